@@ -2,17 +2,33 @@ package auth
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"io"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// Key types that can be used for mailbox and server keys
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// RSA keys generated through GenerateKey use this many bits
+const defaultRSABits = 2048
+
+var ErrUnsupportedKey = errors.New("unsupported key type")
+
 func GeneratePrivateKey(bits int) (p *rsa.PrivateKey, e error) {
 	p, e = rsa.GenerateKey(rand.Reader, bits)
 	if e != nil {
@@ -23,23 +39,82 @@ func GeneratePrivateKey(bits int) (p *rsa.PrivateKey, e error) {
 	return
 }
 
-func StringForPrivateKey(p *rsa.PrivateKey) string {
-	bytes := x509.MarshalPKCS1PrivateKey(p)
+// Function GenerateKey generates a new private key of the given type.
+// A blank key type generates an RSA key
+func GenerateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA, "":
+		return GeneratePrivateKey(defaultRSABits)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+
+	return nil, ErrUnsupportedKey
+}
+
+// Function KeyType returns the key type constant for a public or private
+// key. ECDSA keys are only supported on the P-256 curve
+func KeyType(key interface{}) string {
+	switch key := key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return KeyTypeRSA
+	case *ecdsa.PrivateKey:
+		if key.Curve == elliptic.P256() {
+			return KeyTypeECDSA
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return KeyTypeECDSA
+		}
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return KeyTypeEd25519
+	}
+	return ""
+}
+
+// Function StringForPrivateKey encodes RSA keys as PKCS1 so existing keys
+// stay readable, and every other key type as PKCS8
+func StringForPrivateKey(p crypto.Signer) string {
+	var bytes []byte
+	if rsaKey, ok := p.(*rsa.PrivateKey); ok {
+		bytes = x509.MarshalPKCS1PrivateKey(rsaKey)
+	} else {
+		var err error
+		if bytes, err = x509.MarshalPKCS8PrivateKey(p); err != nil {
+			return ""
+		}
+	}
+
 	bsf := base64.URLEncoding.EncodeToString(bytes)
 	return bsf
 }
 
-func PrivateKeyFromString(pem string) (*rsa.PrivateKey, error) {
+func PrivateKeyFromString(pem string) (crypto.Signer, error) {
 	der, err := base64.URLEncoding.DecodeString(pem)
 	if err != nil {
 		return nil, err
 	}
 
-	key, err := x509.ParsePKCS1PrivateKey(der)
-	return key, err
+	if rsaKey, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return rsaKey, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok || KeyType(signer) == "" {
+		return nil, ErrUnsupportedKey
+	}
+	return signer, nil
 }
 
-func StringForPublicKey(p *rsa.PublicKey) (string, error) {
+func StringForPublicKey(p crypto.PublicKey) (string, error) {
 	bytes, err := x509.MarshalPKIXPublicKey(p)
 	if err != nil {
 		return "", err
@@ -49,30 +124,61 @@ func StringForPublicKey(p *rsa.PublicKey) (string, error) {
 	return der, nil
 }
 
-func PublicKeyFromString(pk string) (*rsa.PublicKey, error) {
+func PublicKeyFromString(pk string) (crypto.PublicKey, error) {
 	der, err := base64.URLEncoding.DecodeString(pk)
 	if err != nil {
 		return nil, err
 	}
 
 	key, err := x509.ParsePKIXPublicKey(der)
-	rsaKey, ok := key.(*rsa.PublicKey)
-	if ok {
-		return rsaKey, err
+	if err != nil {
+		return nil, err
+	}
+
+	if KeyType(key) == "" {
+		return nil, ErrUnsupportedKey
 	}
-	return nil, err
+	return key, nil
 }
 
-func SignMessageWithKey(key *rsa.PrivateKey, msg string) (sig []byte, err error) {
+// Function SignMessageWithKey signs msg using the algorithm that matches the
+// key: RSA-PSS or ECDSA over a SHA256 hash, or pure Ed25519 over the message
+func SignMessageWithKey(key crypto.Signer, msg string) (sig []byte, err error) {
+	if sk, ok := key.(ServerKey); ok {
+		key = sk.Signer
+	}
+
+	if edKey, ok := key.(ed25519.PrivateKey); ok {
+		sig = ed25519.Sign(edKey, []byte(msg))
+		return
+	}
+
 	hashFunction := sha256.New()
 	io.WriteString(hashFunction, msg)
 	hashSum := hashFunction.Sum(nil)
 
-	sig, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, hashSum, nil)
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, hashSum, nil)
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, ErrUnsupportedKey
+		}
+		sig, err = ecdsa.SignASN1(rand.Reader, key, hashSum)
+	default:
+		err = ErrUnsupportedKey
+	}
 	return
 }
 
-func ValidateSignatureForMessage(msg string, sig []byte, pub *rsa.PublicKey) (err error) {
+func ValidateSignatureForMessage(msg string, sig []byte, pub crypto.PublicKey) (err error) {
+	if edKey, ok := pub.(ed25519.PublicKey); ok {
+		if !ed25519.Verify(edKey, []byte(msg), sig) {
+			err = errors.New("ed25519: verification error")
+		}
+		return
+	}
+
 	hashFunction := sha256.New()
 	io.WriteString(hashFunction, msg)
 	hashSum := hashFunction.Sum(nil)
@@ -81,57 +187,135 @@ func ValidateSignatureForMessage(msg string, sig []byte, pub *rsa.PublicKey) (er
 	return
 }
 
-func ValidateSignatureForHash(hashSum []byte, sig []byte, pub *rsa.PublicKey) (err error) {
-	err = rsa.VerifyPSS(pub, crypto.SHA256, hashSum, sig, nil)
+// Function ValidateSignatureForHash checks an RSA or ECDSA signature of a
+// SHA256 hash. Ed25519 signs the full message so it must go through
+// ValidateSignatureForMessage instead
+func ValidateSignatureForHash(hashSum []byte, sig []byte, pub crypto.PublicKey) (err error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPSS(pub, crypto.SHA256, hashSum, sig, nil)
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			err = ErrUnsupportedKey
+		} else if !ecdsa.VerifyASN1(pub, hashSum, sig) {
+			err = errors.New("ecdsa: verification error")
+		}
+	default:
+		err = ErrUnsupportedKey
+	}
 	return
 }
 
 const tokenDelimeter = "-*-*"
+const nonceDelimeter = "."
+const nanosDelimeter = "_"
 
-func NewToken(p *rsa.PrivateKey) (string, error) {
-	unixTime := time.Now().Unix()
-	timeString := strconv.FormatInt(unixTime, 16)
-	sig, err := SignMessageWithKey(p, timeString)
+// Function NewToken returns a server token made of the current time, to the
+// nanosecond, and a random nonce, signed with the server key. If p is a
+// ServerKey its id is included in the token
+func NewToken(p crypto.Signer) (string, error) {
+	nonce, err := NewNonce()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	timeString := strconv.FormatInt(now.Unix(), 16) + nanosDelimeter + strconv.FormatInt(int64(now.Nanosecond()), 16)
+	message := timeString + nonceDelimeter + nonce
+	if sk, ok := p.(ServerKey); ok {
+		message += nonceDelimeter + sk.Id
+	}
+	sig, err := SignMessageWithKey(p, message)
 	if err != nil {
 		return "", err
 	}
 	bsf := base64.URLEncoding.EncodeToString(sig)
-	finalToken := timeString + tokenDelimeter + bsf
+	finalToken := message + tokenDelimeter + bsf
 	return finalToken, nil
 }
 
-func TokenValid(token string, maxDuration time.Duration, pub *rsa.PublicKey) bool {
-	comps := strings.Split(token, tokenDelimeter)
+// Struct token holds the parsed components of a server token
+type token struct {
+	Message   string // the signed part of the token
+	Nonce     string
+	KeyId     string // id of the server key that signed the token, if any
+	SignedAt  time.Time
+	Signature []byte
+}
+
+func parseToken(tokenString string) (t token, err error) {
+	comps := strings.Split(tokenString, tokenDelimeter)
 	if len(comps) < 2 {
-		return false
+		return t, errors.New("error parsing token: len")
 	}
-	timeString := comps[0]
-	signature := comps[1]
+	t.Message = comps[0]
 
-	sig, err := base64.URLEncoding.DecodeString(signature)
-	if err != nil {
-		return false
+	if t.Signature, err = base64.URLEncoding.DecodeString(comps[1]); err != nil {
+		return
 	}
 
-	unixTime, err := strconv.ParseInt(timeString, 16, 64)
+	messageComps := strings.Split(t.Message, nonceDelimeter)
+	if len(messageComps) < 2 || messageComps[1] == "" {
+		return t, errors.New("error parsing token: nonce")
+	}
+	t.Nonce = messageComps[1]
+	if len(messageComps) > 2 {
+		t.KeyId = messageComps[2]
+	}
+
+	// older tokens were signed with whole seconds and have no nanoseconds
+	timeComps := strings.Split(messageComps[0], nanosDelimeter)
+	unixTime, err := strconv.ParseInt(timeComps[0], 16, 64)
 	if err != nil {
-		return false
+		return
 	}
 
-	signedAt := time.Unix(unixTime, 0)
-	now := time.Now()
-	expirationTime := signedAt.Add(maxDuration)
+	var nanos int64
+	if len(timeComps) > 1 {
+		if nanos, err = strconv.ParseInt(timeComps[1], 16, 64); err != nil {
+			return
+		}
+	}
+	t.SignedAt = time.Unix(unixTime, nanos)
+	return
+}
+
+// Function ExpiresAt returns the time after which the token is no longer
+// accepted when validated against maxDuration
+func (t token) ExpiresAt(maxDuration time.Duration) time.Time {
+	return t.SignedAt.Add(maxDuration)
+}
+
+// Function Valid checks the token's age and signature. pub may be a public
+// key or a KeyResolver, like a KeyRing, that looks up the key by the token's key id
+func (t token) Valid(maxDuration time.Duration, pub crypto.PublicKey) bool {
+	if resolver, ok := pub.(KeyResolver); ok {
+		var err error
+		if pub, err = resolver.PublicKeyFor(t.KeyId); err != nil {
+			return false
+		}
+	}
 
-	signedAtAfterNow := signedAt.After(now)
-	nowAfterExpiration := now.After(expirationTime)
+	now := time.Now()
+	signedAtAfterNow := t.SignedAt.After(now)
+	nowAfterExpiration := now.After(t.ExpiresAt(maxDuration))
 
 	if signedAtAfterNow || nowAfterExpiration {
 		return false
 	}
 
-	if err := ValidateSignatureForMessage(timeString, sig, pub); err != nil {
+	if err := ValidateSignatureForMessage(t.Message, t.Signature, pub); err != nil {
 		return false
 	}
 
 	return true
 }
+
+func TokenValid(tokenString string, maxDuration time.Duration, pub crypto.PublicKey) bool {
+	t, err := parseToken(tokenString)
+	if err != nil {
+		return false
+	}
+
+	return t.Valid(maxDuration, pub)
+}
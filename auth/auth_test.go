@@ -1,7 +1,14 @@
 package auth
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
 	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -41,11 +48,16 @@ func TestParsePrivateKey(t *testing.T) {
 		t.Fatal("Error parsing key", err)
 	}
 
-	if err := parsedKey.Validate(); err != nil {
+	parsedRSAKey, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		t.Fatal("Error: parsed key is not an RSA key")
+	}
+
+	if err := parsedRSAKey.Validate(); err != nil {
 		t.Fatal("Error validating parsed key:", err)
 	}
 
-	if StringForPrivateKey(parsedKey) != keyString {
+	if StringForPrivateKey(parsedRSAKey) != keyString {
 		t.Error("Error: Parsed private key does not match original")
 	}
 }
@@ -116,6 +128,7 @@ func TestToken(t *testing.T) {
 		t.Fatal("Error: freshly generated token already invalid:", token)
 	}
 
+	time.Sleep(2 * expirationDuration)
 	if TokenValid(token, expirationDuration, &privateKey.PublicKey) {
 		t.Fatal("Error: token still valid after expiration")
 	}
@@ -129,3 +142,169 @@ func TestToken(t *testing.T) {
 		t.Fatal("Error: token valid for another public key")
 	}
 }
+
+func TestKeyTypes(t *testing.T) {
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		privateKey, err := GenerateKey(keyType)
+		if err != nil {
+			t.Fatal("Error generating", keyType, "key:", err)
+		}
+
+		if KeyType(privateKey) != keyType || KeyType(privateKey.Public()) != keyType {
+			t.Fatal("Error: expected key type", keyType, "but got", KeyType(privateKey))
+		}
+
+		parsedKey, err := PrivateKeyFromString(StringForPrivateKey(privateKey))
+		if err != nil {
+			t.Fatal("Error parsing", keyType, "private key:", err)
+		}
+
+		publicKeyString, err := StringForPublicKey(privateKey.Public())
+		if err != nil {
+			t.Fatal("Error marshaling", keyType, "public key:", err)
+		}
+
+		publicKey, err := PublicKeyFromString(publicKeyString)
+		if err != nil {
+			t.Fatal("Error parsing", keyType, "public key:", err)
+		}
+
+		sig, err := SignMessageWithKey(parsedKey, "hello world")
+		if err != nil {
+			t.Fatal("Error signing message with", keyType, "key:", err)
+		}
+
+		if err := ValidateSignatureForMessage("hello world", sig, publicKey); err != nil {
+			t.Fatal("Error verifying", keyType, "signature:", err)
+		}
+
+		if err := ValidateSignatureForMessage("goodbye world", sig, publicKey); err == nil {
+			t.Fatal("Error:", keyType, "signature valid for a different message")
+		}
+
+		token, err := NewToken(privateKey)
+		if err != nil {
+			t.Fatal("Error generating token with", keyType, "key:", err)
+		}
+
+		if !TokenValid(token, 1*time.Hour, publicKey) {
+			t.Fatal("Error: freshly generated", keyType, "token invalid:", token)
+		}
+	}
+
+	if _, err := GenerateKey("dsa"); err != ErrUnsupportedKey {
+		t.Fatal("Expected unsupported key error but got", err)
+	}
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating P-384 key:", err)
+	}
+
+	publicKeyString, err := StringForPublicKey(p384Key.Public())
+	if err != nil {
+		t.Fatal("Error marshaling P-384 public key:", err)
+	}
+
+	if _, err := PublicKeyFromString(publicKeyString); err != ErrUnsupportedKey {
+		t.Fatal("Expected unsupported key error for a P-384 public key but got", err)
+	}
+
+	if _, err := PrivateKeyFromString(StringForPrivateKey(p384Key)); err != ErrUnsupportedKey {
+		t.Fatal("Expected unsupported key error for a P-384 private key but got", err)
+	}
+}
+
+type testNonceStore map[string]bool
+
+func (ns testNonceStore) SpendNonce(nonce string, expiration time.Duration) (bool, error) {
+	if ns[nonce] {
+		return false, nil
+	}
+	ns[nonce] = true
+	return true, nil
+}
+
+func TestTokenNonce(t *testing.T) {
+	privateKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+
+	token, err := NewToken(privateKey)
+	if err != nil {
+		t.Fatal("Error generating token:", err)
+	}
+
+	anotherToken, err := NewToken(privateKey)
+	if err != nil {
+		t.Fatal("Error generating token:", err)
+	}
+
+	if token == anotherToken {
+		t.Fatal("Error: two tokens generated in the same second are equal")
+	}
+
+	store := testNonceStore{}
+	if !TokenValidOnce(token, 1*time.Hour, privateKey.Public(), store) {
+		t.Fatal("Error: fresh token rejected by TokenValidOnce")
+	}
+
+	if TokenValidOnce(token, 1*time.Hour, privateKey.Public(), store) {
+		t.Fatal("Error: token accepted twice by TokenValidOnce")
+	}
+
+	if !TokenValid(token, 1*time.Hour, privateKey.Public()) {
+		t.Fatal("Error: TokenValid should not spend token nonces")
+	}
+
+	comps := strings.Split(token, tokenDelimeter)
+	noNonce := strings.Split(comps[0], nonceDelimeter)[0]
+	sig, err := SignMessageWithKey(privateKey, noNonce)
+	if err != nil {
+		t.Fatal("Error signing message:", err)
+	}
+
+	oldStyleToken := noNonce + tokenDelimeter + base64.URLEncoding.EncodeToString(sig)
+	if TokenValid(oldStyleToken, 1*time.Hour, privateKey.Public()) {
+		t.Fatal("Error: token without a nonce was accepted")
+	}
+}
+
+func TestTokenSignedAt(t *testing.T) {
+	privateKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+
+	before := time.Now()
+	token, err := NewToken(privateKey)
+	if err != nil {
+		t.Fatal("Error generating token:", err)
+	}
+
+	parsed, err := parseToken(token)
+	if err != nil || parsed.SignedAt.Before(before) || parsed.SignedAt.After(time.Now()) {
+		t.Fatal("Expected token signed at", before, "to the nanosecond but got", parsed.SignedAt, err)
+	}
+
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal("Error generating nonce:", err)
+	}
+
+	message := strconv.FormatInt(before.Unix(), 16) + nonceDelimeter + nonce
+	sig, err := SignMessageWithKey(privateKey, message)
+	if err != nil {
+		t.Fatal("Error signing message:", err)
+	}
+
+	wholeSecondToken := message + tokenDelimeter + base64.URLEncoding.EncodeToString(sig)
+	if parsed, err := parseToken(wholeSecondToken); err != nil || parsed.SignedAt.Unix() != before.Unix() || parsed.SignedAt.Nanosecond() != 0 {
+		t.Fatal("Expected token signed with whole seconds to parse but got", parsed.SignedAt, err)
+	}
+
+	if !TokenValid(wholeSecondToken, 1*time.Hour, privateKey.Public()) {
+		t.Fatal("Error: token signed with whole seconds was rejected")
+	}
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"crypto"
+	"fmt"
+)
+
+// DeviceRegistration adds a device with its own key to a mailbox. Like a
+// KeyRotation it must be signed by a key the mailbox already trusts, either
+// the mailbox key or the key of another device
+type DeviceRegistration struct {
+	MailboxId string
+	Name      string
+	PublicKey string // the key of the new device
+	Token     string // a server token, so the registration can not be replayed later
+	Signature []byte
+}
+
+func (dr DeviceRegistration) Message() string {
+	return fmt.Sprintf("add-device!@@!%s!@@!%s!@@!%s!@@!%s", dr.MailboxId, dr.Name, dr.PublicKey, dr.Token)
+}
+
+func (dr DeviceRegistration) SignatureFor(signer crypto.Signer) ([]byte, error) {
+	return SignMessageWithKey(signer, dr.Message())
+}
+
+// Function ValidOnce checks that the device key can be parsed, that the
+// registration was signed by signer and that the server token is valid.
+// If store is not nil the token is spent
+func (dr DeviceRegistration) ValidOnce(signer crypto.PublicKey, server crypto.PublicKey, store NonceStore) error {
+	return validateKeyGrant(dr.Message(), dr.PublicKey, dr.Token, dr.Signature, signer, server, store)
+}
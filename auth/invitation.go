@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Invitations can not be valid for longer than this
+const MaxInvitationDuration = 7 * 24 * time.Hour
+
+// Invitation grants membership of a thread to whoever redeems it. The
+// server signs invitations, so clients can not forge or change them
+type Invitation struct {
+	Id                string
+	ThreadId          string
+	AllowRead         bool
+	AllowWrite        bool
+	AllowNotification bool
+	ExpiresAt         time.Time
+	MaxUses           int    // 0 if the invitation can be used any number of times
+	KeyId             string `json:",omitempty"` // id of the server key that signed the invitation
+}
+
+// Function Token signs the invitation and returns it as a string that can be
+// shared, in the form base64(json)-*-*base64(signature)
+func (inv Invitation) Token(signer crypto.Signer) (string, error) {
+	if sk, ok := signer.(ServerKey); ok {
+		inv.KeyId = sk.Id
+	}
+
+	invitationJSON, err := json.Marshal(inv)
+	if err != nil {
+		return "", err
+	}
+
+	message := base64.URLEncoding.EncodeToString(invitationJSON)
+	sig, err := SignMessageWithKey(signer, message)
+	if err != nil {
+		return "", err
+	}
+
+	return message + tokenDelimeter + base64.URLEncoding.EncodeToString(sig), nil
+}
+
+// Function ParseInvitation checks the signature and expiration of an
+// invitation token and returns the invitation. server may be a public key or
+// a KeyResolver, like a KeyRing
+func ParseInvitation(tokenString string, server crypto.PublicKey) (inv Invitation, err error) {
+	comps := strings.Split(tokenString, tokenDelimeter)
+	if len(comps) != 2 {
+		return inv, errors.New("error parsing invitation: len")
+	}
+
+	invitationJSON, err := base64.URLEncoding.DecodeString(comps[0])
+	if err != nil {
+		return
+	}
+
+	sig, err := base64.URLEncoding.DecodeString(comps[1])
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(invitationJSON, &inv); err != nil {
+		return
+	}
+
+	if resolver, ok := server.(KeyResolver); ok {
+		if server, err = resolver.PublicKeyFor(inv.KeyId); err != nil {
+			return
+		}
+	}
+
+	if err = ValidateSignatureForMessage(comps[0], sig, server); err != nil {
+		return inv, errors.New("invitation signature invalid")
+	}
+
+	if time.Now().After(inv.ExpiresAt) {
+		return inv, errors.New("invitation has expired")
+	}
+	return inv, nil
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvitation(t *testing.T) {
+	var kr KeyRing
+	serverKey, err := kr.Rotate(KeyTypeEd25519, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv := Invitation{
+		Id:        "invitation-id",
+		ThreadId:  "thread-id",
+		AllowRead: true,
+		ExpiresAt: time.Now().Add(time.Hour),
+		MaxUses:   3,
+	}
+
+	token, err := inv.Token(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseInvitation(token, kr)
+	if err != nil {
+		t.Fatal("Error parsing invitation:", err)
+	}
+
+	if parsed.Id != inv.Id || parsed.ThreadId != inv.ThreadId || !parsed.AllowRead || parsed.AllowWrite || parsed.MaxUses != 3 {
+		t.Fatal("Expected invitation", inv, "but got", parsed)
+	}
+
+	otherKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged, err := inv.Token(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseInvitation(forged, kr); err == nil {
+		t.Fatal("Error: invitation signed by another key was accepted")
+	}
+
+	inv.ExpiresAt = time.Now().Add(-time.Minute)
+	expired, err := inv.Token(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseInvitation(expired, kr); err == nil {
+		t.Fatal("Error: expired invitation was accepted")
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ServerKey is a server signing key with an id. Tokens signed with
+// a ServerKey embed its id so the right public key can be found later
+type ServerKey struct {
+	crypto.Signer
+	Id        string
+	CreatedAt time.Time
+	RetiresAt time.Time // zero until a newer key replaces this one
+}
+
+// KeyResolver finds the public key a token was signed with by key id
+type KeyResolver interface {
+	PublicKeyFor(keyId string) (crypto.PublicKey, error)
+}
+
+// KeyRing holds every server key that has not been pruned, oldest first.
+// New tokens are signed with the newest key
+type KeyRing []ServerKey
+
+// Function NewServerKey generates a new key of the given type. Its id
+// is derived from the public key
+func NewServerKey(keyType string) (sk ServerKey, err error) {
+	if sk.Signer, err = GenerateKey(keyType); err != nil {
+		return
+	}
+
+	sk.CreatedAt = time.Now()
+	sk.Id, err = KeyId(sk.Public())
+	return
+}
+
+// Function KeyId returns a short fingerprint of a public key
+func KeyId(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func (sk ServerKey) Retired() bool {
+	return !sk.RetiresAt.IsZero() && time.Now().After(sk.RetiresAt)
+}
+
+type storedServerKey struct {
+	Id        string
+	Key       string
+	CreatedAt time.Time
+	RetiresAt time.Time
+}
+
+func (sk ServerKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(storedServerKey{
+		Id:        sk.Id,
+		Key:       StringForPrivateKey(sk.Signer),
+		CreatedAt: sk.CreatedAt,
+		RetiresAt: sk.RetiresAt,
+	})
+}
+
+func (sk *ServerKey) UnmarshalJSON(data []byte) (err error) {
+	var stored storedServerKey
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return
+	}
+
+	if sk.Signer, err = PrivateKeyFromString(stored.Key); err != nil {
+		return
+	}
+
+	sk.Id = stored.Id
+	sk.CreatedAt = stored.CreatedAt
+	sk.RetiresAt = stored.RetiresAt
+	return
+}
+
+// Function Newest returns the key that new tokens should be signed with
+func (kr KeyRing) Newest() (ServerKey, error) {
+	if len(kr) == 0 {
+		return ServerKey{}, errors.New("key ring is empty")
+	}
+	return kr[len(kr)-1], nil
+}
+
+// Function PublicKeyFor returns the public key for a key id,
+// as long as that key has not been retired
+func (kr KeyRing) PublicKeyFor(keyId string) (crypto.PublicKey, error) {
+	for _, sk := range kr {
+		if sk.Id != keyId {
+			continue
+		}
+
+		if sk.Retired() {
+			return nil, errors.New("server key has been retired")
+		}
+		return sk.Public(), nil
+	}
+
+	return nil, errors.New("no server key found with that id")
+}
+
+// Function Rotate adds a newly generated key to the ring. Older keys
+// retire after gracePeriod so tokens they signed can still be used
+// until then. Keys that have already retired are removed
+func (kr *KeyRing) Rotate(keyType string, gracePeriod time.Duration) (ServerKey, error) {
+	sk, err := NewServerKey(keyType)
+	if err != nil {
+		return sk, err
+	}
+
+	kr.Add(sk, gracePeriod)
+	return sk, nil
+}
+
+// Function Add makes sk the newest key in the ring. See Rotate
+func (kr *KeyRing) Add(sk ServerKey, gracePeriod time.Duration) {
+	retiresAt := time.Now().Add(gracePeriod)
+	active := KeyRing{}
+	for _, existing := range *kr {
+		if existing.Retired() {
+			continue
+		}
+
+		if existing.RetiresAt.IsZero() {
+			existing.RetiresAt = retiresAt
+		}
+		active = append(active, existing)
+	}
+
+	*kr = append(active, sk)
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	kr := KeyRing{}
+	if _, err := kr.Newest(); err == nil {
+		t.Fatal("Error: empty key ring returned a newest key")
+	}
+
+	oldKey, err := kr.Rotate(KeyTypeEd25519, 1*time.Hour)
+	if err != nil {
+		t.Fatal("Error rotating key ring:", err)
+	}
+
+	oldToken, err := NewToken(oldKey)
+	if err != nil {
+		t.Fatal("Error generating token:", err)
+	}
+
+	newKey, err := kr.Rotate(KeyTypeECDSA, 1*time.Hour)
+	if err != nil {
+		t.Fatal("Error rotating key ring:", err)
+	}
+
+	if newest, _ := kr.Newest(); newest.Id != newKey.Id {
+		t.Fatal("Error: expected newest key", newKey.Id, "but got", newest.Id)
+	}
+
+	newToken, err := NewToken(newKey)
+	if err != nil {
+		t.Fatal("Error generating token:", err)
+	}
+
+	if !TokenValid(oldToken, 1*time.Hour, kr) || !TokenValid(newToken, 1*time.Hour, kr) {
+		t.Fatal("Error: key ring rejected a token signed by an active key")
+	}
+
+	if TokenValid(oldToken, 1*time.Hour, newKey.Public()) {
+		t.Fatal("Error: token valid for a different server key")
+	}
+
+	kr[0].RetiresAt = time.Now().Add(-1 * time.Second)
+	if TokenValid(oldToken, 1*time.Hour, kr) {
+		t.Fatal("Error: key ring accepted a token signed by a retired key")
+	}
+
+	if _, err := kr.Rotate(KeyTypeRSA, 1*time.Hour); err != nil {
+		t.Fatal("Error rotating key ring:", err)
+	}
+
+	if len(kr) != 2 || kr[0].Id != newKey.Id {
+		t.Fatal("Error: retired key was not pruned from the ring")
+	}
+
+	if !TokenValid(newToken, 1*time.Hour, kr) {
+		t.Fatal("Error: token rejected during its key's grace period")
+	}
+}
+
+func TestKeyRingJSON(t *testing.T) {
+	kr := KeyRing{}
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeEd25519} {
+		if _, err := kr.Rotate(keyType, 1*time.Hour); err != nil {
+			t.Fatal("Error rotating key ring:", err)
+		}
+	}
+
+	ringJSON, err := json.Marshal(kr)
+	if err != nil {
+		t.Fatal("Error marshaling key ring:", err)
+	}
+
+	parsed := KeyRing{}
+	if err := json.Unmarshal(ringJSON, &parsed); err != nil {
+		t.Fatal("Error unmarshaling key ring:", err)
+	}
+
+	if len(parsed) != len(kr) {
+		t.Fatal("Expected", len(kr), "keys but got", len(parsed))
+	}
+
+	for i := range kr {
+		if parsed[i].Id != kr[i].Id || !parsed[i].RetiresAt.Equal(kr[i].RetiresAt) {
+			t.Fatal("Error: parsed key", parsed[i].Id, "does not match", kr[i].Id)
+		}
+
+		if StringForPrivateKey(parsed[i].Signer) != StringForPrivateKey(kr[i].Signer) {
+			t.Fatal("Error: parsed private key does not match original")
+		}
+	}
+}
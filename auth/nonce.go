@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Number of random bytes in a token nonce
+const nonceSize = 16
+
+// NonceStore remembers which token nonces have already been used
+type NonceStore interface {
+	// SpendNonce marks a nonce as used until expiration passes. It returns
+	// false if the nonce had already been spent
+	SpendNonce(nonce string, expiration time.Duration) (bool, error)
+}
+
+// When SingleUseStore is set, Request and Session.ValidOnce only accept
+// each token once. Leave it nil to allow tokens to be reused until they expire
+var SingleUseStore NonceStore
+
+// Function NewNonce returns a random hex encoded nonce
+func NewNonce() (string, error) {
+	bytes := make([]byte, nonceSize)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Function TokenValidOnce works like TokenValid, but also spends the token's
+// nonce in store so the token can not be replayed. A nil store is ignored
+func TokenValidOnce(tokenString string, maxDuration time.Duration, pub crypto.PublicKey, store NonceStore) bool {
+	t, err := parseToken(tokenString)
+	if err != nil || !t.Valid(maxDuration, pub) {
+		return false
+	}
+
+	if store == nil {
+		return true
+	}
+
+	// keep the nonce around a little longer than the token to allow for clock skew
+	expiration := t.ExpiresAt(maxDuration).Sub(time.Now()) + time.Minute
+	fresh, err := store.SpendNonce(t.Nonce, expiration)
+	return err == nil && fresh
+}
@@ -1,7 +1,7 @@
 package auth
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"net/http"
 	"time"
 )
@@ -12,7 +12,7 @@ const tokenAuthorizationDuration = 15 * time.Minute
 // Function request checks if the API token provided is valid
 // and if not returns a 403 Forbidden returns true if request
 // is authorized, false if request was blocked
-func Request(w http.ResponseWriter, r *http.Request, pub *rsa.PublicKey) bool {
+func Request(w http.ResponseWriter, r *http.Request, pub crypto.PublicKey) bool {
 	if !RequestValid(w, r, pub) {
 		http.Error(w, "Unauthorized -- Invalid API Token", 403)
 		return false
@@ -20,12 +20,12 @@ func Request(w http.ResponseWriter, r *http.Request, pub *rsa.PublicKey) bool {
 	return true
 }
 
-func RequestValid(w http.ResponseWriter, r *http.Request, pub *rsa.PublicKey) bool {
+func RequestValid(w http.ResponseWriter, r *http.Request, pub crypto.PublicKey) bool {
 	token := r.Header.Get("X-API-Token")
 	if token == "" {
 		token = r.URL.Query().Get("token")
 	}
 
-	tokenValid := TokenValid(token, tokenAuthorizationDuration, pub)
+	tokenValid := TokenValidOnce(token, tokenAuthorizationDuration, pub, SingleUseStore)
 	return tokenValid
 }
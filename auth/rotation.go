@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Key rotations must be signed within this long of getting a server token
+const keyRotationDuration = 15 * time.Minute
+
+// A mailbox can keep accepting its old key for at most this long after a rotation
+const MaxKeyGracePeriod = MaxSessionDuration
+
+// KeyRotation asks to replace the public key of a mailbox. It must be signed
+// with the current mailbox key, so a session alone can not change the key
+type KeyRotation struct {
+	MailboxId string
+	PublicKey string // the new public key
+	Token     string // a server token, so the rotation can not be replayed later
+	Signature []byte // signature of the current mailbox key over Message
+}
+
+func (kr KeyRotation) Message() string {
+	return fmt.Sprintf("rotate-key!@@!%s!@@!%s!@@!%s", kr.MailboxId, kr.PublicKey, kr.Token)
+}
+
+func (kr KeyRotation) SignatureFor(current crypto.Signer) ([]byte, error) {
+	return SignMessageWithKey(current, kr.Message())
+}
+
+func (kr KeyRotation) SignatureString() string {
+	return base64.URLEncoding.EncodeToString(kr.Signature)
+}
+
+// Function ValidOnce checks that the new key can be parsed, that the rotation
+// was signed by the current mailbox key and that the server token is valid.
+// If store is not nil the token is spent
+func (kr KeyRotation) ValidOnce(current crypto.PublicKey, server crypto.PublicKey, store NonceStore) error {
+	return validateKeyGrant(kr.Message(), kr.PublicKey, kr.Token, kr.Signature, current, server, store)
+}
+
+// Function validateKeyGrant checks a request to trust a new public key that
+// was signed by a key that is already trusted
+func validateKeyGrant(message, publicKey, token string, signature []byte, signer, server crypto.PublicKey, store NonceStore) error {
+	if _, err := PublicKeyFromString(publicKey); err != nil {
+		return errors.New("new public key is invalid")
+	}
+
+	if err := ValidateSignatureForMessage(message, signature, signer); err != nil {
+		return errors.New("request was not signed by a key of the mailbox")
+	}
+
+	if !TokenValidOnce(token, keyRotationDuration, server, store) {
+		return errors.New("token has expired, is invalid or was already used")
+	}
+
+	return nil
+}
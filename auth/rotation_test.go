@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestKeyRotation(t *testing.T) {
+	serverKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentKey, err := GenerateKey(KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := NewToken(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPublicKey, err := StringForPublicKey(newKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kr := KeyRotation{
+		MailboxId: "mailbox-id",
+		PublicKey: newPublicKey,
+		Token:     token,
+	}
+
+	// signing with the new key does not prove the client holds the current one
+	if kr.Signature, err = kr.SignatureFor(newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kr.ValidOnce(currentKey.Public(), serverKey.Public(), nil); err == nil {
+		t.Fatal("Error: rotation signed by the new key was accepted")
+	}
+
+	if kr.Signature, err = kr.SignatureFor(currentKey); err != nil {
+		t.Fatal(err)
+	}
+
+	store := testNonceStore{}
+	if err := kr.ValidOnce(currentKey.Public(), serverKey.Public(), store); err != nil {
+		t.Fatal("Error validating key rotation:", err)
+	}
+
+	if err := kr.ValidOnce(currentKey.Public(), serverKey.Public(), store); err == nil {
+		t.Fatal("Error: key rotation was accepted twice")
+	}
+
+	kr.MailboxId = "another-mailbox-id"
+	if err := kr.ValidOnce(currentKey.Public(), serverKey.Public(), nil); err == nil {
+		t.Fatal("Error: key rotation was accepted for another mailbox")
+	}
+}
+
+func TestDeviceRegistration(t *testing.T) {
+	serverKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailboxKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceKey, err := GenerateKey(KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := NewToken(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dr := DeviceRegistration{MailboxId: "mailbox-id", Name: "laptop", Token: token}
+	if dr.PublicKey, err = StringForPublicKey(deviceKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	if dr.Signature, err = dr.SignatureFor(deviceKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dr.ValidOnce(mailboxKey.Public(), serverKey.Public(), nil); err == nil {
+		t.Fatal("Error: device registration signed only by the new device was accepted")
+	}
+
+	if dr.Signature, err = dr.SignatureFor(mailboxKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dr.ValidOnce(mailboxKey.Public(), serverKey.Public(), nil); err != nil {
+		t.Fatal("Error validating device registration:", err)
+	}
+
+	dr.Name = "someone elses laptop"
+	if err := dr.ValidOnce(mailboxKey.Public(), serverKey.Public(), nil); err == nil {
+		t.Fatal("Error: device registration was accepted after changing the name")
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Scope restricts what a session may do. The zero value is unrestricted.
+// The scope is part of the session message, so it is signed by the client
+type Scope struct {
+	ReadOnly bool     `json:"read_only,omitempty"`
+	Threads  []string `json:"threads,omitempty"` // thread ids the session may access, all if empty
+	Topics   []string `json:"topics,omitempty"`  // topic patterns like "telemetry.*", all if empty
+}
+
+func ParseScope(scopeString string) (sc Scope, err error) {
+	scopeJSON, err := base64.URLEncoding.DecodeString(scopeString)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(scopeJSON, &sc)
+	return
+}
+
+// Function String encodes the scope for use in a session string.
+// Unrestricted scopes encode to a blank string
+func (sc Scope) String() string {
+	if !sc.Restricted() {
+		return ""
+	}
+
+	scopeJSON, _ := json.Marshal(sc)
+	return base64.URLEncoding.EncodeToString(scopeJSON)
+}
+
+// Function Restricted returns true if the scope limits the session in any way
+func (sc Scope) Restricted() bool {
+	return sc.ReadOnly || len(sc.Threads) > 0 || len(sc.Topics) > 0
+}
+
+func (sc Scope) AllowsThread(threadId string) bool {
+	if len(sc.Threads) == 0 {
+		return true
+	}
+
+	for _, allowed := range sc.Threads {
+		if allowed == threadId {
+			return true
+		}
+	}
+	return false
+}
+
+// Function AllowsTopic matches the topic against the scope's topic
+// patterns with MatchTopic
+func (sc Scope) AllowsTopic(topic string) bool {
+	return MatchTopic(sc.Topics, topic)
+}
@@ -1,8 +1,10 @@
 package auth
 
 import (
-	"crypto/rsa"
+	"crypto"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strconv"
@@ -10,10 +12,14 @@ import (
 	"time"
 )
 
+// Sessions can not last longer than this, whatever duration the client signs
+const MaxSessionDuration = 24 * time.Hour
+
 type Session struct {
 	Token     string        // A token from the server
 	Duration  time.Duration // the duration of the session
 	Signature []byte        // Client signature of session message
+	Scope     Scope         // Optional limits on what the session can do
 }
 
 func ParseSession(sessionKey string) (Session, error) {
@@ -30,7 +36,15 @@ func ParseSession(sessionKey string) (Session, error) {
 	}
 	s.Duration = time.Duration(durationInt) * time.Second
 
-	s.Signature, err = base64.URLEncoding.DecodeString(comps[2])
+	signature := comps[2]
+	if len(comps) > 3 { // scoped sessions have the scope before the signature
+		if s.Scope, err = ParseScope(comps[2]); err != nil {
+			return s, errors.New("error parsing session key: scope")
+		}
+		signature = comps[3]
+	}
+
+	s.Signature, err = base64.URLEncoding.DecodeString(signature)
 	if err != nil {
 		return s, errors.New("Error parsing session key: bsf")
 	}
@@ -40,10 +54,13 @@ func ParseSession(sessionKey string) (Session, error) {
 
 func (s Session) Message() string {
 	secs := s.Duration / time.Second
+	if scope := s.Scope.String(); scope != "" {
+		return fmt.Sprintf("%s!@@!%d!@@!%s", s.Token, secs, scope)
+	}
 	return fmt.Sprintf("%s!@@!%d", s.Token, secs)
 }
 
-func (s Session) SignatureFor(priv *rsa.PrivateKey) ([]byte, error) {
+func (s Session) SignatureFor(priv crypto.Signer) ([]byte, error) {
 	sig, err := SignMessageWithKey(priv, s.Message())
 	return sig, err
 }
@@ -57,18 +74,48 @@ func (s Session) String() string {
 	return fmt.Sprintf("%s!@@!%s", s.Message(), s.SignatureString())
 }
 
-func (s Session) Valid(client *rsa.PublicKey, server *rsa.PublicKey) error {
-	if err := ValidateSignatureForMessage(s.Message(), s.Signature, client); err != nil {
-		return fmt.Errorf("client signature invalid") // the client did not sign off on this
+// Function Id returns an identifier for the session that is safe to show
+// to clients. The same session string always has the same id
+func (s Session) Id() string {
+	sum := sha256.Sum256([]byte(s.String()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Function IssuedAt returns the time the server token was signed
+func (s Session) IssuedAt() (time.Time, error) {
+	t, err := parseToken(s.Token)
+	return t.SignedAt, err
+}
+
+// Function ExpiresAt returns the time after which the session is no longer valid
+func (s Session) ExpiresAt() (time.Time, error) {
+	t, err := parseToken(s.Token)
+	return t.ExpiresAt(s.MaxDuration()), err
+}
+
+// Function MaxDuration returns the session duration, capped at MaxSessionDuration
+func (s Session) MaxDuration() time.Duration {
+	if s.Duration > MaxSessionDuration {
+		return MaxSessionDuration
 	}
+	return s.Duration
+}
 
-	maxDuration := s.Duration
-	if maxDuration > (24 * time.Hour) {
-		maxDuration = 24 * time.Hour
+// Function Valid checks the client signature and the server token. server may
+// be a single public key or a KeyResolver such as a KeyRing
+func (s Session) Valid(client crypto.PublicKey, server crypto.PublicKey) error {
+	return s.ValidOnce(client, server, nil)
+}
+
+// Function ValidOnce validates the session like Valid. If store is not nil
+// the server token is spent, so the same token can not start another session
+func (s Session) ValidOnce(client crypto.PublicKey, server crypto.PublicKey, store NonceStore) error {
+	if err := ValidateSignatureForMessage(s.Message(), s.Signature, client); err != nil {
+		return fmt.Errorf("client signature invalid") // the client did not sign off on this
 	}
 
-	if TokenValid(s.Token, maxDuration, server) == false {
-		return fmt.Errorf("token has expired or is invalid")
+	if TokenValidOnce(s.Token, s.MaxDuration(), server, store) == false {
+		return fmt.Errorf("token has expired, is invalid or was already used")
 	}
 
 	return nil
@@ -43,3 +43,141 @@ func TestSession(t *testing.T) {
 		t.Fatal("session was supposed to expire but did not")
 	}
 }
+
+func TestMixedKeySession(t *testing.T) {
+	serverKey, err := GenerateKey(KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := NewToken(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Session{
+		Token:    token,
+		Duration: 1 * time.Hour,
+	}
+
+	if s.Signature, err = s.SignatureFor(clientKey); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseSession(s.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parsed.Valid(clientKey.Public(), serverKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parsed.Valid(serverKey.Public(), clientKey.Public()); err == nil {
+		t.Fatal("session valid with client and server keys swapped")
+	}
+}
+
+func TestSessionId(t *testing.T) {
+	serverKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := NewToken(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Session{Token: token, Duration: 48 * time.Hour}
+	if s.Signature, err = s.SignatureFor(clientKey); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseSession(s.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Id() != s.Id() || len(s.Id()) == 0 {
+		t.Fatal("expected session id", s.Id(), "but got", parsed.Id())
+	}
+
+	issuedAt, err := s.IssuedAt()
+	if err != nil || time.Since(issuedAt) > time.Minute {
+		t.Fatal("unexpected session issue time", issuedAt, err)
+	}
+
+	expiresAt, err := s.ExpiresAt()
+	if err != nil || expiresAt.Sub(issuedAt) != MaxSessionDuration {
+		t.Fatal("expected session to be capped at", MaxSessionDuration, "but it expires at", expiresAt)
+	}
+}
+
+func TestScopedSession(t *testing.T) {
+	serverKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := GenerateKey(KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := NewToken(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Session{
+		Token:    token,
+		Duration: 1 * time.Hour,
+		Scope: Scope{
+			ReadOnly: true,
+			Threads:  []string{"thread-a"},
+			Topics:   []string{"telemetry.*", "chat"},
+		},
+	}
+
+	if s.Signature, err = s.SignatureFor(clientKey); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseSession(s.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parsed.Valid(clientKey.Public(), serverKey.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !parsed.Scope.ReadOnly || !parsed.Scope.AllowsThread("thread-a") || parsed.Scope.AllowsThread("thread-b") {
+		t.Fatal("parsed scope does not match", parsed.Scope)
+	}
+
+	if !parsed.Scope.AllowsTopic("telemetry.cpu") || !parsed.Scope.AllowsTopic("chat") || parsed.Scope.AllowsTopic("chat-admin") {
+		t.Fatal("unexpected topic matches for scope", parsed.Scope)
+	}
+
+	// widening the scope must break the client signature
+	parsed.Scope.ReadOnly = false
+	if err := parsed.Valid(clientKey.Public(), serverKey.Public()); err == nil {
+		t.Fatal("session with modified scope is still valid")
+	}
+
+	if (Scope{}).Restricted() || !parsed.Scope.Restricted() {
+		t.Fatal("unexpected result from Restricted")
+	}
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Function TopicRegexp turns a topic pattern like "telemetry.*", where * matches
+// any run of characters except / and every other character matches itself,
+// into an anchored regular expression. The same expression is used by Go and
+// by postgres, so scopes, member topics and queries all agree on what matches
+func TopicRegexp(pattern string) string {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.Replace(quoted, `\*`, `[^/]*`, -1)
+	return "^" + quoted + "$"
+}
+
+// Function MatchTopic returns true if the topic matches any of the
+// patterns. Every topic matches an empty list of patterns
+func MatchTopic(patterns []string, topic string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, err := regexp.MatchString(TopicRegexp(pattern), topic); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
@@ -1,36 +1,152 @@
 package controller
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"fmt"
 	"github.com/omarqazi/hearst/auth"
 	"github.com/omarqazi/hearst/datastore"
 	"log"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
-var serverSessionKey *rsa.PrivateKey
+// The type of key to generate when adding a server session key.
+// One of rsa, ecdsa or ed25519. Defaults to rsa
+const sessionKeyTypeVariable = "HEARST_SESSION_KEY_TYPE"
 
-const keySize = 2048
-const sessionKeyCacheLocation = "hearst-env-server-session-key"
+// If set to true, each server token can only be used once
+// to establish a socket session or authorize an API request
+const singleUseTokensVariable = "HEARST_SINGLE_USE_TOKENS"
+
+// How long a server signs with its cached key ring before reloading it,
+// to pick up keys added by rotations on other servers
+const serverKeyRingMaxAge = time.Minute
+
+// Struct serverKeyRing caches the server key ring stored in redis
+// so tokens can be signed and checked without a round trip
+type serverKeyRing struct {
+	sync.RWMutex
+	ring     auth.KeyRing
+	loadedAt time.Time
+}
+
+var serverKeys = &serverKeyRing{}
 
 func init() {
-	privateKeyString, err := datastore.RedisDb.Get(sessionKeyCacheLocation).Result()
-	if err != nil {
-		serverSessionKey, err = auth.GeneratePrivateKey(keySize)
-		if err != nil {
-			log.Fatalln("Could not generate private key", err)
+	if err := serverKeys.Reload(); err != nil {
+		log.Fatalln("error loading server key ring from redis:", err)
+	}
+
+	if _, err := serverKeys.ring.Newest(); err != nil { // no keys yet
+		if err = RotateServerKeys(); err == datastore.ErrKeyRingLocked {
+			// another server is adding the first key at the same time
+			time.Sleep(time.Second)
+			err = serverKeys.Reload()
 		}
 
-		privateKeyString = auth.StringForPrivateKey(serverSessionKey)
-		if err = datastore.RedisDb.Set(sessionKeyCacheLocation, privateKeyString, 0).Err(); err != nil {
-			log.Println("Could not save server session key to redis:", err)
+		if err != nil {
+			log.Fatalln("Could not generate server session key", err)
 		}
 	}
 
-	serverSessionKey, err = auth.PrivateKeyFromString(privateKeyString)
+	if os.Getenv(singleUseTokensVariable) == "true" {
+		auth.SingleUseStore = datastore.RedisNonceStore{Client: datastore.RedisDb}
+	}
+}
+
+// Function Reload replaces the cached key ring with the one in redis
+func (skr *serverKeyRing) Reload() error {
+	kr, err := datastore.LoadKeyRing()
 	if err != nil {
-		log.Fatalln("error parsing private key from redis:", err)
+		return err
+	}
+
+	skr.set(kr)
+	return nil
+}
+
+func (skr *serverKeyRing) set(kr auth.KeyRing) {
+	skr.Lock()
+	defer skr.Unlock()
+	skr.ring = kr
+	skr.loadedAt = time.Now()
+}
+
+// Function SigningKey returns the key new tokens should be signed with.
+// The cached ring is reloaded when it is older than serverKeyRingMaxAge,
+// so a rotation on another server is picked up within that time
+func (skr *serverKeyRing) SigningKey() auth.ServerKey {
+	skr.RLock()
+	newest, _ := skr.ring.Newest()
+	stale := time.Since(skr.loadedAt) > serverKeyRingMaxAge
+	skr.RUnlock()
+
+	if stale && skr.Reload() == nil {
+		skr.RLock()
+		newest, _ = skr.ring.Newest()
+		skr.RUnlock()
+	}
+	return newest
+}
+
+// Function PublicKeyFor implements auth.KeyResolver. Unknown key ids
+// cause a reload in case the key was added by another server
+func (skr *serverKeyRing) PublicKeyFor(keyId string) (crypto.PublicKey, error) {
+	skr.RLock()
+	pub, err := skr.ring.PublicKeyFor(keyId)
+	skr.RUnlock()
+	if err == nil {
+		return pub, nil
+	}
+
+	if err = skr.Reload(); err != nil {
+		return nil, err
+	}
+
+	skr.RLock()
+	defer skr.RUnlock()
+	return skr.ring.PublicKeyFor(keyId)
+}
+
+// Function RotateServerKeys adds a new server session key that is used to sign
+// all new tokens. Older keys keep validating sessions and invitations until
+// they retire, after the longest possible invitation has expired. It fails with
+// datastore.ErrKeyRingLocked if another server is rotating the keys
+func RotateServerKeys() error {
+	unlock, err := datastore.LockKeyRing()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	kr, err := datastore.LoadKeyRing()
+	if err != nil {
+		return err
+	}
+
+	if _, err = kr.Rotate(os.Getenv(sessionKeyTypeVariable), auth.MaxInvitationDuration); err != nil {
+		return err
+	}
+
+	if err = datastore.SaveKeyRing(kr); err != nil {
+		return err
+	}
+
+	serverKeys.set(kr)
+	return nil
+}
+
+// Function RotateServerKeysEvery rotates the server session keys on a schedule.
+// It never returns, so it should be run in a goroutine on a single server
+func RotateServerKeysEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := RotateServerKeys(); err != nil {
+			log.Println("Error rotating server session keys:", err)
+		} else {
+			log.Println("Rotated server session keys")
+		}
 	}
 }
 
@@ -38,7 +154,7 @@ type AuthController struct {
 }
 
 func (ac AuthController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.NewToken(serverSessionKey)
+	token, err := auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -4,10 +4,15 @@ package controller
 // for controllers in the server to use
 
 import (
+	"crypto"
+	"encoding/base64"
+	"errors"
 	"github.com/omarqazi/hearst/auth"
 	"github.com/omarqazi/hearst/datastore"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Controller interface {
@@ -36,6 +41,13 @@ func urlSubcategory(r *http.Request) string {
 }
 
 func authorizedMailbox(r *http.Request) (mb datastore.Mailbox, err error) {
+	mb, _, err = authorizedSession(r)
+	return
+}
+
+// Function authorizedSession works like authorizedMailbox
+// but also returns the session the request was made with
+func authorizedSession(r *http.Request) (mb datastore.Mailbox, session auth.Session, err error) {
 	mailboxId := r.Header.Get("X-Hearst-Mailbox")
 	if mailboxId == "" {
 		mailboxId = r.URL.Query().Get("mailbox")
@@ -46,24 +58,391 @@ func authorizedMailbox(r *http.Request) (mb datastore.Mailbox, err error) {
 		sessionToken = r.URL.Query().Get("session")
 	}
 
+	deviceId := r.Header.Get("X-Hearst-Device")
+	if deviceId == "" {
+		deviceId = r.URL.Query().Get("device")
+	}
+
 	mb, err = datastore.GetMailbox(mailboxId)
 	if err != nil {
 		return
 	}
 
-	pubKey, er := auth.PublicKeyFromString(mb.PublicKey)
-	if er != nil {
-		return mb, er
+	if session, err = auth.ParseSession(sessionToken); err != nil {
+		return
 	}
 
-	session, erx := auth.ParseSession(sessionToken)
-	if erx != nil {
-		return mb, erx
+	if err = checkSession(&mb, deviceId, session, nil); err == nil {
+		mb.StillConnected()
 	}
+	return
+}
 
-	err = session.Valid(pubKey, &serverSessionKey.PublicKey)
-	if err == nil {
-		mb.StillConnected()
+// Function checkSession validates a session for a mailbox, makes sure it
+// has not been revoked and records that it was used. If deviceId is not
+// blank the session must be signed by that device of the mailbox instead of
+// the mailbox key. If store is not nil the session's server token is spent
+func checkSession(mb *datastore.Mailbox, deviceId string, session auth.Session, store auth.NonceStore) error {
+	pubKeys, err := sessionKeys(mb, deviceId)
+	if err != nil {
+		return err
+	}
+
+	// the signature is checked before the token is spent, so trying each key is safe
+	for _, pubKey := range pubKeys {
+		if err = session.ValidOnce(pubKey, serverKeys, store); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if mb.SessionRevoked(session) {
+		return errors.New("session has been revoked")
+	}
+
+	mb.Scope = session.Scope
+	mb.SessionId = session.Id()
+
+	mb.TrackSession(session)
+	return nil
+}
+
+// Function sessionKeys returns the keys a session may be signed with.
+// When deviceId is not blank the device is also set on mb
+func sessionKeys(mb *datastore.Mailbox, deviceId string) ([]crypto.PublicKey, error) {
+	if deviceId == "" {
+		return mb.PublicKeys()
+	}
+
+	device, err := mb.GetDevice(deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceKey, err := auth.PublicKeyFromString(device.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	mb.Device = &device
+	return []crypto.PublicKey{deviceKey}, nil
+}
+
+// Function trustedKeys returns every key that may sign a request to trust
+// a new device: the mailbox keys and the keys of its devices
+func trustedKeys(mb *datastore.Mailbox) ([]crypto.PublicKey, error) {
+	keys, err := mb.PublicKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := mb.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, device := range devices {
+		if deviceKey, err := auth.PublicKeyFromString(device.PublicKey); err == nil {
+			keys = append(keys, deviceKey)
+		}
+	}
+	return keys, nil
+}
+
+// Function registerDevice adds a device to the mailbox after checking that
+// the registration was signed by the mailbox key or one of its devices
+func registerDevice(mb *datastore.Mailbox, registration auth.DeviceRegistration) (device datastore.Device, err error) {
+	if !mb.Can(datastore.ActionCreate, datastore.Device{MailboxId: mb.Id}) {
+		err = errors.New("session is not allowed to register devices")
+		return
 	}
+
+	keys, err := trustedKeys(mb)
+	if err != nil {
+		return
+	}
+
+	registration.MailboxId = mb.Id
+	for _, key := range keys {
+		if err = registration.ValidOnce(key, serverKeys, auth.SingleUseStore); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	device = datastore.Device{
+		MailboxId: mb.Id,
+		Name:      registration.Name,
+		PublicKey: registration.PublicKey,
+	}
+	err = device.Insert()
 	return
 }
+
+// Function rotateMailboxKey replaces the key of a mailbox after checking that
+// the rotation was signed by the current key. Every session except the one
+// the mailbox was authorized with is revoked
+func rotateMailboxKey(mb *datastore.Mailbox, rotation auth.KeyRotation, gracePeriod time.Duration) error {
+	if !mb.Can(datastore.ActionUpdate, mb) {
+		return errors.New("session is not allowed to rotate the mailbox key")
+	}
+
+	currentKey, err := auth.PublicKeyFromString(mb.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	rotation.MailboxId = mb.Id
+	if err = rotation.ValidOnce(currentKey, serverKeys, auth.SingleUseStore); err != nil {
+		return err
+	}
+
+	if err = mb.RotateKey(rotation.PublicKey, gracePeriod); err != nil {
+		return err
+	}
+
+	return mb.RevokeOtherSessions(mb.SessionId)
+}
+
+// Function parseKeyRotation builds a key rotation from the fields clients
+// send. The signature is base64 URL encoded like session signatures
+func parseKeyRotation(publicKey, token, signature string) (rotation auth.KeyRotation, err error) {
+	rotation.PublicKey = publicKey
+	rotation.Token = token
+	rotation.Signature, err = base64.URLEncoding.DecodeString(signature)
+	return
+}
+
+// Function parseDeviceRegistration works like parseKeyRotation
+func parseDeviceRegistration(name, publicKey, token, signature string) (registration auth.DeviceRegistration, err error) {
+	registration.Name = name
+	registration.PublicKey = publicKey
+	registration.Token = token
+	registration.Signature, err = base64.URLEncoding.DecodeString(signature)
+	return
+}
+
+// Function createInvitation signs and saves an invitation to a thread. The
+// mailbox must be able to write to the thread, and can not grant permissions
+// it does not have itself. Invitations expire after expiresIn, at most
+// auth.MaxInvitationDuration
+func createInvitation(mb *datastore.Mailbox, inv datastore.Invitation, expiresIn time.Duration) (datastore.Invitation, error) {
+	inv.CreatorId = mb.Id
+	if inv.ThreadId == "" || !mb.Can(datastore.ActionCreate, inv) ||
+		(inv.AllowRead && !mb.CanRead(inv.ThreadId)) ||
+		(inv.AllowNotification && !mb.CanFollow(inv.ThreadId)) {
+		return inv, errors.New("not allowed to invite to this thread")
+	}
+
+	if expiresIn <= 0 || expiresIn > auth.MaxInvitationDuration {
+		expiresIn = auth.MaxInvitationDuration
+	}
+
+	inv.Id = ""
+	inv.ExpiresAt = time.Now().Add(expiresIn)
+	if err := inv.Sign(serverKeys.SigningKey()); err != nil {
+		return inv, err
+	}
+
+	return inv, inv.Insert()
+}
+
+// Function redeemInvitation checks an invitation token and makes the
+// mailbox a member of the thread it was issued for. If threadId is not
+// blank the invitation must be for that thread
+func redeemInvitation(mb *datastore.Mailbox, threadId string, token string) (member datastore.ThreadMember, err error) {
+	if !mb.Can(datastore.ActionUpdate, mb) {
+		return member, errors.New("session is not allowed to join threads")
+	}
+
+	grant, err := auth.ParseInvitation(token, serverKeys)
+	if err != nil {
+		return
+	}
+
+	if threadId != "" && grant.ThreadId != threadId {
+		return member, errors.New("invitation is for another thread")
+	}
+
+	return mb.RedeemInvitation(grant)
+}
+
+// Function joinThread adds the mailbox to an open thread, or files a join
+// request with the note if the thread takes requests. It returns the new
+// membership or the request
+func joinThread(mb *datastore.Mailbox, threadId string, note string) (interface{}, error) {
+	thread, err := datastore.GetThread(threadId)
+	if err != nil {
+		return nil, errors.New("thread not found")
+	}
+
+	if !mb.Can(datastore.ActionJoin, thread) {
+		return nil, errors.New("thread is not open to join")
+	}
+
+	if thread.JoinPolicy == datastore.JoinOpen {
+		return mb.Join(&thread)
+	}
+	return mb.RequestToJoin(&thread, note)
+}
+
+// Function listJoinRequests lists the pending requests to join
+// a thread, for its owners and admins
+func listJoinRequests(mb *datastore.Mailbox, threadId string) ([]datastore.JoinRequest, error) {
+	thread := datastore.Thread{Record: datastore.Rec(threadId)}
+	if threadId == "" || !mb.Can(datastore.ActionRead, datastore.JoinRequest{ThreadId: threadId}) {
+		return nil, errors.New("not allowed to see join requests for this thread")
+	}
+	return thread.JoinRequests()
+}
+
+// Function decideJoinRequest approves or denies a join request. Approving
+// returns the new membership and denying returns the request. If threadId
+// is not blank the request must be for that thread
+func decideJoinRequest(mb *datastore.Mailbox, threadId string, requestId string, approve bool) (interface{}, error) {
+	request, err := datastore.GetJoinRequest(requestId)
+	if err != nil || (threadId != "" && request.ThreadId != threadId) {
+		return nil, errors.New("join request not found")
+	}
+
+	if !mb.Can(datastore.ActionUpdate, request) {
+		return nil, errors.New("not allowed to decide join requests for this thread")
+	}
+
+	if approve {
+		return request.Approve()
+	}
+	return request, request.Deny()
+}
+
+// Function withdrawJoinRequest deletes a join request the mailbox filed
+func withdrawJoinRequest(mb *datastore.Mailbox, threadId string, requestId string) error {
+	request, err := datastore.GetJoinRequest(requestId)
+	if err != nil || (threadId != "" && request.ThreadId != threadId) {
+		return errors.New("join request not found")
+	}
+
+	if !mb.Can(datastore.ActionDelete, request) {
+		return errors.New("not allowed to withdraw this join request")
+	}
+	return request.Delete()
+}
+
+// Function createGroup inserts a new group with the mailbox as its first admin
+func createGroup(mb *datastore.Mailbox, g *datastore.Group) error {
+	if !mb.Can(datastore.ActionCreate, g) {
+		return errors.New("session can not create groups")
+	}
+
+	g.Id = ""
+	if err := g.Insert(); err != nil {
+		return err
+	}
+	return g.AddMember(&datastore.GroupMember{MailboxId: mb.Id, Admin: true})
+}
+
+// Function updateProfile replaces the profile of the mailbox
+func updateProfile(mb *datastore.Mailbox, profile datastore.Profile) error {
+	if !mb.Can(datastore.ActionUpdate, mb) {
+		return errors.New("session can not change the profile")
+	}
+	return mb.UpdateProfile(profile)
+}
+
+// Function directThread returns the direct thread between the mailbox and
+// another one, given by id or by handle like "@omar"
+func directThread(mb *datastore.Mailbox, otherId string) (thread datastore.Thread, err error) {
+	if strings.HasPrefix(otherId, "@") {
+		other, err := datastore.GetMailboxByHandle(otherId)
+		if err != nil {
+			return thread, err
+		}
+		otherId = other.Id
+	}
+
+	if !mb.Can(datastore.ActionCreate, datastore.Thread{}) {
+		return thread, errors.New("session can not start direct threads")
+	}
+	return mb.DirectThread(otherId)
+}
+
+// Function blockMailbox blocks or mutes another mailbox, given by id or by
+// handle like "@omar", and returns the block
+func blockMailbox(mb *datastore.Mailbox, otherId string, kind datastore.BlockKind) (block datastore.Block, err error) {
+	if strings.HasPrefix(otherId, "@") {
+		other, err := datastore.GetMailboxByHandle(otherId)
+		if err != nil {
+			return block, err
+		}
+		otherId = other.Id
+	}
+
+	if !mb.Can(datastore.ActionUpdate, mb) {
+		return block, errors.New("session can not block mailboxes")
+	}
+
+	if err = mb.Block(otherId, kind); err != nil {
+		return
+	}
+	return datastore.Block{MailboxId: mb.Id, BlockedId: otherId, Kind: kind}, nil
+}
+
+// Function unblockMailbox removes a block or mute of another mailbox
+func unblockMailbox(mb *datastore.Mailbox, otherId string) error {
+	if !mb.Can(datastore.ActionUpdate, mb) {
+		return errors.New("session can not unblock mailboxes")
+	}
+	return mb.Unblock(otherId)
+}
+
+// Function searchMessages runs a full text search of the messages the mailbox
+// may read, taking the parameters "q", "thread_id", "sender", "since",
+// "until", "limit" and "offset" from param. Times are in unix seconds and
+// the sender may be given by handle like "@omar"
+func searchMessages(mb *datastore.Mailbox, param func(string) string) ([]datastore.SearchResult, error) {
+	search := datastore.MessageSearch{Query: param("q"), ThreadId: param("thread_id"), SenderId: param("sender")}
+	search.Limit, _ = strconv.Atoi(param("limit"))
+	search.Offset, _ = strconv.Atoi(param("offset"))
+	if since, err := strconv.ParseInt(param("since"), 10, 64); err == nil {
+		search.Since = time.Unix(since, 0)
+	}
+
+	if until, err := strconv.ParseInt(param("until"), 10, 64); err == nil {
+		search.Until = time.Unix(until, 0)
+	}
+
+	if strings.HasPrefix(search.SenderId, "@") {
+		sender, err := datastore.GetMailboxByHandle(search.SenderId)
+		if err != nil {
+			return nil, err
+		}
+		search.SenderId = sender.Id
+	}
+
+	if search.ThreadId != "" {
+		thread, err := datastore.GetThread(search.ThreadId)
+		if err != nil {
+			return nil, err
+		} else if !mb.Can(datastore.ActionList, &thread) {
+			return nil, errors.New("not a reader of the thread")
+		}
+		search.ThreadId = thread.Id
+	}
+	return mb.SearchMessages(search)
+}
+
+// Function messageRevisions lists the earlier versions of a message the
+// mailbox may read. Messages it can not read are not found
+func messageRevisions(mb *datastore.Mailbox, messageId string) ([]datastore.MessageRevision, error) {
+	message, err := datastore.GetMessage(messageId)
+	if err != nil {
+		return nil, err
+	} else if !mb.Can(datastore.ActionRead, &message) {
+		return nil, errors.New("No message found with that UUID")
+	}
+	return mb.ReadableRevisions(&message)
+}
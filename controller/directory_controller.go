@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/omarqazi/hearst/datastore"
+	"net/http"
+	"strconv"
+)
+
+// Number of recent messages in a thread preview
+const previewLimit = 50
+
+// DirectoryController serves the public directory of listed threads. It
+// does not need a session, so anyone can discover and preview threads
+type DirectoryController struct {
+}
+
+func (dc DirectoryController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "directory is read only", 405)
+		return
+	}
+
+	if !allowRequest(w, r, rateLimitList, nil) {
+		return
+	}
+
+	if urlSubcategory(r) == "preview" {
+		dc.GetPreview(rid(r), w, r)
+	} else {
+		dc.SearchThreads(w, r)
+	}
+}
+
+// Function SearchThreads lists listed threads matching the "q" and "label"
+// query parameters. Results are paged with "limit" and "offset"
+func (dc DirectoryController) SearchThreads(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	offset, _ := strconv.Atoi(query.Get("offset"))
+
+	threads, err := datastore.SearchThreads(query.Get("q"), query.Get("label"), limit, offset)
+	if err != nil {
+		http.Error(w, "error searching threads", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(threads); err != nil {
+		http.Error(w, "error marshaling response JSON", 500)
+	}
+}
+
+// threadPreview is the response to /directory/<id>/preview
+type threadPreview struct {
+	Thread   datastore.Thread
+	Messages []datastore.Message
+}
+
+// Function GetPreview responds with a listed thread and its recent messages,
+// leaving out whispers. Unlisted threads are not found
+func (dc DirectoryController) GetPreview(tid string, w http.ResponseWriter, r *http.Request) {
+	thread, err := datastore.GetThread(tid)
+	if err != nil || !thread.IsListed() {
+		http.Error(w, "thread not found", 404)
+		return
+	}
+
+	messages, err := thread.PreviewMessages(previewLimit)
+	if err != nil {
+		http.Error(w, "error finding recent messages", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(threadPreview{Thread: thread, Messages: messages}); err != nil {
+		http.Error(w, "error marshaling response JSON", 500)
+	}
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omarqazi/hearst/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var dc = http.StripPrefix("/directory/", DirectoryController{})
+
+func TestDirectoryRequests(t *testing.T) {
+	mailbox, _ := testMailbox(t)
+
+	isListed := true
+	listed := datastore.Thread{Subject: "directory test", Listed: &isListed, Labels: []string{"golang"}}
+	unlisted := datastore.Thread{Subject: "directory test"}
+	for _, thread := range []*datastore.Thread{&listed, &unlisted} {
+		if err := thread.Insert(); err != nil {
+			t.Fatal("Error inserting thread:", err)
+		}
+		defer thread.Delete()
+	}
+
+	public := datastore.Message{ThreadId: listed.Id, SenderMailboxId: mailbox.Id, Body: "hello"}
+	whisper := datastore.Message{ThreadId: listed.Id, SenderMailboxId: mailbox.Id, Body: "psst", Recipients: []string{mailbox.Id}}
+	testMessages(t, &public, &whisper)
+
+	req, _ := http.NewRequest("GET", "http://localhost:8080/directory/?label=golang&q=DIRECTORY", nil)
+	w := httptest.NewRecorder()
+	dc.ServeHTTP(w, req)
+	var threads []datastore.Thread
+	if err := json.NewDecoder(w.Body).Decode(&threads); err != nil {
+		t.Fatal("Error decoding directory response:", err, w.Code)
+	}
+
+	for _, thread := range threads {
+		if thread.Id == unlisted.Id {
+			t.Fatal("Expected unlisted thread to be left out of the directory")
+		}
+	}
+	if len(threads) == 0 || threads[0].Id != listed.Id {
+		t.Fatal("Expected listed thread in the directory but got", threads)
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("http://localhost:8080/directory/%s/preview", listed.Id), nil)
+	w = httptest.NewRecorder()
+	dc.ServeHTTP(w, req)
+	var preview threadPreview
+	if err := json.NewDecoder(w.Body).Decode(&preview); err != nil {
+		t.Fatal("Error decoding preview response:", err, w.Code)
+	}
+
+	if len(preview.Messages) != 1 || preview.Messages[0].Id != public.Id {
+		t.Fatal("Expected only the public message in the preview but got", preview.Messages)
+	}
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("http://localhost:8080/directory/%s/preview", unlisted.Id), nil)
+	w = httptest.NewRecorder()
+	dc.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Fatal("Expected 404 response when previewing an unlisted thread but got", w.Code)
+	}
+}
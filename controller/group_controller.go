@@ -0,0 +1,255 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omarqazi/hearst/datastore"
+	"net/http"
+)
+
+type GroupController struct {
+}
+
+func (gc GroupController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mb, err := authorizedMailbox(r)
+	if err != nil {
+		http.Error(w, "session token invalid", 403)
+		return
+	}
+
+	if urlSubcategory(r) == "members" {
+		gc.RouteGroupMembersRequest(w, r, &mb)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		gc.GetGroup(rid(r), w, r, &mb)
+	case "POST":
+		gc.PostGroup(w, r, &mb)
+	case "PUT":
+		gc.PutGroup(w, r, &mb)
+	case "DELETE":
+		gc.DeleteGroup(w, r, &mb)
+	default:
+		gc.HandleUnknown(w, r)
+	}
+}
+
+// Function RouteGroupMembersRequest handles the members
+// of a group, at /group/<id>/members/<mailbox id>
+func (gc GroupController) RouteGroupMembersRequest(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	switch r.Method {
+	case "GET":
+		gc.GetGroupMembers(w, r, mb)
+	case "POST":
+		gc.PostGroupMember(w, r, mb)
+	case "PUT":
+		gc.PutGroupMember(w, r, mb)
+	case "DELETE":
+		gc.DeleteGroupMember(w, r, mb)
+	default:
+		gc.HandleUnknown(w, r)
+	}
+}
+
+// Function GetGroup responds with the group, or with the groups
+// the mailbox is in if no group id is given
+func (gc GroupController) GetGroup(gid string, w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	var output interface{}
+	if gid == "" {
+		groups, err := mb.Groups()
+		if err != nil {
+			http.Error(w, "error getting groups", 500)
+			return
+		}
+		output = groups
+	} else {
+		group, err := datastore.GetGroup(gid)
+		if err != nil {
+			http.Error(w, "group not found", 404)
+			return
+		}
+
+		if !mb.Can(datastore.ActionRead, &group) {
+			http.Error(w, "access denied", 403)
+			return
+		}
+		output = group
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(output); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (gc GroupController) PostGroup(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	var group datastore.Group
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	if err := createGroup(mb, &group); err != nil {
+		http.Error(w, "could not create group: "+err.Error(), 403)
+		return
+	}
+	gc.GetGroup(group.Id, w, r, mb)
+}
+
+func (gc GroupController) PutGroup(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	var group datastore.Group
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	dbGroup, err := datastore.GetGroup(rid(r))
+	if err != nil {
+		http.Error(w, "group not found", 404)
+		return
+	}
+
+	if !mb.Can(datastore.ActionUpdate, &dbGroup) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	dbGroup.Name = group.Name
+	if err := dbGroup.Update(); err != nil {
+		http.Error(w, "error updating group", 500)
+		return
+	}
+	gc.GetGroup(dbGroup.Id, w, r, mb)
+}
+
+func (gc GroupController) DeleteGroup(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	group, err := datastore.GetGroup(rid(r))
+	if err != nil {
+		http.Error(w, "group not found", 404)
+		return
+	}
+
+	if !mb.Can(datastore.ActionDelete, &group) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	if err := group.Delete(); err != nil {
+		http.Error(w, "error deleting group", 500)
+		return
+	}
+	fmt.Fprintln(w, "group deleted")
+}
+
+func (gc GroupController) GetGroupMembers(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	group := datastore.Group{Record: datastore.Rec(rid(r))}
+	if !mb.Can(datastore.ActionList, &group) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	members, err := group.GetAllMembers()
+	if err != nil {
+		http.Error(w, "error getting group members", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(members); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (gc GroupController) PostGroupMember(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	var member datastore.GroupMember
+	if err := json.NewDecoder(r.Body).Decode(&member); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	member.GroupId = rid(r)
+	if !mb.Can(datastore.ActionCreate, &member) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	if err := member.Insert(); err != nil {
+		http.Error(w, "error adding group member", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(member); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// Function PutGroupMember makes a member an admin of the group or
+// takes that away, given a body like {"Admin": true}
+func (gc GroupController) PutGroupMember(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "invalid mailbox id for group member", 400)
+		return
+	}
+
+	var member datastore.GroupMember
+	if err := json.NewDecoder(r.Body).Decode(&member); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	stored := datastore.GroupMember{GroupId: rid(r), MailboxId: comps[2]}
+	if err := stored.Load(); err != nil {
+		http.Error(w, "group member not found", 404)
+		return
+	}
+
+	if !mb.Can(datastore.ActionUpdate, &stored) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	stored.Admin = member.Admin
+	if err := stored.Update(); err != nil {
+		http.Error(w, "error updating group member", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stored); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (gc GroupController) DeleteGroupMember(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "invalid mailbox id for group member", 400)
+		return
+	}
+
+	member := datastore.GroupMember{GroupId: rid(r), MailboxId: comps[2]}
+	if err := member.Load(); err != nil {
+		http.Error(w, "group member not found", 404)
+		return
+	}
+
+	if !mb.Can(datastore.ActionDelete, &member) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	if err := member.Delete(); err != nil {
+		http.Error(w, "error removing group member", 500)
+		return
+	}
+	fmt.Fprintln(w, "group member removed")
+}
+
+func (gc GroupController) HandleUnknown(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(400)
+	fmt.Fprintln(w, "unknown group request")
+}
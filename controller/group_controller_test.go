@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/omarqazi/hearst/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var gc = http.StripPrefix("/group/", GroupController{})
+
+func TestGroupRequests(t *testing.T) {
+	admin, adminKey := testMailbox(t)
+	teammate, teammateKey := testMailbox(t)
+
+	body, _ := json.Marshal(datastore.Group{Name: "team"})
+	req := testRequest("POST", "http://localhost:8080/group/", bytes.NewBuffer(body), t, adminKey, &admin)
+	w := httptest.NewRecorder()
+	gc.ServeHTTP(w, req)
+	var group datastore.Group
+	if err := json.NewDecoder(w.Body).Decode(&group); err != nil || group.Id == "" {
+		t.Fatal("Expected new group but got", w.Code, err)
+	}
+	defer group.Delete()
+
+	membersUrl := fmt.Sprintf("http://localhost:8080/group/%s/members", group.Id)
+	body, _ = json.Marshal(datastore.GroupMember{MailboxId: teammate.Id})
+	req = testRequest("POST", membersUrl, bytes.NewBuffer(body), t, teammateKey, &teammate)
+	w = httptest.NewRecorder()
+	gc.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Fatal("Expected 403 response when a non member adds to a group but got", w.Code)
+	}
+
+	req = testRequest("POST", membersUrl, bytes.NewBuffer(body), t, adminKey, &admin)
+	w = httptest.NewRecorder()
+	gc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when adding a group member but got", w.Code, w.Body.String())
+	}
+
+	thread := testThread(t, "group thread")
+
+	if err := thread.AddMember(&datastore.ThreadMember{MailboxId: admin.Id, Role: datastore.RoleOwner}); err != nil {
+		t.Fatal("Error adding thread member:", err)
+	}
+
+	body, _ = json.Marshal(datastore.ThreadGroup{GroupId: group.Id, AllowRead: true, AllowWrite: true})
+	req = testRequest("POST", fmt.Sprintf("http://localhost:8080/thread/%s/groups", thread.Id), bytes.NewBuffer(body), t, adminKey, &admin)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when adding group to thread but got", w.Code, w.Body.String())
+	}
+
+	if !teammate.CanWrite(thread.Id) {
+		t.Fatal("Expected group member to be able to write to the thread")
+	}
+
+	req = testRequest("DELETE", membersUrl+"/"+teammate.Id, nil, t, teammateKey, &teammate)
+	w = httptest.NewRecorder()
+	gc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when leaving a group but got", w.Code, w.Body.String())
+	}
+
+	if teammate.CanRead(thread.Id) {
+		t.Fatal("Expected mailbox to lose access to the thread after leaving the group")
+	}
+}
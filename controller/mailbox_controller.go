@@ -14,6 +14,11 @@ type MailboxController struct {
 }
 
 func (c MailboxController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subcat := urlSubcategory(r); subcat == "sessions" || subcat == "sockets" || subcat == "key" || subcat == "devices" || subcat == "profile" || subcat == "blocks" {
+		c.RouteSessionRequest(w, r)
+		return
+	}
+
 	var authorizedUser datastore.Mailbox
 	var err error
 	if r.Method == "PUT" || r.Method == "DELETE" {
@@ -25,9 +30,15 @@ func (c MailboxController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		c.GetMailbox(rid(r), w, r)
+		if handle := r.URL.Query().Get("handle"); rid(r) == "" && handle != "" {
+			c.GetMailboxByHandle(handle, w, r)
+		} else {
+			c.GetMailbox(rid(r), w, r)
+		}
 	case "POST":
-		c.PostMailbox(w, r)
+		if allowRequest(w, r, rateLimitMailbox, nil) {
+			c.PostMailbox(w, r)
+		}
 	case "PUT":
 		c.PutMailbox(w, r, &authorizedUser)
 	case "DELETE":
@@ -62,6 +73,17 @@ func (c MailboxController) GetMailbox(mbid string, w http.ResponseWriter, r *htt
 	}
 }
 
+// Function GetMailboxByHandle handles a GET request for /mailbox/?handle=<handle>
+// by rendering the mailbox with that handle as JSON
+func (c MailboxController) GetMailboxByHandle(handle string, w http.ResponseWriter, r *http.Request) {
+	mb, err := datastore.GetMailboxByHandle(handle)
+	if err != nil {
+		http.Error(w, "mailbox not found", 404)
+		return
+	}
+	c.GetMailbox(mb.Id, w, r)
+}
+
 // Function PostMailbox handles a HTTP POST request
 // By parsing the JSON request body and inserting it
 // into the database
@@ -75,15 +97,18 @@ func (c MailboxController) PostMailbox(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if mailbox.PublicKey == "" {
-		if key, err := mailbox.GenerateNewKey(); err == nil {
+		if key, err := mailbox.GenerateNewKeyOfType(r.URL.Query().Get("key_type")); err == nil {
 			w.Header().Add("X-Hearst-Mailbox-Key", auth.StringForPrivateKey(key))
-			if token, err := mailbox.SessionToken(24*time.Hour, key, serverSessionKey); err == nil {
+			if token, err := mailbox.SessionToken(24*time.Hour, key, serverKeys.SigningKey()); err == nil {
 				w.Header().Add("X-Hearst-Session-Token", token)
 			}
 		}
 	}
 
-	if err := mailbox.Insert(); err != nil {
+	if err := mailbox.Insert(); err == datastore.ErrHandleTaken {
+		http.Error(w, err.Error(), 409)
+		return
+	} else if err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintln(w, "error saving mailbox:", err.Error())
 		return
@@ -108,8 +133,9 @@ func (c MailboxController) PutMailbox(w http.ResponseWriter, r *http.Request, au
 		mailbox.Id = rid(r)
 	}
 
-	if authorizedUser.Id != mailbox.Id {
+	if !authorizedUser.Can(datastore.ActionUpdate, mailbox) {
 		http.Error(w, "access denied", 403)
+		return
 	}
 
 	dbBox, erx := datastore.GetMailbox(mailbox.Id)
@@ -119,8 +145,9 @@ func (c MailboxController) PutMailbox(w http.ResponseWriter, r *http.Request, au
 		return
 	}
 
-	if mailbox.PublicKey == "" {
-		mailbox.PublicKey = dbBox.PublicKey
+	if mailbox.PublicKey != "" && mailbox.PublicKey != dbBox.PublicKey {
+		http.Error(w, "public key can only be changed with a signed key rotation", 400)
+		return
 	}
 
 	if mailbox.DeviceId == "" {
@@ -138,7 +165,7 @@ func (c MailboxController) PutMailbox(w http.ResponseWriter, r *http.Request, au
 
 func (c MailboxController) DeleteMailbox(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
 	identifier := rid(r)
-	if authorizedUser.Id != identifier {
+	if !authorizedUser.Can(datastore.ActionDelete, datastore.Mailbox{Record: datastore.Rec(identifier)}) {
 		http.Error(w, "access denied", 403)
 		return
 	}
@@ -152,6 +179,280 @@ func (c MailboxController) DeleteMailbox(w http.ResponseWriter, r *http.Request,
 	fmt.Fprintln(w, "Mailbox deleted")
 }
 
+// Function RouteSessionRequest handles requests for the sessions, sockets,
+// key, devices, profile and blocks of a mailbox, which are only available to the mailbox itself
+func (c MailboxController) RouteSessionRequest(w http.ResponseWriter, r *http.Request) {
+	authorizedUser, err := authorizedMailbox(r)
+	if err != nil {
+		http.Error(w, "invalid session token", 403)
+		return
+	}
+
+	if authorizedUser.Id != rid(r) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && urlSubcategory(r) == "sessions":
+		c.GetSessions(w, r, &authorizedUser)
+	case r.Method == "GET" && urlSubcategory(r) == "sockets":
+		c.GetSockets(w, r, &authorizedUser)
+	case r.Method == "DELETE" && urlSubcategory(r) == "sessions":
+		c.DeleteSessions(w, r, &authorizedUser)
+	case r.Method == "POST" && urlSubcategory(r) == "key":
+		c.PostKey(w, r, &authorizedUser)
+	case r.Method == "GET" && urlSubcategory(r) == "devices":
+		c.GetDevices(w, r, &authorizedUser)
+	case r.Method == "POST" && urlSubcategory(r) == "devices":
+		c.PostDevice(w, r, &authorizedUser)
+	case r.Method == "DELETE" && urlSubcategory(r) == "devices":
+		c.DeleteDevice(w, r, &authorizedUser)
+	case r.Method == "PUT" && urlSubcategory(r) == "profile":
+		c.PutProfile(w, r, &authorizedUser)
+	case r.Method == "GET" && urlSubcategory(r) == "blocks":
+		c.GetBlocks(w, r, &authorizedUser)
+	case r.Method == "POST" && urlSubcategory(r) == "blocks":
+		c.PostBlock(w, r, &authorizedUser)
+	case r.Method == "DELETE" && urlSubcategory(r) == "blocks":
+		c.DeleteBlock(w, r, &authorizedUser)
+	default:
+		c.HandleUnknown(w, r)
+	}
+}
+
+// Function GetSessions lists the live sessions of the mailbox as JSON
+func (c MailboxController) GetSessions(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	sessions, err := authorizedUser.ActiveSessions()
+	if err != nil {
+		http.Error(w, "error getting sessions", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// Function GetSockets lists the open sockets of the mailbox as JSON
+func (c MailboxController) GetSockets(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	sockets, err := authorizedUser.OpenSockets()
+	if err != nil {
+		http.Error(w, "error getting sockets", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sockets); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// Function DeleteSessions revokes the session named in the URL,
+// or every session of the mailbox if no session id is given
+func (c MailboxController) DeleteSessions(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	if !authorizedUser.Can(datastore.ActionUpdate, authorizedUser) {
+		http.Error(w, "access denied: session can not revoke sessions", 403)
+		return
+	}
+
+	comps := pathComponents(r)
+	var err error
+	if len(comps) > 2 && comps[2] != "" {
+		err = authorizedUser.RevokeSession(comps[2])
+	} else {
+		err = authorizedUser.RevokeAllSessions()
+	}
+
+	if err != nil {
+		http.Error(w, "error revoking session", 500)
+		return
+	}
+	fmt.Fprintln(w, "session revoked")
+}
+
+// keyRotationRequest is the body of a POST to /mailbox/<id>/key
+type keyRotationRequest struct {
+	PublicKey   string `json:"public_key"`
+	Token       string `json:"token"`
+	Signature   string `json:"signature"`    // base64 URL encoded signature by the current key
+	GracePeriod int64  `json:"grace_period"` // seconds the old key keeps working
+}
+
+// Function PostKey rotates the mailbox key. The rotation must be signed with
+// the current key, and all sessions but the one making the request are revoked
+func (c MailboxController) PostKey(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	var request keyRotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	rotation, err := parseKeyRotation(request.PublicKey, request.Token, request.Signature)
+	if err != nil {
+		http.Error(w, "invalid signature encoding", 400)
+		return
+	}
+
+	gracePeriod := time.Duration(request.GracePeriod) * time.Second
+	if err := rotateMailboxKey(authorizedUser, rotation, gracePeriod); err != nil {
+		http.Error(w, "could not rotate key: "+err.Error(), 403)
+		return
+	}
+
+	c.GetMailbox(authorizedUser.Id, w, r)
+}
+
+// Function PutProfile replaces the profile of the mailbox with the request
+// body, like {"Handle": "omar", "DisplayName": "Omar", "Fields": {...}}
+func (c MailboxController) PutProfile(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	var profile datastore.Profile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	if err := updateProfile(authorizedUser, profile); err == datastore.ErrHandleTaken {
+		http.Error(w, err.Error(), 409)
+		return
+	} else if err != nil {
+		http.Error(w, "could not update profile: "+err.Error(), 400)
+		return
+	}
+
+	c.GetMailbox(authorizedUser.Id, w, r)
+}
+
+// Function GetDevices lists the devices of the mailbox as JSON
+func (c MailboxController) GetDevices(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	devices, err := authorizedUser.Devices()
+	if err != nil {
+		http.Error(w, "error getting devices", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(devices); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// deviceRegistrationRequest is the body of a POST to /mailbox/<id>/devices
+type deviceRegistrationRequest struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+	Token     string `json:"token"`
+	Signature string `json:"signature"` // base64 URL encoded signature by the mailbox key or another device
+}
+
+// Function PostDevice registers a new device with its own key
+func (c MailboxController) PostDevice(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	var request deviceRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	registration, err := parseDeviceRegistration(request.Name, request.PublicKey, request.Token, request.Signature)
+	if err != nil {
+		http.Error(w, "invalid signature encoding", 400)
+		return
+	}
+
+	device, err := registerDevice(authorizedUser, registration)
+	if err != nil {
+		http.Error(w, "could not register device: "+err.Error(), 403)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(device); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// Function DeleteDevice removes the device named in the URL
+// and revokes its sessions
+func (c MailboxController) DeleteDevice(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	if !authorizedUser.Can(datastore.ActionDelete, datastore.Device{MailboxId: authorizedUser.Id}) {
+		http.Error(w, "access denied: session can not remove devices", 403)
+		return
+	}
+
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "device id required", 400)
+		return
+	}
+
+	if err := authorizedUser.RemoveDevice(comps[2]); err != nil {
+		http.Error(w, "device not found", 404)
+		return
+	}
+	fmt.Fprintln(w, "device removed")
+}
+
+// Function GetBlocks lists the mailboxes the mailbox blocked or muted as JSON
+func (c MailboxController) GetBlocks(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	blocks, err := authorizedUser.Blocks()
+	if err != nil {
+		http.Error(w, "error getting blocks", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(blocks); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// blockRequest is the body of a POST to /mailbox/<id>/blocks
+type blockRequest struct {
+	MailboxId string `json:"mailbox_id"` // the mailbox to block, or its handle like "@omar"
+	Kind      string `json:"kind"`       // "block" or "mute", block if blank
+}
+
+// Function PostBlock blocks or mutes the mailbox in the request body
+func (c MailboxController) PostBlock(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	var request blockRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	kind := datastore.BlockKind(request.Kind)
+	if kind == "" {
+		kind = datastore.KindBlock
+	}
+
+	block, err := blockMailbox(authorizedUser, request.MailboxId, kind)
+	if err != nil {
+		http.Error(w, "could not block mailbox: "+err.Error(), 400)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(block); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// Function DeleteBlock removes the block or mute of the mailbox named in the URL
+func (c MailboxController) DeleteBlock(w http.ResponseWriter, r *http.Request, authorizedUser *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "mailbox id required", 400)
+		return
+	}
+
+	if err := unblockMailbox(authorizedUser, comps[2]); err != nil {
+		http.Error(w, "could not unblock mailbox: "+err.Error(), 403)
+		return
+	}
+	fmt.Fprintln(w, "mailbox unblocked")
+}
+
 func (c MailboxController) HandleUnknown(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(400)
 	fmt.Fprintln(w, "what the fuck are you talking about?")
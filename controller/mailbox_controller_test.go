@@ -2,6 +2,8 @@ package controller
 
 import (
 	"bytes"
+	"crypto"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/omarqazi/hearst/auth"
@@ -156,7 +158,7 @@ func TestMailboxPutRequest(t *testing.T) {
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
 
-	token, err := auth.NewToken(serverSessionKey)
+	token, err := auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -221,7 +223,7 @@ func TestMailboxPutRequest(t *testing.T) {
 
 	req.Header.Add("X-Hearst-Mailbox", anotherMailbox.Id)
 
-	token, err = auth.NewToken(serverSessionKey)
+	token, err = auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -277,7 +279,7 @@ func TestMailboxDeleteRequest(t *testing.T) {
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
 
-	token, err := auth.NewToken(serverSessionKey)
+	token, err := auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -308,3 +310,263 @@ func TestMailboxDeleteRequest(t *testing.T) {
 		t.Error("Able to retrieve mailbox after DELETE request but got", mrx)
 	}
 }
+
+func TestMailboxSessionsRequest(t *testing.T) {
+	mailbox, clientKey := testMailbox(t)
+
+	requestUrl := fmt.Sprintf("http://localhost:8080/mailbox/%s/sessions", mailbox.Id)
+	req := testRequest("GET", requestUrl, nil, t, clientKey, &mailbox)
+	w := httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response but got", w.Code)
+	}
+
+	var sessions []datastore.MailboxSession
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatal("Error decoding sessions:", err)
+	}
+
+	session, err := auth.ParseSession(req.Header.Get("X-Hearst-Session"))
+	if err != nil {
+		t.Fatal("Error parsing request session:", err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Id != session.Id() {
+		t.Fatal("Expected the request session to be listed but got", sessions)
+	}
+
+	revokeUrl := fmt.Sprintf("%s/%s", requestUrl, session.Id())
+	revokeReq, _ := http.NewRequest("DELETE", revokeUrl, nil)
+	revokeReq.Header = req.Header
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, revokeReq)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when revoking session but got", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Fatal("Expected 403 response with a revoked session but got", w.Code)
+	}
+}
+
+func TestMailboxKeyRotationRequest(t *testing.T) {
+	mailbox, clientKey, err := datastore.NewMailboxWithKeyType(auth.KeyTypeECDSA)
+	if err != nil {
+		t.Fatal("Error generating mailbox:", err)
+	}
+
+	if err := mailbox.Insert(); err != nil {
+		t.Fatal("Error inserting mailbox:", err)
+	}
+	defer mailbox.Delete()
+
+	newKey, err := auth.GenerateKey(auth.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating new key:", err)
+	}
+
+	token, err := auth.NewToken(serverKeys.SigningKey())
+	if err != nil {
+		t.Fatal("Error generating token", err)
+	}
+
+	rotation := auth.KeyRotation{MailboxId: mailbox.Id, Token: token}
+	if rotation.PublicKey, err = auth.StringForPublicKey(newKey.Public()); err != nil {
+		t.Fatal("Error encoding new key:", err)
+	}
+
+	rotationRequest := func(signer crypto.Signer) *httptest.ResponseRecorder {
+		sig, err := rotation.SignatureFor(signer)
+		if err != nil {
+			t.Fatal("Error signing key rotation:", err)
+		}
+		rotation.Signature = sig
+
+		body, _ := json.Marshal(keyRotationRequest{
+			PublicKey:   rotation.PublicKey,
+			Token:       rotation.Token,
+			Signature:   rotation.SignatureString(),
+			GracePeriod: 60,
+		})
+
+		requestUrl := fmt.Sprintf("http://localhost:8080/mailbox/%s/key", mailbox.Id)
+		req := testRequest("POST", requestUrl, bytes.NewBuffer(body), t, clientKey, &mailbox)
+		w := httptest.NewRecorder()
+		mbc.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := rotationRequest(newKey); w.Code != 403 {
+		t.Fatal("Expected 403 response for a rotation not signed by the current key but got", w.Code)
+	}
+
+	if w := rotationRequest(clientKey); w.Code != 200 {
+		t.Fatal("Expected 200 response for a signed key rotation but got", w.Code, w.Body.String())
+	}
+
+	mbx, err := datastore.GetMailbox(mailbox.Id)
+	if err != nil {
+		t.Fatal("Error getting mailbox after key rotation:", err)
+	}
+
+	if mbx.PublicKey != rotation.PublicKey {
+		t.Fatal("Expected mailbox public key to be rotated but got", mbx.PublicKey)
+	}
+
+	// sessions signed with the new key work right away
+	req := testRequest("GET", fmt.Sprintf("http://localhost:8080/mailbox/%s/sessions", mailbox.Id), nil, t, newKey, &mbx)
+	w := httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response with a session signed by the new key but got", w.Code)
+	}
+}
+
+func TestMailboxDeviceRequests(t *testing.T) {
+	mailbox, mailboxKey := testMailbox(t)
+
+	deviceKey, err := auth.GenerateKey(auth.KeyTypeECDSA)
+	if err != nil {
+		t.Fatal("Error generating device key:", err)
+	}
+
+	token, err := auth.NewToken(serverKeys.SigningKey())
+	if err != nil {
+		t.Fatal("Error generating token", err)
+	}
+
+	registration := auth.DeviceRegistration{MailboxId: mailbox.Id, Name: "laptop", Token: token}
+	if registration.PublicKey, err = auth.StringForPublicKey(deviceKey.Public()); err != nil {
+		t.Fatal("Error encoding device key:", err)
+	}
+
+	if registration.Signature, err = registration.SignatureFor(mailboxKey); err != nil {
+		t.Fatal("Error signing device registration:", err)
+	}
+
+	body, _ := json.Marshal(deviceRegistrationRequest{
+		Name:      registration.Name,
+		PublicKey: registration.PublicKey,
+		Token:     registration.Token,
+		Signature: base64.URLEncoding.EncodeToString(registration.Signature),
+	})
+
+	devicesUrl := fmt.Sprintf("http://localhost:8080/mailbox/%s/devices", mailbox.Id)
+	req := testRequest("POST", devicesUrl, bytes.NewBuffer(body), t, mailboxKey, &mailbox)
+	w := httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when registering device but got", w.Code, w.Body.String())
+	}
+
+	var device datastore.Device
+	if err := json.NewDecoder(w.Body).Decode(&device); err != nil {
+		t.Fatal("Error decoding device:", err)
+	}
+
+	// sessions signed by the device key work when the device is named
+	req = testRequest("GET", devicesUrl, nil, t, deviceKey, &mailbox)
+	req.Header.Add("X-Hearst-Device", device.Id)
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response with a device session but got", w.Code)
+	}
+
+	var devices []datastore.Device
+	if err := json.NewDecoder(w.Body).Decode(&devices); err != nil || len(devices) != 1 {
+		t.Fatal("Expected the registered device to be listed but got", devices, err)
+	}
+
+	req = testRequest("DELETE", devicesUrl+"/"+device.Id, nil, t, mailboxKey, &mailbox)
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when removing device but got", w.Code)
+	}
+
+	req = testRequest("GET", devicesUrl, nil, t, deviceKey, &mailbox)
+	req.Header.Add("X-Hearst-Device", device.Id)
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Fatal("Expected 403 response with a session of a removed device but got", w.Code)
+	}
+}
+
+func TestMailboxProfileRequests(t *testing.T) {
+	mailbox, mailboxKey := testMailbox(t)
+	other, _ := testMailbox(t)
+	if err := other.UpdateProfile(datastore.Profile{Handle: "profile-test-taken"}); err != nil {
+		t.Fatal("Error updating profile:", err)
+	}
+
+	profileUrl := fmt.Sprintf("http://localhost:8080/mailbox/%s/profile", mailbox.Id)
+	body, _ := json.Marshal(datastore.Profile{Handle: "Profile-Test-Taken"})
+	req := testRequest("PUT", profileUrl, bytes.NewBuffer(body), t, mailboxKey, &mailbox)
+	w := httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 409 {
+		t.Fatal("Expected 409 response when taking another mailbox's handle but got", w.Code)
+	}
+
+	body, _ = json.Marshal(datastore.Profile{
+		Handle:      "Profile-Test",
+		DisplayName: "Profile Test",
+		Fields:      []byte(`{"city": "Toronto"}`),
+	})
+	req = testRequest("PUT", profileUrl, bytes.NewBuffer(body), t, mailboxKey, &mailbox)
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when updating profile but got", w.Code, w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8080/mailbox/?handle=profile-test", nil)
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	var found datastore.Mailbox
+	if err := json.NewDecoder(w.Body).Decode(&found); err != nil || found.Id != mailbox.Id {
+		t.Fatal("Expected to find mailbox by handle but got", found, err)
+	}
+
+	if found.DisplayName != "Profile Test" || found.Handle != "profile-test" {
+		t.Fatal("Expected profile to be saved but got", found.Profile)
+	}
+}
+
+func TestMailboxBlockRequests(t *testing.T) {
+	mailbox, mailboxKey := testMailbox(t)
+	other, _ := testMailbox(t)
+
+	blocksUrl := fmt.Sprintf("http://localhost:8080/mailbox/%s/blocks", mailbox.Id)
+	body, _ := json.Marshal(blockRequest{MailboxId: other.Id, Kind: "mute"})
+	req := testRequest("POST", blocksUrl, bytes.NewBuffer(body), t, mailboxKey, &mailbox)
+	w := httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when muting mailbox but got", w.Code, w.Body.String())
+	}
+
+	req = testRequest("GET", blocksUrl, nil, t, mailboxKey, &mailbox)
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	var blocks []datastore.Block
+	if err := json.NewDecoder(w.Body).Decode(&blocks); err != nil || len(blocks) != 1 || blocks[0].Kind != datastore.KindMute {
+		t.Fatal("Expected muted mailbox in blocks but got", blocks, err)
+	}
+
+	req = testRequest("DELETE", blocksUrl+"/"+other.Id, nil, t, mailboxKey, &mailbox)
+	w = httptest.NewRecorder()
+	mbc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when unblocking mailbox but got", w.Code, w.Body.String())
+	}
+
+	if blocks, err := mailbox.Blocks(); err != nil || len(blocks) != 0 {
+		t.Fatal("Expected no blocks after unblocking but got", blocks, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/omarqazi/hearst/datastore"
 	"net/http"
+	"strconv"
 )
 
 type MessageController struct {
@@ -19,16 +20,31 @@ func (mc MessageController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		mc.GetMessage(rid(r), w, r, &mb)
+		if !allowRequest(w, r, rateLimitList, &mb) {
+			return
+		}
+
+		if urlSubcategory(r) == "revisions" {
+			mc.GetRevisions(rid(r), w, r, &mb)
+		} else {
+			mc.GetMessage(rid(r), w, r, &mb)
+		}
 	case "POST":
-		mc.PostMessage(w, r, &mb)
+		if allowRequest(w, r, rateLimitMessage, &mb) {
+			mc.PostMessage(w, r, &mb)
+		}
 	default:
 		mc.HandleUnknown(w, r)
 	}
 }
 
+// Most messages returned by one request for the history of a thread
 const messageLimit = 500
 
+// Function GetMessage responds with the history of a thread, the latest
+// messages by default. Pages are chosen with the "before" and "after" index
+// cursors and the "limit" query parameters, and the X-Hearst-Previous and
+// X-Hearst-Next headers have the cursors of the pages around this one
 func (mc MessageController) GetMessage(tid string, w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
 	thread, err := datastore.GetThread(tid)
 	if err != nil {
@@ -36,23 +52,58 @@ func (mc MessageController) GetMessage(tid string, w http.ResponseWriter, r *htt
 		return
 	}
 
-	userThreadMember, err := thread.GetMember(mb.Id)
-	if err != nil || !userThreadMember.AllowRead {
+	if !mb.Can(datastore.ActionList, &thread) {
 		http.Error(w, "acess denied: not thread member", 403)
 		return
 	}
 
-	topic := r.URL.Query().Get("topic")
+	query := r.URL.Query()
+	topic := query.Get("topic")
 	if topic == "" {
 		topic = "%"
 	}
 
-	recentMessages, err := thread.RecentMessagesWithTopic(topic, messageLimit)
+	filter, err := datastore.ParseJSONFilter(query.Get("labels"), query.Get("payload"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > messageLimit {
+		limit = messageLimit
+	}
+
+	before, beforeErr := strconv.ParseInt(query.Get("before"), 10, 64)
+	after, afterErr := strconv.ParseInt(query.Get("after"), 10, 64)
+	reader := mb.Member(thread.Id)
+	var recentMessages []datastore.Message
+	switch {
+	case beforeErr == nil:
+		recentMessages, err = thread.MessagesBefore(before, limit, topic, reader, filter)
+	case afterErr == nil:
+		recentMessages, err = thread.MessagesSince(after, limit, topic, reader, filter)
+	default:
+		recentMessages, err = thread.RecentMessagesWithTopic(topic, limit, reader, filter)
+	}
 	if err != nil {
 		http.Error(w, "error finding recent messages", 500)
 		return
 	}
 
+	// The cursors come from the page before messages outside the session
+	// scope are removed, so that scoped sessions do not repeat pages
+	pagingBack := afterErr != nil
+	if len(recentMessages) > 0 {
+		if !pagingBack || len(recentMessages) == limit {
+			w.Header().Set("X-Hearst-Previous", strconv.Itoa(recentMessages[0].Index))
+		}
+		w.Header().Set("X-Hearst-Next", strconv.Itoa(recentMessages[len(recentMessages)-1].Index))
+	} else if !pagingBack {
+		w.Header().Set("X-Hearst-Next", strconv.FormatInt(after, 10))
+	}
+	recentMessages = mb.ScopeMessages(recentMessages)
+
 	encoder := json.NewEncoder(w)
 	w.Header().Add("Content-Type", "application/json")
 	if err := encoder.Encode(recentMessages); err != nil {
@@ -60,6 +111,21 @@ func (mc MessageController) GetMessage(tid string, w http.ResponseWriter, r *htt
 	}
 }
 
+// Function GetRevisions responds to /messages/<message id>/revisions with
+// the earlier versions of the message, oldest first
+func (mc MessageController) GetRevisions(mid string, w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	revisions, err := messageRevisions(mb, mid)
+	if err != nil {
+		http.Error(w, "message not found", 404)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(revisions); err != nil {
+		http.Error(w, "error marshaling response JSON", 500)
+	}
+}
+
 func (mc MessageController) PostMessage(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
 	var message datastore.Message
 	decoder := json.NewDecoder(r.Body)
@@ -72,11 +138,8 @@ func (mc MessageController) PostMessage(w http.ResponseWriter, r *http.Request,
 		message.ThreadId = rid(r)
 	}
 
-	thread := datastore.Thread{
-		Record: datastore.Rec(message.ThreadId),
-	}
-	userMember, err := thread.GetMember(mb.Id)
-	if err != nil || !userMember.AllowWrite {
+	message.SenderMailboxId = mb.Id
+	if !mb.Can(datastore.ActionCreate, &message) {
 		http.Error(w, "access denied: not member of thread", 403)
 		return
 	}
@@ -8,6 +8,7 @@ import (
 	"github.com/omarqazi/hearst/datastore"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 )
@@ -82,7 +83,7 @@ func TestMessageGetRequest(t *testing.T) {
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
-	token, err := auth.NewToken(serverSessionKey)
+	token, err := auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -133,7 +134,7 @@ func TestMessageGetRequest(t *testing.T) {
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
-	token, err = auth.NewToken(serverSessionKey)
+	token, err = auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -178,7 +179,7 @@ func TestMessageGetRequest(t *testing.T) {
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
-	token, err = auth.NewToken(serverSessionKey)
+	token, err = auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -271,7 +272,7 @@ func TestMessagePostRequest(t *testing.T) {
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
-	token, err := auth.NewToken(serverSessionKey)
+	token, err := auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -372,7 +373,7 @@ func TestPermissions(t *testing.T) {
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
-	token, err := auth.NewToken(serverSessionKey)
+	token, err := auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -406,7 +407,7 @@ func TestPermissions(t *testing.T) {
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
-	token, err = auth.NewToken(serverSessionKey)
+	token, err = auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -450,7 +451,7 @@ func TestPermissions(t *testing.T) {
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
-	token, err = auth.NewToken(serverSessionKey)
+	token, err = auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -486,7 +487,7 @@ func TestPermissions(t *testing.T) {
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mailbox.Id)
-	token, err = auth.NewToken(serverSessionKey)
+	token, err = auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -510,3 +511,108 @@ func TestPermissions(t *testing.T) {
 	}
 
 }
+
+func TestMessageGetRequestWithJSONFilter(t *testing.T) {
+	mailbox, mailboxKey := testMailbox(t)
+
+	thread := testThread(t, "test message JSON filter")
+	thread.AddMember(&datastore.ThreadMember{MailboxId: mailbox.Id, AllowRead: true})
+
+	order := &datastore.Message{ThreadId: thread.Id, SenderMailboxId: mailbox.Id, Topic: testMessageTopic}
+	order.Labels.Scan(`{"kind": "order"}`)
+	chat := &datastore.Message{ThreadId: thread.Id, SenderMailboxId: mailbox.Id, Topic: testMessageTopic}
+	chat.Labels.Scan(`{"kind": "chat"}`)
+	testMessages(t, order, chat)
+
+	requestUrl := fmt.Sprintf("http://localhost:8080/messages/%s?labels=%s", thread.Id, url.QueryEscape(`{"kind": "order"}`))
+	req := testRequest("GET", requestUrl, nil, t, mailboxKey, &mailbox)
+	w := httptest.NewRecorder()
+	mc.ServeHTTP(w, req)
+	var messages []datastore.Message
+	if err := json.NewDecoder(w.Body).Decode(&messages); err != nil || len(messages) != 1 || messages[0].Id != order.Id {
+		t.Fatal("Expected only the order message but got", messages, err, w.Code)
+	}
+
+	requestUrl = fmt.Sprintf("http://localhost:8080/messages/%s?payload=%s", thread.Id, url.QueryEscape(`{"kind":`))
+	req = testRequest("GET", requestUrl, nil, t, mailboxKey, &mailbox)
+	w = httptest.NewRecorder()
+	mc.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatal("Expected 400 response for an invalid JSON filter but got", w.Code)
+	}
+}
+
+func TestMessageGetRequestPaging(t *testing.T) {
+	mailbox, mailboxKey := testMailbox(t)
+
+	thread := testThread(t, "test message paging")
+	thread.AddMember(&datastore.ThreadMember{MailboxId: mailbox.Id, AllowRead: true})
+
+	for i := 0; i < 5; i++ {
+		testMessages(t, &datastore.Message{ThreadId: thread.Id, SenderMailboxId: mailbox.Id, Topic: testMessageTopic})
+	}
+
+	getPage := func(query string) ([]datastore.Message, http.Header) {
+		requestUrl := fmt.Sprintf("http://localhost:8080/messages/%s?%s", thread.Id, query)
+		req := testRequest("GET", requestUrl, nil, t, mailboxKey, &mailbox)
+		w := httptest.NewRecorder()
+		mc.ServeHTTP(w, req)
+
+		var messages []datastore.Message
+		if err := json.NewDecoder(w.Body).Decode(&messages); err != nil {
+			t.Fatal("Error decoding messages page:", err, w.Code)
+		}
+		return messages, w.Header()
+	}
+
+	latest, header := getPage("limit=2")
+	if len(latest) != 2 || latest[1].Index != 5 || header.Get("X-Hearst-Previous") != "4" || header.Get("X-Hearst-Next") != "5" {
+		t.Fatal("Expected the latest two messages with cursors but got", latest, header)
+	}
+
+	older, header := getPage("limit=2&before=" + header.Get("X-Hearst-Previous"))
+	if len(older) != 2 || older[0].Index != 2 || header.Get("X-Hearst-Previous") != "2" {
+		t.Fatal("Expected the two messages before the latest page but got", older, header)
+	}
+
+	oldest, header := getPage("limit=2&before=" + header.Get("X-Hearst-Previous"))
+	if len(oldest) != 1 || oldest[0].Index != 1 || header.Get("X-Hearst-Previous") != "" {
+		t.Fatal("Expected the first message with no previous cursor but got", oldest, header)
+	}
+
+	newer, header := getPage("limit=2&after=" + header.Get("X-Hearst-Next"))
+	if len(newer) != 2 || newer[0].Index != 2 || header.Get("X-Hearst-Next") != "3" {
+		t.Fatal("Expected the two messages after the first but got", newer, header)
+	}
+}
+
+func TestMessageRevisionsRequest(t *testing.T) {
+	mailbox, mailboxKey := testMailbox(t)
+	outsider, outsiderKey := testMailbox(t)
+	thread := testThread(t, "test message revisions")
+	thread.AddMember(&datastore.ThreadMember{MailboxId: mailbox.Id, AllowRead: true, AllowWrite: true})
+
+	m := &datastore.Message{ThreadId: thread.Id, SenderMailboxId: mailbox.Id, Topic: testMessageTopic, Body: "before"}
+	testMessages(t, m)
+
+	m.Body = "after"
+	if err := m.Update(); err != nil {
+		t.Fatal("Error updating message:", err)
+	}
+
+	requestUrl := fmt.Sprintf("http://localhost:8080/messages/%s/revisions", m.Id)
+	req := testRequest("GET", requestUrl, nil, t, mailboxKey, &mailbox)
+	w := httptest.NewRecorder()
+	mc.ServeHTTP(w, req)
+	var revisions []datastore.MessageRevision
+	if err := json.NewDecoder(w.Body).Decode(&revisions); err != nil || len(revisions) != 1 || revisions[0].Body != "before" {
+		t.Fatal("Expected the replaced version of the message but got", revisions, err, w.Code)
+	}
+
+	req = testRequest("GET", requestUrl, nil, t, outsiderKey, &outsider)
+	w = httptest.NewRecorder()
+	mc.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Fatal("Expected 404 response for revisions of an unreadable message but got", w.Code)
+	}
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/omarqazi/hearst/datastore"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions that have their own rate limits
+const (
+	rateLimitMessage = "message" // inserting messages
+	rateLimitMailbox = "mailbox" // creating mailboxes
+	rateLimitList    = "list"    // listing and searching messages, threads and members
+)
+
+// Limits are read from HEARST_RATE_LIMIT_<ACTION>, like
+// HEARST_RATE_LIMIT_MESSAGE=60/1m, and limits per IP address from
+// HEARST_RATE_LIMIT_<ACTION>_IP. Set a limit to "off" to disable it
+const rateLimitVariablePrefix = "HEARST_RATE_LIMIT_"
+const ipRateLimitVariableSuffix = "_IP"
+
+// Sockets are closed after this many requests in a row are over the limit
+const maxRateLimitStrikes = 20
+
+// Limits for each mailbox
+var rateLimits = map[string]datastore.RateLimit{
+	rateLimitMessage: {Burst: 60, Period: time.Minute},
+	rateLimitMailbox: {Burst: 10, Period: time.Hour},
+	rateLimitList:    {Burst: 120, Period: time.Minute},
+}
+
+// Limits for each IP address. Many mailboxes can share an address behind a
+// NAT, so these are higher than the limits for one mailbox
+var ipRateLimits = map[string]datastore.RateLimit{
+	rateLimitMessage: {Burst: 600, Period: time.Minute},
+	rateLimitMailbox: {Burst: 50, Period: time.Hour},
+	rateLimitList:    {Burst: 1200, Period: time.Minute},
+}
+
+func init() {
+	loadRateLimits(rateLimits, "")
+	loadRateLimits(ipRateLimits, ipRateLimitVariableSuffix)
+}
+
+// Function loadRateLimits overrides the limits with the ones set in the
+// environment variables ending in suffix
+func loadRateLimits(limits map[string]datastore.RateLimit, suffix string) {
+	for action := range limits {
+		limitString := os.Getenv(rateLimitVariablePrefix + strings.ToUpper(action) + suffix)
+		if limitString == "" {
+			continue
+		} else if limitString == "off" {
+			delete(limits, action)
+			continue
+		}
+
+		limit, err := datastore.ParseRateLimit(limitString)
+		if err != nil {
+			log.Fatalln("Invalid rate limit for", action+suffix, err)
+		}
+		limits[action] = limit
+	}
+}
+
+// Function allowAction checks the rate limits for action, both for the mailbox
+// and for the IP address in remoteAddr. mb may be nil for clients that are
+// not signed in. A token is only taken if both limits allow the action. If a
+// limit is exceeded it returns false and how long to wait. If redis can not
+// be reached the action is allowed
+func allowAction(action string, mb *datastore.Mailbox, remoteAddr string) (bool, time.Duration) {
+	buckets := []datastore.RateLimitBucket{}
+	if limit, ok := ipRateLimits[action]; ok {
+		buckets = append(buckets, datastore.RateLimitBucket{Key: action + "-ip-" + remoteIP(remoteAddr), Limit: limit})
+	}
+	if limit, ok := rateLimits[action]; ok && mb != nil && mb.Id != "" {
+		buckets = append(buckets, datastore.RateLimitBucket{Key: action + "-mailbox-" + mb.Id, Limit: limit})
+	}
+
+	allowed, retryAfter, err := datastore.AllowAll(buckets...)
+	if err != nil {
+		log.Println("Error checking rate limit:", err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// Function allowRequest checks the rate limit of an HTTP request. If it
+// is over the limit a 429 response is sent and false is returned
+func allowRequest(w http.ResponseWriter, r *http.Request, action string, mb *datastore.Mailbox) bool {
+	allowed, retryAfter := allowAction(action, mb, r.RemoteAddr)
+	if !allowed {
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		http.Error(w, "rate limit exceeded", 429)
+	}
+	return allowed
+}
+
+// Struct socketLimiter applies rate limits to the requests on a socket and
+// closes it when the client keeps going over the limit
+type socketLimiter struct {
+	conn    *websocket.Conn
+	mb      *datastore.Mailbox
+	strikes int
+}
+
+// Function Allow returns true if the request may be handled. Otherwise
+// it returns an error response for the client
+func (sl *socketLimiter) Allow(action string, rid string) (bool, map[string]string) {
+	allowed, retryAfter := allowAction(action, sl.mb, sl.conn.RemoteAddr().String())
+	if allowed {
+		sl.strikes = 0
+		return true, nil
+	}
+
+	sl.strikes++
+	if sl.strikes >= maxRateLimitStrikes {
+		closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded")
+		sl.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(pingTime))
+		sl.conn.Close()
+	}
+
+	return false, map[string]string{
+		"error":       "rate limit exceeded",
+		"retry_after": retryAfterSeconds(retryAfter),
+		"rid":         rid,
+	}
+}
+
+// Function requestRateLimit returns the rate limited action a socket request
+// performs, or a blank string if it is not limited. It understands both the
+// sock and the older socket protocol
+func requestRateLimit(request map[string]string) string {
+	switch action := request["action"]; {
+	case action == "list" || action == "search":
+		return rateLimitList
+	case (action == "create" || action == "insert") && request["model"] == "message":
+		return rateLimitMessage
+	case (action == "create" || action == "insert") && request["model"] == "mailbox":
+		return rateLimitMailbox
+	}
+	return ""
+}
+
+func retryAfterSeconds(retryAfter time.Duration) string {
+	return strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10)
+}
+
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
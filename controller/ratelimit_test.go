@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"github.com/omarqazi/hearst/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestRateLimit(t *testing.T) {
+	cases := []struct {
+		action, model, limit string
+	}{
+		{"list", "thread", rateLimitList},
+		{"create", "message", rateLimitMessage},
+		{"insert", "message", rateLimitMessage},
+		{"create", "mailbox", rateLimitMailbox},
+		{"read", "message", ""},
+		{"update", "thread", ""},
+	}
+
+	for _, c := range cases {
+		if limit := requestRateLimit(map[string]string{"action": c.action, "model": c.model}); limit != c.limit {
+			t.Error("Expected", c.action, c.model, "to be limited as", c.limit, "but got", limit)
+		}
+	}
+}
+
+// Function testRateLimit sets the limit for action until the test ends
+func testRateLimit(t *testing.T, limits map[string]datastore.RateLimit, action string, limit datastore.RateLimit) {
+	previousLimit, hadLimit := limits[action]
+	limits[action] = limit
+	t.Cleanup(func() {
+		if hadLimit {
+			limits[action] = previousLimit
+		} else {
+			delete(limits, action)
+		}
+	})
+}
+
+func TestAllowRequest(t *testing.T) {
+	testRateLimit(t, ipRateLimits, rateLimitMailbox, datastore.RateLimit{Burst: 1, Period: time.Hour})
+
+	r, _ := http.NewRequest("POST", "http://localhost:8080/mailbox/", nil)
+	r.RemoteAddr = "test-" + datastore.NewUUID() + ":1234"
+
+	if w := httptest.NewRecorder(); !allowRequest(w, r, rateLimitMailbox, nil) {
+		t.Fatal("Error: first request was rate limited")
+	}
+
+	w := httptest.NewRecorder()
+	if allowRequest(w, r, rateLimitMailbox, nil) {
+		t.Fatal("Error: request over the limit was allowed")
+	}
+
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Fatal("Expected 429 response with Retry-After but got", w.Code, w.Header())
+	}
+}
+
+func TestAllowActionBuckets(t *testing.T) {
+	testRateLimit(t, rateLimits, rateLimitMessage, datastore.RateLimit{Burst: 1, Period: time.Hour})
+	testRateLimit(t, ipRateLimits, rateLimitMessage, datastore.RateLimit{Burst: 2, Period: time.Hour})
+
+	remoteAddr := "test-" + datastore.NewUUID() + ":1234"
+	alice, bob := datastore.NewMailbox(), datastore.NewMailbox()
+
+	if allowed, _ := allowAction(rateLimitMessage, &alice, remoteAddr); !allowed {
+		t.Fatal("Error: first message was rate limited")
+	}
+
+	// alice is over her own limit, which must not use up the address's limit
+	for i := 0; i < 3; i++ {
+		if allowed, retryAfter := allowAction(rateLimitMessage, &alice, remoteAddr); allowed || retryAfter <= 0 {
+			t.Fatal("Expected message over the mailbox limit to wait but got", allowed, retryAfter)
+		}
+	}
+
+	if allowed, _ := allowAction(rateLimitMessage, &bob, remoteAddr); !allowed {
+		t.Fatal("Error: another mailbox at the same address was rate limited")
+	}
+
+	carol := datastore.NewMailbox()
+	if allowed, _ := allowAction(rateLimitMessage, &carol, remoteAddr); allowed {
+		t.Fatal("Error: message over the address limit was allowed")
+	}
+}
@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// SearchController searches the messages a mailbox may read
+type SearchController struct {
+}
+
+func (sc SearchController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mb, err := authorizedMailbox(r)
+	if err != nil {
+		http.Error(w, "session token invalid", 403)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "search is read only", 405)
+		return
+	}
+
+	if !allowRequest(w, r, rateLimitList, &mb) {
+		return
+	}
+
+	results, err := searchMessages(&mb, r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, "could not search messages: "+err.Error(), 400)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		http.Error(w, "error marshaling response JSON", 500)
+	}
+}
@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omarqazi/hearst/datastore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var searchc = http.StripPrefix("/search/", SearchController{})
+
+func TestSearchRequests(t *testing.T) {
+	mailbox, mailboxKey := testMailbox(t)
+	thread, otherThread := testThread(t, "search test"), testThread(t, "search test")
+
+	member := datastore.ThreadMember{MailboxId: mailbox.Id, AllowRead: true, AllowWrite: true}
+	if err := thread.AddMember(&member); err != nil {
+		t.Fatal("Error adding thread member:", err)
+	}
+
+	message := datastore.Message{ThreadId: thread.Id, SenderMailboxId: mailbox.Id, Topic: "chat", Body: "searching for needles"}
+	testMessages(t, &message)
+
+	searchUrl := fmt.Sprintf("http://localhost:8080/search/?q=needle&thread_id=%s&sender=%s", thread.Id, mailbox.Id)
+	req := testRequest("GET", searchUrl, nil, t, mailboxKey, &mailbox)
+	w := httptest.NewRecorder()
+	searchc.ServeHTTP(w, req)
+	var results []datastore.SearchResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil || len(results) != 1 || results[0].Id != message.Id {
+		t.Fatal("Expected matching message in search results but got", results, err, w.Code)
+	}
+
+	req = testRequest("GET", "http://localhost:8080/search/?q=needle&thread_id="+otherThread.Id, nil, t, mailboxKey, &mailbox)
+	w = httptest.NewRecorder()
+	searchc.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Fatal("Expected 400 response when searching a thread the mailbox can not read but got", w.Code)
+	}
+}
@@ -1,7 +1,9 @@
 package controller
 
 import (
-	"crypto/rsa"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/omarqazi/hearst/auth"
@@ -33,6 +35,12 @@ type SockRequest struct {
 
 // Upgrade incoming HTTP connections to WebSocket
 func (sc SockController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := datastore.ParseJSONFilter(r.URL.Query().Get("labels"), r.URL.Query().Get("payload"))
+	if err != nil {
+		http.Error(w, "invalid notification filter: "+err.Error(), 400)
+		return
+	}
+
 	conn, err := socketizer.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, "error upgrading connection", 500)
@@ -43,19 +51,29 @@ func (sc SockController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	conn.SetPongHandler(sc.HandlePong)
 	responses := make(chan interface{}, 10)
 
-	mb, err := sc.IdentifyClient(conn)
+	mb, session, err := sc.IdentifyClient(conn)
 	if err != nil {
 		return
 	}
 
+	done := make(chan struct{})
+	defer close(done)
+	go disconnectOnRevoke(conn, &mb, session.Id(), done)
+
+	sock, err := mb.OpenSocket(session.Id(), "sock", r.RemoteAddr)
+	if err == nil {
+		defer sock.Close()
+	}
+
 	mb.StillConnected()
 	conn.SetPongHandler(func(appData string) error {
 		mb.StillConnected()
+		sock.StillConnected()
 		return nil
 	})
 
 	go sc.HandleReads(conn, responses, r, &mb)
-	go sc.HandleNotifications(conn, responses, r, &mb)
+	go sc.HandleNotifications(conn, responses, filter, &mb)
 	sc.HandleWrites(conn, responses, time.Tick(pingTime), &mb)
 }
 
@@ -71,6 +89,7 @@ func (sc SockController) HandleReads(conn *websocket.Conn, responses chan interf
 		HTTPRequest: r,
 		Client:      mb,
 	}
+	limiter := socketLimiter{conn: conn, mb: mb}
 
 	for {
 		if err = conn.ReadJSON(&request); err != nil {
@@ -80,6 +99,16 @@ func (sc SockController) HandleReads(conn *websocket.Conn, responses chan interf
 
 		mb.StillConnected()
 
+		if action := requestRateLimit(request); action != "" {
+			if allowed, errorResponse := limiter.Allow(action, request["rid"]); !allowed {
+				if request["action"] == "create" {
+					conn.ReadJSON(&map[string]interface{}{}) // skip the object that follows the request
+				}
+				responses <- errorResponse
+				continue
+			}
+		}
+
 		switch request["action"] {
 		case "create":
 			err = sc.HandleCreate(req, responses)
@@ -91,6 +120,20 @@ func (sc SockController) HandleReads(conn *websocket.Conn, responses chan interf
 			err = sc.HandleDelete(req, responses)
 		case "list":
 			err = sc.HandleList(req, responses)
+		case "rotatekey":
+			err = sc.HandleRotateKey(req, responses)
+		case "redeem":
+			err = sc.HandleRedeemInvitation(req, responses)
+		case "join":
+			err = sc.HandleJoinThread(req, responses)
+		case "approve", "deny":
+			err = sc.HandleDecideJoinRequest(req, responses)
+		case "direct":
+			err = sc.HandleDirectThread(req, responses)
+		case "block", "mute", "unblock":
+			err = sc.HandleBlock(req, responses)
+		case "search":
+			err = sc.HandleSearch(req, responses)
 		default:
 			responses <- map[string]string{"error": "invalid action"}
 		}
@@ -115,6 +158,16 @@ func (sc SockController) HandleCreate(req SockRequest, responses chan interface{
 		dbo = &datastore.Message{}
 	case "threadmember":
 		dbo = &datastore.ThreadMember{}
+	case "group":
+		return sc.HandleCreateGroup(req, responses)
+	case "groupmember":
+		dbo = &datastore.GroupMember{}
+	case "threadgroup":
+		dbo = &datastore.ThreadGroup{}
+	case "device":
+		return sc.HandleRegisterDevice(req, responses)
+	case "invitation":
+		return sc.HandleCreateInvitation(req, responses)
 	default:
 		return errors.New("Error during create: invalid model type")
 	}
@@ -126,10 +179,14 @@ func (sc SockController) HandleCreate(req SockRequest, responses chan interface{
 	switch dbo := dbo.(type) {
 	case *datastore.Message:
 		dbo.SenderMailboxId = req.Client.Id
+	case *datastore.Thread:
+		// ids are always generated, so clients can not take the id of a direct thread
+		dbo.Id = ""
+		dbo.Direct = false // direct threads are only made by HandleDirectThread
 	}
 
 	go func() {
-		if !req.Client.CanWrite(dbo.PermissionThreadId()) {
+		if !req.Client.Can(datastore.ActionCreate, dbo) {
 			responses <- map[string]string{"error": "you do not have permission to create this object", "rid": rid}
 			return
 		}
@@ -145,15 +202,16 @@ func (sc SockController) HandleCreate(req SockRequest, responses chan interface{
 
 		// If we're creating a thread we need to give ourselves permissions over it
 		if req.Request["model"] == "thread" {
-			adminMember := &datastore.ThreadMember{
-				ThreadId:          dbo.PermissionThreadId(),
+			ownerMember := &datastore.ThreadMember{
+				ThreadId:          dbo.Policy().ThreadId,
 				MailboxId:         req.Client.Id,
 				AllowRead:         true,
 				AllowWrite:        true,
 				AllowNotification: true,
+				Role:              datastore.RoleOwner,
 			}
 
-			if memAddErr := adminMember.Insert(); memAddErr != nil {
+			if memAddErr := ownerMember.Insert(); memAddErr != nil {
 				responses <- map[string]string{"error": "error adding thread member to new thread", "rid": rid}
 				return
 			}
@@ -177,6 +235,9 @@ func (sc SockController) HandleRead(req SockRequest, responses chan interface{})
 
 	switch req.Request["model"] {
 	case "mailbox":
+		if handle := req.Request["handle"]; handle != "" {
+			return sc.HandleReadHandle(req, responses)
+		}
 		dbo = &datastore.Mailbox{Record: datastore.Rec(req.Request["id"])}
 	case "thread":
 		dbo = &datastore.Thread{Record: datastore.Rec(req.Request["id"])}
@@ -184,6 +245,12 @@ func (sc SockController) HandleRead(req SockRequest, responses chan interface{})
 		dbo = &datastore.Message{Id: req.Request["id"]}
 	case "threadmember":
 		dbo = &datastore.ThreadMember{MailboxId: req.Request["mailbox_id"], ThreadId: req.Request["thread_id"]}
+	case "group":
+		dbo = &datastore.Group{Record: datastore.Rec(req.Request["id"])}
+	case "groupmember":
+		dbo = &datastore.GroupMember{GroupId: req.Request["group_id"], MailboxId: req.Request["mailbox_id"]}
+	case "threadgroup":
+		dbo = &datastore.ThreadGroup{ThreadId: req.Request["thread_id"], GroupId: req.Request["group_id"]}
 	default:
 		return errors.New("Error during read: invalid model type")
 	}
@@ -194,7 +261,7 @@ func (sc SockController) HandleRead(req SockRequest, responses chan interface{})
 			return
 		}
 
-		if req.Client.CanRead(dbo.PermissionThreadId()) {
+		if req.Client.Can(datastore.ActionRead, dbo) {
 			responses <- dbo
 		} else {
 			responses <- map[string]string{"error": "client not authorized to read this object"}
@@ -212,6 +279,22 @@ func (sc SockController) HandleList(req SockRequest, responses chan interface{})
 		err = sc.HandleListThreadMember(req, responses)
 	case "mailbox":
 		err = sc.HandleListMailbox(req, responses)
+	case "session":
+		err = sc.HandleListSession(req, responses)
+	case "socket":
+		err = sc.HandleListSocket(req, responses)
+	case "device":
+		err = sc.HandleListDevice(req, responses)
+	case "invitation":
+		err = sc.HandleListInvitation(req, responses)
+	case "joinrequest":
+		err = sc.HandleListJoinRequest(req, responses)
+	case "group", "groupmember", "threadgroup":
+		err = sc.HandleListGroup(req, responses)
+	case "block":
+		err = sc.HandleListBlock(req, responses)
+	case "revision":
+		err = sc.HandleListRevision(req, responses)
 	}
 	return
 }
@@ -227,7 +310,7 @@ func (sc SockController) HandleListThread(req SockRequest, responses chan interf
 			return
 		}
 
-		if !req.Client.CanRead(thread.Id) {
+		if !req.Client.Can(datastore.ActionList, &thread) {
 			responses <- map[string]string{"error": "not authorized to list thread", "thread_id": threadId, "rid": rid}
 			return
 		}
@@ -244,17 +327,25 @@ func (sc SockController) HandleListThread(req SockRequest, responses chan interf
 			lsn = 0
 		}
 
+		filter, err := datastore.ParseJSONFilter(req.Request["labels"], req.Request["payload"])
+		if err != nil {
+			responses <- map[string]string{"error": err.Error(), "thread_id": thread.Id, "rid": rid}
+			return
+		}
+
 		topic := req.Request["topic"]
+		reader := req.Client.Member(thread.Id)
 		var messages []datastore.Message
 		if req.Request["choose"] == "latest" {
-			messages, err = thread.RecentMessagesSince(lsn, limit, topic)
+			messages, err = thread.RecentMessagesSince(lsn, limit, topic, reader, filter)
 		} else {
-			messages, err = thread.MessagesSince(lsn, limit, topic)
+			messages, err = thread.MessagesSince(lsn, limit, topic, reader, filter)
 		}
 		if err != nil {
 			responses <- map[string]string{"error": "error retrieving recent messages", "thread_id": thread.Id, "rid": rid}
 			return
 		}
+		messages = req.Client.ScopeMessages(messages)
 
 		if len(rid) > 0 {
 			responses <- map[string]interface{}{
@@ -276,6 +367,11 @@ func (sc SockController) HandleListThreadMember(req SockRequest, responses chan
 
 		if hasThreadId {
 			thread := datastore.Thread{Record: datastore.Rec(threadId)}
+			if !req.Client.Can(datastore.ActionList, &thread) {
+				responses <- map[string]string{"error": "not authorized to list thread members", "thread_id": threadId}
+				return
+			}
+
 			members, err := thread.GetAllMembers()
 			if err != nil {
 				responses <- map[string]string{"error": "unable to get members for thread", "thread_id": threadId}
@@ -284,11 +380,16 @@ func (sc SockController) HandleListThreadMember(req SockRequest, responses chan
 			}
 		} else if hasMailboxId {
 			mailbox := datastore.Mailbox{Record: datastore.Rec(mailboxId)}
+			if !req.Client.Can(datastore.ActionList, &mailbox) {
+				responses <- map[string]string{"error": "not authorized to list threads of mailbox", "mailbox_id": mailboxId}
+				return
+			}
+
 			members, err := mailbox.GetAllThreadMembers()
 			if err != nil {
 				responses <- map[string]string{"error": "unable to get threads for mailbox", "mailbox_id": mailboxId}
 			} else {
-				responses <- members
+				responses <- scopeThreadMembers(req.Client, members)
 			}
 		} else {
 			responses <- map[string]string{"error": "neither thread_id nor mailbox_id required"}
@@ -335,6 +436,7 @@ func (sc SockController) HandleListMailbox(req SockRequest, responses chan inter
 
 		lastUpdatedTime := time.Unix(lastUpdatedInt, 0)
 		recentThreads, rtErr := mailbox.RecentThreads(lastUpdatedTime, limitInt, offsetInt)
+		recentThreads = mailbox.ScopeThreads(recentThreads)
 		if rtErr != nil {
 			responses <- map[string]string{"error": "unable to get recent threads for mailbox", "mailbox_id": mailbox.Id, "rid": rid}
 		} else if hasRid {
@@ -362,6 +464,16 @@ func (sc SockController) HandleUpdate(req SockRequest, responses chan interface{
 		dbo = &datastore.Message{}
 	case "threadmember":
 		dbo = &datastore.ThreadMember{}
+	case "group":
+		dbo = &datastore.Group{}
+	case "groupmember":
+		dbo = &datastore.GroupMember{}
+	case "threadgroup":
+		dbo = &datastore.ThreadGroup{}
+	case "profile":
+		return sc.HandleUpdateProfile(req, responses)
+	default:
+		return errors.New("Error during update: invalid model type")
 	}
 
 	if err = req.Conn.ReadJSON(&dbo); err != nil {
@@ -369,11 +481,34 @@ func (sc SockController) HandleUpdate(req SockRequest, responses chan interface{
 	}
 
 	go func() {
-		if req.Client.CanWrite(dbo.PermissionThreadId()) {
-			if updateErr := dbo.Update(); updateErr != nil {
-				responses <- map[string]string{"error": "could not update object"}
-				return
+		// Permissions are checked against the stored object,
+		// since the client could have changed its owner or thread
+		stored, loadErr := datastore.Stored(dbo)
+		if loadErr != nil {
+			responses <- map[string]string{"error": "unable to load object from datastore"}
+			return
+		}
+
+		switch dbo := dbo.(type) {
+		case *datastore.Message:
+			dbo.ThreadId = stored.(*datastore.Message).ThreadId
+			dbo.SenderMailboxId = stored.(*datastore.Message).SenderMailboxId
+		case *datastore.ThreadMember:
+			if dbo.Role == "" {
+				dbo.Role = stored.(*datastore.ThreadMember).Role
 			}
+		case *datastore.Thread:
+			dbo.KeepOmitted(*stored.(*datastore.Thread))
+		}
+
+		if req.Client.AuthorizeUpdate(stored, dbo) != nil {
+			responses <- map[string]string{"error": "not authorized to update object"}
+			return
+		}
+
+		if updateErr := dbo.Update(); updateErr != nil {
+			responses <- map[string]string{"error": "could not update object"}
+			return
 		}
 
 		if loadErr := dbo.Load(); loadErr == nil {
@@ -396,19 +531,587 @@ func (sc SockController) HandleDelete(req SockRequest, responses chan interface{
 		dbo = &datastore.Message{Id: req.Request["id"]}
 	case "threadmember":
 		dbo = &datastore.ThreadMember{MailboxId: req.Request["mailbox_id"], ThreadId: req.Request["thread_id"]}
+	case "group":
+		dbo = &datastore.Group{Record: datastore.Rec(req.Request["id"])}
+	case "groupmember":
+		dbo = &datastore.GroupMember{GroupId: req.Request["group_id"], MailboxId: req.Request["mailbox_id"]}
+	case "threadgroup":
+		dbo = &datastore.ThreadGroup{ThreadId: req.Request["thread_id"], GroupId: req.Request["group_id"]}
+	case "session":
+		return sc.HandleRevokeSession(req, responses)
+	case "device":
+		return sc.HandleRemoveDevice(req, responses)
+	case "invitation":
+		return sc.HandleRevokeInvitation(req, responses)
+	case "joinrequest":
+		return sc.HandleWithdrawJoinRequest(req, responses)
 	default:
 		return errors.New("Error during read: invalid model type")
 	}
 
 	go func() {
-		if req.Client.CanWrite(dbo.PermissionThreadId()) {
-			if deleteErr := dbo.Delete(); deleteErr != nil {
-				responses <- map[string]string{"error": "could not delete object"}
+		stored, loadErr := datastore.Stored(dbo)
+		if loadErr != nil {
+			responses <- map[string]string{"error": "unable to load object from datastore"}
+			return
+		}
+
+		if !req.Client.Can(datastore.ActionDelete, stored) {
+			responses <- map[string]string{"error": "not authorized to delete object"}
+			return
+		}
+
+		if deleteErr := stored.Delete(); deleteErr != nil {
+			responses <- map[string]string{"error": "could not delete object"}
+			return
+		}
+		responses <- stored
+	}()
+
+	return
+}
+
+// Function scopeThreadMembers removes memberships of threads outside the
+// client's session scope
+func scopeThreadMembers(client *datastore.Mailbox, members []datastore.ThreadMember) []datastore.ThreadMember {
+	scoped := []datastore.ThreadMember{}
+	for _, member := range members {
+		if client.Scope.AllowsThread(member.ThreadId) {
+			scoped = append(scoped, member)
+		}
+	}
+	return scoped
+}
+
+// Function HandleListSession lists the live sessions of the client's own mailbox
+func (sc SockController) HandleListSession(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid, hasRid := req.Request["rid"]
+		sessions, err := req.Client.ActiveSessions()
+		if err != nil {
+			responses <- map[string]string{"error": "unable to get sessions for mailbox", "rid": rid}
+		} else if hasRid {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": sessions,
 			}
-			responses <- dbo
+		} else {
+			responses <- sessions
+		}
+	}()
+
+	return
+}
+
+// Function HandleListSocket lists the open sockets of the client's own mailbox
+func (sc SockController) HandleListSocket(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid, hasRid := req.Request["rid"]
+		sockets, err := req.Client.OpenSockets()
+		if err != nil {
+			responses <- map[string]string{"error": "unable to get sockets for mailbox", "rid": rid}
+		} else if hasRid {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": sockets,
+			}
+		} else {
+			responses <- sockets
+		}
+	}()
+
+	return
+}
+
+// Function HandleRevokeSession revokes the session with the requested id, or
+// every session of the client's mailbox if "all" is "true"
+func (sc SockController) HandleRevokeSession(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		if !req.Client.Can(datastore.ActionUpdate, req.Client) {
+			responses <- map[string]string{"error": "not authorized to revoke sessions", "rid": rid}
 			return
+		}
+
+		var revokeErr error
+		if req.Request["all"] == "true" {
+			revokeErr = req.Client.RevokeAllSessions()
+		} else if sessionId := req.Request["id"]; sessionId != "" {
+			revokeErr = req.Client.RevokeSession(sessionId)
 		} else {
-			responses <- map[string]string{"error": "not authorized to delete object"}
+			responses <- map[string]string{"error": "id or all required to revoke sessions", "rid": rid}
+			return
+		}
+
+		if revokeErr != nil {
+			responses <- map[string]string{"error": "could not revoke session", "rid": rid}
+		} else {
+			responses <- map[string]string{"revoked": "true", "rid": rid}
+		}
+	}()
+
+	return
+}
+
+// Function HandleListDevice lists the devices of the client's own mailbox
+func (sc SockController) HandleListDevice(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid, hasRid := req.Request["rid"]
+		devices, err := req.Client.Devices()
+		if err != nil {
+			responses <- map[string]string{"error": "unable to get devices for mailbox", "rid": rid}
+		} else if hasRid {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": devices,
+			}
+		} else {
+			responses <- devices
+		}
+	}()
+
+	return
+}
+
+// Function HandleRegisterDevice adds a device named "name" with the key
+// "public_key" to the client's mailbox. "signature" must be a signature of
+// the registration by the mailbox key or the key of another device
+func (sc SockController) HandleRegisterDevice(req SockRequest, responses chan interface{}) (err error) {
+	registration, err := parseDeviceRegistration(req.Request["name"], req.Request["public_key"], req.Request["token"], req.Request["signature"])
+	if err != nil {
+		return errors.New("invalid device registration signature")
+	}
+
+	go func() {
+		rid := req.Request["rid"]
+		device, registerErr := registerDevice(req.Client, registration)
+		if registerErr != nil {
+			responses <- map[string]string{"error": "could not register device: " + registerErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": device,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleRemoveDevice removes the device with the requested id
+// from the client's mailbox and revokes its sessions
+func (sc SockController) HandleRemoveDevice(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		if !req.Client.Can(datastore.ActionDelete, datastore.Device{MailboxId: req.Client.Id}) {
+			responses <- map[string]string{"error": "not authorized to remove devices", "rid": rid}
+			return
+		}
+
+		if removeErr := req.Client.RemoveDevice(req.Request["id"]); removeErr != nil {
+			responses <- map[string]string{"error": "could not remove device", "rid": rid}
+		} else {
+			responses <- map[string]string{"removed": "true", "rid": rid}
+		}
+	}()
+
+	return
+}
+
+// Function HandleCreateInvitation creates an invitation to "thread_id" that
+// grants "allow_read", "allow_write" and "allow_notification" when they are
+// "true". It expires after "expires_in" seconds and "max_uses" uses
+func (sc SockController) HandleCreateInvitation(req SockRequest, responses chan interface{}) (err error) {
+	expiresIn, _ := strconv.ParseInt(req.Request["expires_in"], 10, 64)
+	maxUses, _ := strconv.Atoi(req.Request["max_uses"])
+	invitation := datastore.Invitation{
+		ThreadId:          req.Request["thread_id"],
+		AllowRead:         req.Request["allow_read"] == "true",
+		AllowWrite:        req.Request["allow_write"] == "true",
+		AllowNotification: req.Request["allow_notification"] == "true",
+		MaxUses:           maxUses,
+	}
+
+	go func() {
+		rid := req.Request["rid"]
+		invitation, createErr := createInvitation(req.Client, invitation, time.Duration(expiresIn)*time.Second)
+		if createErr != nil {
+			responses <- map[string]string{"error": "could not create invitation: " + createErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": invitation,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleListInvitation lists the invitations the client has
+// created, only to "thread_id" if it is given
+func (sc SockController) HandleListInvitation(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid, hasRid := req.Request["rid"]
+		invitations, err := req.Client.Invitations(req.Request["thread_id"])
+		if err != nil {
+			responses <- map[string]string{"error": "unable to get invitations", "rid": rid}
+		} else if hasRid {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": invitations,
+			}
+		} else {
+			responses <- invitations
+		}
+	}()
+
+	return
+}
+
+// Function HandleRevokeInvitation revokes an invitation the client created
+func (sc SockController) HandleRevokeInvitation(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		if revokeErr := req.Client.RevokeInvitation(req.Request["id"]); revokeErr != nil {
+			responses <- map[string]string{"error": "could not revoke invitation", "rid": rid}
+		} else {
+			responses <- map[string]string{"revoked": "true", "rid": rid}
+		}
+	}()
+
+	return
+}
+
+// Function HandleRedeemInvitation makes the client a member of
+// the thread the invitation in "token" was issued for
+func (sc SockController) HandleRedeemInvitation(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		member, redeemErr := redeemInvitation(req.Client, "", req.Request["token"])
+		if redeemErr != nil {
+			responses <- map[string]string{"error": "could not redeem invitation: " + redeemErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": member,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleJoinThread adds the client to the open thread "thread_id",
+// or files a join request with "note" if the thread takes requests
+func (sc SockController) HandleJoinThread(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		joined, joinErr := joinThread(req.Client, req.Request["thread_id"], req.Request["note"])
+		if joinErr != nil {
+			responses <- map[string]string{"error": "could not join thread: " + joinErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": joined,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleListJoinRequest lists the pending requests to join
+// "thread_id" for the thread's owners and admins
+func (sc SockController) HandleListJoinRequest(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid, hasRid := req.Request["rid"]
+		requests, err := listJoinRequests(req.Client, req.Request["thread_id"])
+		if err != nil {
+			responses <- map[string]string{"error": "unable to get join requests", "rid": rid}
+		} else if hasRid {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": requests,
+			}
+		} else {
+			responses <- requests
+		}
+	}()
+
+	return
+}
+
+// Function HandleDecideJoinRequest approves or denies the join request "id",
+// depending on whether the action is "approve" or "deny"
+func (sc SockController) HandleDecideJoinRequest(req SockRequest, responses chan interface{}) (err error) {
+	approve := req.Request["action"] == "approve"
+
+	go func() {
+		rid := req.Request["rid"]
+		decided, decideErr := decideJoinRequest(req.Client, req.Request["thread_id"], req.Request["id"], approve)
+		if decideErr != nil {
+			responses <- map[string]string{"error": "could not decide join request: " + decideErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": decided,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleWithdrawJoinRequest deletes a join request the client filed
+func (sc SockController) HandleWithdrawJoinRequest(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		if withdrawErr := withdrawJoinRequest(req.Client, req.Request["thread_id"], req.Request["id"]); withdrawErr != nil {
+			responses <- map[string]string{"error": "could not withdraw join request", "rid": rid}
+		} else {
+			responses <- map[string]string{"withdrawn": "true", "rid": rid}
+		}
+	}()
+
+	return
+}
+
+// Function HandleCreateGroup reads a group from the socket and
+// creates it with the client as its first admin
+func (sc SockController) HandleCreateGroup(req SockRequest, responses chan interface{}) (err error) {
+	var group datastore.Group
+	if err = req.Conn.ReadJSON(&group); err != nil {
+		return
+	}
+
+	go func() {
+		rid := req.Request["rid"]
+		if createErr := createGroup(req.Client, &group); createErr != nil {
+			responses <- map[string]string{"error": "could not create group: " + createErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": group,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleListGroup lists the groups the client is in for the
+// "group" model, the members of "group_id" for "groupmember", and the
+// groups with access to "thread_id" for "threadgroup"
+func (sc SockController) HandleListGroup(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid, hasRid := req.Request["rid"]
+		var list interface{}
+		var listErr error
+
+		switch req.Request["model"] {
+		case "group":
+			list, listErr = req.Client.Groups()
+		case "groupmember":
+			group := datastore.Group{Record: datastore.Rec(req.Request["group_id"])}
+			if !req.Client.Can(datastore.ActionList, &group) {
+				listErr = datastore.ErrNotAllowed
+			} else {
+				list, listErr = group.GetAllMembers()
+			}
+		case "threadgroup":
+			thread := datastore.Thread{Record: datastore.Rec(req.Request["thread_id"])}
+			if !req.Client.Can(datastore.ActionList, &thread) {
+				listErr = datastore.ErrNotAllowed
+			} else {
+				list, listErr = thread.GetGroups()
+			}
+		}
+
+		if listErr != nil {
+			responses <- map[string]string{"error": "unable to list " + req.Request["model"], "rid": rid}
+		} else if hasRid {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": list,
+			}
+		} else {
+			responses <- list
+		}
+	}()
+
+	return
+}
+
+// Function HandleReadHandle responds with the mailbox whose handle is "handle"
+func (sc SockController) HandleReadHandle(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		mailbox, lookupErr := datastore.GetMailboxByHandle(req.Request["handle"])
+		if lookupErr != nil {
+			responses <- map[string]string{"error": "mailbox not found", "rid": rid}
+		} else if len(rid) > 0 {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": mailbox,
+			}
+		} else {
+			responses <- mailbox
+		}
+	}()
+
+	return
+}
+
+// Function HandleUpdateProfile reads a profile from the socket
+// and makes it the profile of the client's mailbox
+func (sc SockController) HandleUpdateProfile(req SockRequest, responses chan interface{}) (err error) {
+	var profile datastore.Profile
+	if err = req.Conn.ReadJSON(&profile); err != nil {
+		return
+	}
+
+	go func() {
+		rid := req.Request["rid"]
+		if updateErr := updateProfile(req.Client, profile); updateErr != nil {
+			responses <- map[string]string{"error": "could not update profile: " + updateErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": req.Client,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleDirectThread responds with the direct thread between
+// the client and "mailbox_id", creating it the first time
+func (sc SockController) HandleDirectThread(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		thread, directErr := directThread(req.Client, req.Request["mailbox_id"])
+		if directErr != nil {
+			responses <- map[string]string{"error": "could not get direct thread: " + directErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": thread,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleListRevision lists the earlier versions of
+// the message "id", oldest first
+func (sc SockController) HandleListRevision(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		revisions, listErr := messageRevisions(req.Client, req.Request["id"])
+		if listErr != nil {
+			responses <- map[string]string{"error": "message not found", "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": revisions,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleBlock blocks, mutes or unblocks "mailbox_id", which
+// may also be a handle like "@omar", depending on the action
+func (sc SockController) HandleBlock(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		if req.Request["action"] == "unblock" {
+			if unblockErr := unblockMailbox(req.Client, req.Request["mailbox_id"]); unblockErr != nil {
+				responses <- map[string]string{"error": "could not unblock mailbox: " + unblockErr.Error(), "rid": rid}
+			} else {
+				responses <- map[string]string{"unblocked": "true", "rid": rid}
+			}
+			return
+		}
+
+		block, blockErr := blockMailbox(req.Client, req.Request["mailbox_id"], datastore.BlockKind(req.Request["action"]))
+		if blockErr != nil {
+			responses <- map[string]string{"error": "could not block mailbox: " + blockErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": block,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleListBlock lists the mailboxes the client blocked or muted
+func (sc SockController) HandleListBlock(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid, hasRid := req.Request["rid"]
+		blocks, err := req.Client.Blocks()
+		if err != nil {
+			responses <- map[string]string{"error": "unable to get blocks for mailbox", "rid": rid}
+		} else if hasRid {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": blocks,
+			}
+		} else {
+			responses <- blocks
+		}
+	}()
+
+	return
+}
+
+// Function HandleSearch responds with the messages the client may read
+// that match "q", best match first. The search can be narrowed with
+// "thread_id", "sender", "since" and "until", and paged with "limit"
+// and "offset"
+func (sc SockController) HandleSearch(req SockRequest, responses chan interface{}) (err error) {
+	go func() {
+		rid := req.Request["rid"]
+		param := func(name string) string { return req.Request[name] }
+		results, searchErr := searchMessages(req.Client, param)
+		if searchErr != nil {
+			responses <- map[string]string{"error": "could not search messages: " + searchErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]interface{}{
+				"rid":     rid,
+				"payload": results,
+			}
+		}
+	}()
+
+	return
+}
+
+// Function HandleRotateKey replaces the client's mailbox key with
+// "public_key". "signature" must be a signature of the rotation by the
+// current key, and the old key is accepted for "grace_period" more seconds
+func (sc SockController) HandleRotateKey(req SockRequest, responses chan interface{}) (err error) {
+	rotation, err := parseKeyRotation(req.Request["public_key"], req.Request["token"], req.Request["signature"])
+	if err != nil {
+		return errors.New("invalid key rotation signature")
+	}
+
+	graceSeconds, _ := strconv.ParseInt(req.Request["grace_period"], 10, 64)
+	gracePeriod := time.Duration(graceSeconds) * time.Second
+
+	go func() {
+		rid := req.Request["rid"]
+		if rotateErr := rotateMailboxKey(req.Client, rotation, gracePeriod); rotateErr != nil {
+			responses <- map[string]string{"error": "could not rotate key: " + rotateErr.Error(), "rid": rid}
+		} else {
+			responses <- map[string]string{"rotated": "true", "rid": rid}
 		}
 	}()
 
@@ -435,11 +1138,20 @@ func (sc SockController) HandleWrites(conn *websocket.Conn, jsonWrites <-chan in
 	return
 }
 
-func (sc SockController) HandleNotifications(conn *websocket.Conn, responses chan interface{}, r *http.Request, mb *datastore.Mailbox) {
+// Function HandleNotifications sends the client the notifications of new
+// messages for its mailbox. If filter is not nil, which it is when the sock
+// URL has "labels" or "payload" JSON query parameters, only messages that
+// contain them are sent
+func (sc SockController) HandleNotifications(conn *websocket.Conn, responses chan interface{}, filter *datastore.JSONFilter, mb *datastore.Mailbox) {
 	defer func() {
 		recover()
 	}()
 	for evt := range datastore.Stream.EventChannel("message-notification-" + mb.Id) {
+		var message datastore.Message
+		if err := json.Unmarshal(evt.Payload, &message); err == nil && (!mb.InScope(&message) || !filter.Matches(&message)) {
+			continue
+		}
+
 		select {
 		case responses <- []datastore.Event{evt}:
 			// if the event goes through, keep going
@@ -451,7 +1163,7 @@ func (sc SockController) HandleNotifications(conn *websocket.Conn, responses cha
 
 // Function IdentifyClient attempts to identify the user over a web socket connection
 // It must have exclusive access to io on the connection until it returns
-func (sc SockController) IdentifyClient(conn *websocket.Conn) (mb datastore.Mailbox, err error) {
+func (sc SockController) IdentifyClient(conn *websocket.Conn) (mb datastore.Mailbox, session auth.Session, err error) {
 	var authRequest map[string]string
 	if err = conn.ReadJSON(&authRequest); err != nil { // read auth request from connection
 		conn.WriteJSON(map[string]string{"error": "client failed to identify itself"})
@@ -467,33 +1179,42 @@ func (sc SockController) IdentifyClient(conn *websocket.Conn) (mb datastore.Mail
 			return
 		}
 
-		pubKey, er := auth.PublicKeyFromString(mb.PublicKey)
-		if er != nil {
-			return mb, er
+		if session, err = auth.ParseSession(token); err != nil {
+			return
 		}
 
-		session, erx := auth.ParseSession(token)
-		if erx != nil {
-			return mb, erx
+		err = checkSession(&mb, authRequest["device"], session, auth.SingleUseStore)
+	case "challenge":
+		mb, session, err = sc.ChallengeClient(conn, authRequest)
+	case "temp", "new":
+		if allowed, _ := allowAction(rateLimitMailbox, nil, conn.RemoteAddr().String()); !allowed {
+			err = errors.New("rate limit exceeded")
+			conn.WriteJSON(map[string]string{"error": "rate limit exceeded"})
+			return
 		}
 
-		err = session.Valid(pubKey, &serverSessionKey.PublicKey)
-	case "temp", "new":
-		var key *rsa.PrivateKey
-		mb, key, err = datastore.NewMailboxWithKey()
+		var key crypto.Signer
+		mb, key, err = datastore.NewMailboxWithKeyType(authRequest["key_type"])
 		if err != nil {
 			return
 		}
 
-		token, erx := mb.SessionToken(24*time.Hour, key, serverSessionKey)
+		token, erx := mb.SessionToken(24*time.Hour, key, serverKeys.SigningKey())
 		if erx != nil {
 			err = erx
 			return
 		}
 
+		if session, err = auth.ParseSession(token); err != nil {
+			return
+		}
+
 		if err = mb.Insert(); err != nil {
 			return
 		}
+		mb.SessionId = session.Id()
+		mb.TrackSession(session)
+
 		authResponse := map[string]string{"mailbox_id": mb.Id, "session_token": token}
 		if authRequest["auth"] == "new" {
 			authResponse["private_key"] = auth.StringForPrivateKey(key)
@@ -507,6 +1228,77 @@ func (sc SockController) IdentifyClient(conn *websocket.Conn) (mb datastore.Mail
 	return
 }
 
+// Function ChallengeClient authenticates the client on the socket without a
+// separate trip to /auth/. The server sends a challenge, which is the message
+// of a session with a fresh server token, and the client answers with its
+// signature by the mailbox key, or the key of "device" if one is given.
+// "duration" (in seconds) and "scope" of the auth request set up the session
+func (sc SockController) ChallengeClient(conn *websocket.Conn, authRequest map[string]string) (mb datastore.Mailbox, session auth.Session, err error) {
+	if mb, err = datastore.GetMailbox(authRequest["mailbox"]); err != nil {
+		conn.WriteJSON(map[string]string{"error": "mailbox not found"})
+		return
+	}
+
+	session.Duration = auth.MaxSessionDuration
+	if seconds, erx := strconv.ParseInt(authRequest["duration"], 10, 64); erx == nil && seconds > 0 {
+		session.Duration = time.Duration(seconds) * time.Second
+	}
+
+	if scope := authRequest["scope"]; scope != "" {
+		if session.Scope, err = auth.ParseScope(scope); err != nil {
+			conn.WriteJSON(map[string]string{"error": "invalid scope"})
+			return
+		}
+	}
+
+	if session.Token, err = auth.NewToken(serverKeys.SigningKey()); err != nil {
+		conn.WriteJSON(map[string]string{"error": "could not generate challenge"})
+		return
+	}
+
+	conn.WriteJSON(map[string]string{"challenge": session.Message()})
+
+	var answer map[string]string
+	if err = conn.ReadJSON(&answer); err != nil {
+		return
+	}
+
+	if session.Signature, err = base64.URLEncoding.DecodeString(answer["signature"]); err != nil {
+		conn.WriteJSON(map[string]string{"error": "invalid signature encoding"})
+		return
+	}
+
+	if err = checkSession(&mb, authRequest["device"], session, auth.SingleUseStore); err != nil {
+		conn.WriteJSON(map[string]string{"error": "challenge failed"})
+		return
+	}
+
+	conn.WriteJSON(map[string]string{"mailbox_id": mb.Id, "session_token": session.String()})
+	return
+}
+
+// Function disconnectOnRevoke closes conn as soon as the session it was
+// opened with is revoked. It returns when done is closed
+func disconnectOnRevoke(conn *websocket.Conn, mb *datastore.Mailbox, sessionId string, done <-chan struct{}) {
+	revocations := datastore.Stream.EventChannel("session-revoke-" + mb.Id)
+	for {
+		select {
+		case <-done:
+			return
+		case evt := <-revocations:
+			var revoked datastore.MailboxSession
+			if err := json.Unmarshal(evt.Payload, &revoked); err != nil || !revoked.Revokes(sessionId) {
+				continue
+			}
+
+			closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked")
+			conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(pingTime))
+			conn.Close()
+			return
+		}
+	}
+}
+
 // Function HandlePong is called when the client responds to a ping
 func (sc SockController) HandlePong(appData string) error {
 	return nil
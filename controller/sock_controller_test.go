@@ -1,9 +1,14 @@
 package controller
 
 import (
+	"crypto"
+	"encoding/base64"
+	"github.com/gorilla/websocket"
+	"github.com/omarqazi/hearst/auth"
 	"github.com/omarqazi/hearst/datastore"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -36,6 +41,122 @@ func TestSockNormalHTTP(t *testing.T) {
 	}
 }
 
+func TestSockInvalidNotificationFilter(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/sock/?labels=notjson", nil)
+	w := httptest.NewRecorder()
+	sc.ServeHTTP(w, req)
+
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "invalid notification filter") {
+		t.Fatal("Expected 400 response for an invalid notification filter but got", w.Code, w.Body.String())
+	}
+}
+
 func TestAuth(t *testing.T) {
 
 }
+
+func TestSockChallengeAuth(t *testing.T) {
+	mailbox, clientKey := testMailbox(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:6943/sock/", nil)
+	if err != nil {
+		t.Fatal("Error connecting to sock:", err)
+	}
+	defer conn.Close()
+
+	authRequest := map[string]string{"auth": "challenge", "mailbox": mailbox.Id, "duration": "300"}
+	if err := conn.WriteJSON(authRequest); err != nil {
+		t.Fatal("Error sending auth request:", err)
+	}
+
+	var challenge map[string]string
+	if err := conn.ReadJSON(&challenge); err != nil || challenge["challenge"] == "" {
+		t.Fatal("Expected a challenge but got", challenge, err)
+	}
+
+	sig, err := auth.SignMessageWithKey(clientKey, challenge["challenge"])
+	if err != nil {
+		t.Fatal("Error signing challenge:", err)
+	}
+
+	if err := conn.WriteJSON(map[string]string{"signature": base64.URLEncoding.EncodeToString(sig)}); err != nil {
+		t.Fatal("Error sending challenge signature:", err)
+	}
+
+	var authResponse map[string]string
+	if err := conn.ReadJSON(&authResponse); err != nil {
+		t.Fatal("Error reading auth response:", err)
+	}
+
+	if authResponse["mailbox_id"] != mailbox.Id || authResponse["session_token"] == "" {
+		t.Fatal("Expected a session token for the mailbox but got", authResponse)
+	}
+
+	session, err := auth.ParseSession(authResponse["session_token"])
+	if err != nil {
+		t.Fatal("Error parsing session token:", err)
+	}
+
+	if err := session.Valid(clientKey.Public(), serverKeys); err != nil {
+		t.Fatal("Error: session token from challenge is not valid:", err)
+	}
+}
+
+// Function dialSock connects to the sock test server and signs in
+// as mailbox by answering a challenge
+func dialSock(t *testing.T, mailbox datastore.Mailbox, clientKey crypto.Signer) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:6943/sock/", nil)
+	if err != nil {
+		t.Fatal("Error connecting to sock:", err)
+	}
+
+	var challenge map[string]string
+	conn.WriteJSON(map[string]string{"auth": "challenge", "mailbox": mailbox.Id, "duration": "300"})
+	if err := conn.ReadJSON(&challenge); err != nil {
+		t.Fatal("Error reading challenge:", err)
+	}
+
+	sig, err := auth.SignMessageWithKey(clientKey, challenge["challenge"])
+	if err != nil {
+		t.Fatal("Error signing challenge:", err)
+	}
+
+	var authResponse map[string]string
+	conn.WriteJSON(map[string]string{"signature": base64.URLEncoding.EncodeToString(sig)})
+	if err := conn.ReadJSON(&authResponse); err != nil || authResponse["session_token"] == "" {
+		t.Fatal("Error signing in to sock:", authResponse, err)
+	}
+	return conn
+}
+
+func TestSockCanNotChangeOtherMailbox(t *testing.T) {
+	mailbox, clientKey := testMailbox(t)
+	other, _ := testMailbox(t)
+
+	conn := dialSock(t, mailbox, clientKey)
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]string{"action": "update", "model": "mailbox"})
+	conn.WriteJSON(datastore.Mailbox{Record: other.Record, DeviceId: "hijacked"})
+	var response map[string]interface{}
+	if err := conn.ReadJSON(&response); err != nil || response["error"] == nil {
+		t.Fatal("Expected an error updating another mailbox but got", response, err)
+	}
+
+	response = nil
+	conn.WriteJSON(map[string]string{"action": "delete", "model": "mailbox", "id": other.Id})
+	if err := conn.ReadJSON(&response); err != nil || response["error"] == nil {
+		t.Fatal("Expected an error deleting another mailbox but got", response, err)
+	}
+
+	response = nil
+	conn.WriteJSON(map[string]string{"action": "list", "model": "threadmember", "mailbox_id": other.Id})
+	if err := conn.ReadJSON(&response); err != nil || response["error"] == nil {
+		t.Fatal("Expected an error listing threads of another mailbox but got", response, err)
+	}
+
+	dbOther, err := datastore.GetMailbox(other.Id)
+	if err != nil || dbOther.DeviceId == "hijacked" {
+		t.Fatal("Error: other mailbox was changed through the sock", dbOther, err)
+	}
+}
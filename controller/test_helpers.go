@@ -1,7 +1,7 @@
 package controller
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"github.com/omarqazi/hearst/auth"
 	"github.com/omarqazi/hearst/datastore"
 	"io"
@@ -10,14 +10,14 @@ import (
 	"time"
 )
 
-func testRequest(method, url string, body io.Reader, t *testing.T, clientKey *rsa.PrivateKey, mb *datastore.Mailbox) *http.Request {
+func testRequest(method, url string, body io.Reader, t *testing.T, clientKey crypto.Signer, mb *datastore.Mailbox) *http.Request {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		t.Fatal("Error creating HTTP request", err)
 	}
 
 	req.Header.Add("X-Hearst-Mailbox", mb.Id)
-	token, err := auth.NewToken(serverSessionKey)
+	token, err := auth.NewToken(serverKeys.SigningKey())
 	if err != nil {
 		t.Fatal("Error generating token", err)
 	}
@@ -35,3 +35,48 @@ func testRequest(method, url string, body io.Reader, t *testing.T, clientKey *rs
 
 	return req
 }
+
+// Function testMailbox inserts a mailbox with a new Ed25519 key that is deleted
+// when the test ends. It returns the mailbox and the key its requests are signed with
+func testMailbox(t *testing.T) (datastore.Mailbox, crypto.Signer) {
+	mb, clientKey, err := datastore.NewMailboxWithKeyType(auth.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating test mailbox:", err)
+	}
+
+	if err := mb.Insert(); err != nil {
+		t.Fatal("Error inserting test mailbox:", err)
+	}
+	t.Cleanup(func() { mb.Delete() })
+	return mb, clientKey
+}
+
+// Function testThread inserts a thread that is deleted when the test ends
+func testThread(t *testing.T, subject string) datastore.Thread {
+	thread := datastore.Thread{Subject: subject}
+	if err := thread.Insert(); err != nil {
+		t.Fatal("Error inserting test thread:", err)
+	}
+	t.Cleanup(func() { thread.Delete() })
+	return thread
+}
+
+// Function testMessages inserts the messages, with empty labels and payloads
+// unless they have their own, and deletes them when the test ends
+func testMessages(t *testing.T, messages ...*datastore.Message) {
+	for _, m := range messages {
+		if len(m.Labels) == 0 {
+			m.Labels.Scan("{}")
+		}
+		if len(m.Payload) == 0 {
+			m.Payload.Scan("{}")
+		}
+
+		if err := m.Insert(); err != nil {
+			t.Fatal("Error inserting test message:", err)
+		}
+
+		m := m
+		t.Cleanup(func() { m.Delete() })
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/omarqazi/hearst/datastore"
+	"io"
 	"net/http"
+	"time"
 )
 
 type ThreadController struct {
@@ -17,8 +19,16 @@ func (tc ThreadController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if subcat := urlSubcategory(r); subcat == "members" {
+	if rid(r) == "direct" {
+		tc.PostDirectThread(w, r, &mb)
+	} else if subcat := urlSubcategory(r); subcat == "members" {
 		tc.RouteThreadMembersRequest(w, r, &mb)
+	} else if subcat == "invitations" || subcat == "redeem" {
+		tc.RouteInvitationsRequest(w, r, &mb)
+	} else if subcat == "join" || subcat == "requests" {
+		tc.RouteJoinRequest(w, r, &mb)
+	} else if subcat == "groups" {
+		tc.RouteThreadGroupsRequest(w, r, &mb)
 	} else {
 		tc.RouteThreadRequest(w, r, &mb)
 	}
@@ -42,7 +52,9 @@ func (tc ThreadController) RouteThreadRequest(w http.ResponseWriter, r *http.Req
 func (tc ThreadController) RouteThreadMembersRequest(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
 	switch r.Method {
 	case "GET":
-		tc.GetThreadMembers(rid(r), w, r, mb)
+		if allowRequest(w, r, rateLimitList, mb) {
+			tc.GetThreadMembers(rid(r), w, r, mb)
+		}
 	case "POST":
 		tc.PostThreadMember(w, r, mb)
 	case "PUT":
@@ -54,6 +66,42 @@ func (tc ThreadController) RouteThreadMembersRequest(w http.ResponseWriter, r *h
 	}
 }
 
+// Function RouteInvitationsRequest handles invitations to a thread. Creators
+// manage invitations at /thread/<id>/invitations and invitees redeem
+// them with a POST to /thread/<id>/redeem
+func (tc ThreadController) RouteInvitationsRequest(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	switch {
+	case r.Method == "GET" && urlSubcategory(r) == "invitations":
+		tc.GetInvitations(w, r, mb)
+	case r.Method == "POST" && urlSubcategory(r) == "invitations":
+		tc.PostInvitation(w, r, mb)
+	case r.Method == "DELETE" && urlSubcategory(r) == "invitations":
+		tc.DeleteInvitation(w, r, mb)
+	case r.Method == "POST" && urlSubcategory(r) == "redeem":
+		tc.RedeemInvitation(w, r, mb)
+	default:
+		tc.HandleUnknown(w, r)
+	}
+}
+
+// Function RouteJoinRequest handles joining a thread without an invitation.
+// Mailboxes join with a POST to /thread/<id>/join, and owners and admins
+// decide join requests at /thread/<id>/requests
+func (tc ThreadController) RouteJoinRequest(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	switch {
+	case r.Method == "POST" && urlSubcategory(r) == "join":
+		tc.JoinThread(w, r, mb)
+	case r.Method == "GET" && urlSubcategory(r) == "requests":
+		tc.GetJoinRequests(w, r, mb)
+	case r.Method == "POST" && urlSubcategory(r) == "requests":
+		tc.DecideJoinRequest(w, r, mb)
+	case r.Method == "DELETE" && urlSubcategory(r) == "requests":
+		tc.WithdrawJoinRequest(w, r, mb)
+	default:
+		tc.HandleUnknown(w, r)
+	}
+}
+
 func (tc ThreadController) GetThread(tid string, w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
 	thread, err := datastore.GetThread(tid)
 	if err != nil {
@@ -62,8 +110,7 @@ func (tc ThreadController) GetThread(tid string, w http.ResponseWriter, r *http.
 		return
 	}
 
-	member, err := thread.GetMember(mb.Id)
-	if err != nil || !member.AllowRead {
+	if !mb.Can(datastore.ActionRead, &thread) {
 		http.Error(w, "access denied", 403)
 		return
 	}
@@ -78,6 +125,11 @@ func (tc ThreadController) GetThread(tid string, w http.ResponseWriter, r *http.
 }
 
 func (tc ThreadController) PostThread(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	if !mb.Can(datastore.ActionCreate, datastore.Thread{}) {
+		http.Error(w, "access denied: session can not create threads", 403)
+		return
+	}
+
 	var thread datastore.Thread
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&thread); err != nil {
@@ -86,21 +138,25 @@ func (tc ThreadController) PostThread(w http.ResponseWriter, r *http.Request, mb
 		return
 	}
 
+	// ids are always generated, so clients can not take the id of a direct thread
+	thread.Id = ""
+	thread.Direct = false // direct threads are only made by PostDirectThread
 	if err := thread.Insert(); err != nil {
 		w.WriteHeader(500)
 		fmt.Fprintln(w, "error saving thread")
 		return
 	}
 
-	adminMember := &datastore.ThreadMember{
+	ownerMember := &datastore.ThreadMember{
 		ThreadId:          thread.Id,
 		MailboxId:         mb.Id,
 		AllowRead:         true,
 		AllowWrite:        true,
 		AllowNotification: true,
+		Role:              datastore.RoleOwner,
 	}
 
-	if err := thread.AddMember(adminMember); err != nil {
+	if err := thread.AddMember(ownerMember); err != nil {
 		http.Error(w, "error adding thread member", 500)
 		return
 	}
@@ -108,6 +164,24 @@ func (tc ThreadController) PostThread(w http.ResponseWriter, r *http.Request, mb
 	tc.GetThread(thread.Id, w, r, mb)
 }
 
+// Function PostDirectThread responds to a POST to /thread/direct/<mailbox id>
+// with the direct thread between the mailbox and the other one, creating it
+// the first time. The other mailbox may also be given by handle, like @omar
+func (tc ThreadController) PostDirectThread(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if r.Method != "POST" || len(comps) < 2 || comps[1] == "" {
+		tc.HandleUnknown(w, r)
+		return
+	}
+
+	thread, err := directThread(mb, comps[1])
+	if err != nil {
+		http.Error(w, "could not get direct thread: "+err.Error(), 403)
+		return
+	}
+	tc.GetThread(thread.Id, w, r, mb)
+}
+
 func (tc ThreadController) PutThread(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
 	var thread datastore.Thread
 	decoder := json.NewDecoder(r.Body)
@@ -128,8 +202,8 @@ func (tc ThreadController) PutThread(w http.ResponseWriter, r *http.Request, mb
 		return
 	}
 
-	member, err := dbThread.GetMember(mb.Id)
-	if err != nil || !member.AllowWrite {
+	thread.KeepOmitted(dbThread)
+	if err := mb.AuthorizeUpdate(&dbThread, &thread); err != nil {
 		http.Error(w, "access denied: not thread member", 403)
 		return
 	}
@@ -150,9 +224,9 @@ func (tc ThreadController) PutThread(w http.ResponseWriter, r *http.Request, mb
 func (tc ThreadController) DeleteThread(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
 	thread := datastore.Thread{Record: datastore.Rec(rid(r))}
 
-	member, err := thread.GetMember(mb.Id)
-	if err != nil || !member.AllowWrite {
+	if !mb.Can(datastore.ActionDelete, &thread) {
 		http.Error(w, "access denied: not thread member", 403)
+		return
 	}
 
 	if err := thread.Delete(); err != nil {
@@ -174,9 +248,17 @@ func (tc ThreadController) GetThreadMembers(tid string, w http.ResponseWriter, r
 	comps := pathComponents(r)
 	var outputValue interface{}
 	if len(comps) > 2 { // Requesting specific member
-		mailboxId := comps[2]
-		outputValue, err = thread.GetMember(mailboxId)
+		member := datastore.ThreadMember{ThreadId: thread.Id, MailboxId: comps[2]}
+		if !mb.Can(datastore.ActionRead, &member) {
+			http.Error(w, "access denied", 403)
+			return
+		}
+		outputValue, err = thread.GetMember(member.MailboxId)
 	} else {
+		if !mb.Can(datastore.ActionList, &thread) {
+			http.Error(w, "access denied", 403)
+			return
+		}
 		outputValue, err = thread.GetAllMembers()
 	}
 	if err != nil {
@@ -199,12 +281,6 @@ func (tc ThreadController) PostThreadMember(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	tmember, err := thread.GetMember(mb.Id)
-	if err != nil || !tmember.AllowWrite {
-		http.Error(w, "access denied", 403)
-		return
-	}
-
 	var member datastore.ThreadMember
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&member); err != nil {
@@ -218,6 +294,11 @@ func (tc ThreadController) PostThreadMember(w http.ResponseWriter, r *http.Reque
 	}
 
 	member.ThreadId = thread.Id
+	if !mb.Can(datastore.ActionCreate, &member) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
 	if err := thread.AddMember(&member); err != nil {
 		http.Error(w, "error adding member to thread", 500)
 		fmt.Println(err)
@@ -241,12 +322,6 @@ func (tc ThreadController) PutThreadMember(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	tmember, err := thread.GetMember(mb.Id)
-	if err != nil || !tmember.AllowWrite {
-		http.Error(w, "access denied", 403)
-		return
-	}
-
 	var member datastore.ThreadMember
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&member); err != nil {
@@ -260,11 +335,25 @@ func (tc ThreadController) PutThreadMember(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	dbMember.AllowRead = member.AllowRead
-	dbMember.AllowWrite = member.AllowWrite
-	dbMember.AllowNotification = member.AllowNotification
+	updated := dbMember
+	updated.AllowRead = member.AllowRead
+	updated.AllowWrite = member.AllowWrite
+	updated.AllowNotification = member.AllowNotification
+	updated.ReadTopics = member.ReadTopics
+	updated.WriteTopics = member.WriteTopics
+	if member.Role != "" {
+		updated.Role = member.Role
+	}
+
+	if err := mb.AuthorizeUpdate(dbMember, updated); err != nil {
+		http.Error(w, "access denied", 403)
+		return
+	}
 
-	if err := dbMember.UpdatePermissions(); err != nil {
+	if err := updated.UpdatePermissions(); err == datastore.ErrLastOwner {
+		http.Error(w, err.Error(), 409)
+		return
+	} else if err != nil {
 		http.Error(w, "error updating member permissions", 500)
 		return
 	}
@@ -286,18 +375,21 @@ func (tc ThreadController) DeleteThreadMember(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	tmember, err := thread.GetMember(mb.Id)
-	if err != nil || !tmember.AllowWrite {
-		http.Error(w, "access denied", 403)
-	}
-
 	member, err := thread.GetMember(mailboxId)
 	if err != nil {
 		http.Error(w, "thread member not found", 404)
 		return
 	}
 
-	if err := member.Remove(); err != nil {
+	if !mb.Can(datastore.ActionDelete, member) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	if err := member.Remove(); err == datastore.ErrLastOwner {
+		http.Error(w, err.Error(), 409)
+		return
+	} else if err != nil {
 		http.Error(w, "Error removing thread member", 500)
 		return
 	}
@@ -305,6 +397,293 @@ func (tc ThreadController) DeleteThreadMember(w http.ResponseWriter, r *http.Req
 	fmt.Fprintln(w, "thread member removed")
 }
 
+// Function RouteThreadGroupsRequest handles the groups whose members have
+// access to a thread, at /thread/<id>/groups/<group id>
+func (tc ThreadController) RouteThreadGroupsRequest(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	switch r.Method {
+	case "GET":
+		tc.GetThreadGroups(w, r, mb)
+	case "POST":
+		tc.PostThreadGroup(w, r, mb)
+	case "PUT":
+		tc.PutThreadGroup(w, r, mb)
+	case "DELETE":
+		tc.DeleteThreadGroup(w, r, mb)
+	default:
+		tc.HandleUnknown(w, r)
+	}
+}
+
+func (tc ThreadController) GetThreadGroups(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	thread := datastore.Thread{Record: datastore.Rec(rid(r))}
+	if !mb.Can(datastore.ActionList, &thread) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	groups, err := thread.GetGroups()
+	if err != nil {
+		http.Error(w, "error getting thread groups", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (tc ThreadController) PostThreadGroup(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	var group datastore.ThreadGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	group.ThreadId = rid(r)
+	if !mb.Can(datastore.ActionCreate, &group) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	if err := group.Insert(); err != nil {
+		http.Error(w, "error adding group to thread", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(group); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (tc ThreadController) PutThreadGroup(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "group id required", 400)
+		return
+	}
+
+	var group datastore.ThreadGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	stored := datastore.ThreadGroup{ThreadId: rid(r), GroupId: comps[2]}
+	if err := stored.Load(); err != nil {
+		http.Error(w, "thread group not found", 404)
+		return
+	}
+
+	group.ThreadId, group.GroupId = stored.ThreadId, stored.GroupId
+	if err := mb.AuthorizeUpdate(&stored, &group); err != nil {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	if err := group.Update(); err != nil {
+		http.Error(w, "error updating thread group", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(group); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (tc ThreadController) DeleteThreadGroup(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "group id required", 400)
+		return
+	}
+
+	group := datastore.ThreadGroup{ThreadId: rid(r), GroupId: comps[2]}
+	if err := group.Load(); err != nil {
+		http.Error(w, "thread group not found", 404)
+		return
+	}
+
+	if !mb.Can(datastore.ActionDelete, &group) {
+		http.Error(w, "access denied", 403)
+		return
+	}
+
+	if err := group.Delete(); err != nil {
+		http.Error(w, "error removing group from thread", 500)
+		return
+	}
+	fmt.Fprintln(w, "group removed from thread")
+}
+
+// invitationRequest is the body of a POST to /thread/<id>/invitations
+type invitationRequest struct {
+	AllowRead         bool  `json:"allow_read"`
+	AllowWrite        bool  `json:"allow_write"`
+	AllowNotification bool  `json:"allow_notification"`
+	ExpiresIn         int64 `json:"expires_in"` // seconds until the invitation expires
+	MaxUses           int   `json:"max_uses"`
+}
+
+// Function GetInvitations lists the invitations to the
+// thread created by the mailbox making the request
+func (tc ThreadController) GetInvitations(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	invitations, err := mb.Invitations(rid(r))
+	if err != nil {
+		http.Error(w, "error getting invitations", 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(invitations); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (tc ThreadController) PostInvitation(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	var request invitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	invitation, err := createInvitation(mb, datastore.Invitation{
+		ThreadId:          rid(r),
+		AllowRead:         request.AllowRead,
+		AllowWrite:        request.AllowWrite,
+		AllowNotification: request.AllowNotification,
+		MaxUses:           request.MaxUses,
+	}, time.Duration(request.ExpiresIn)*time.Second)
+	if err != nil {
+		http.Error(w, "could not create invitation: "+err.Error(), 403)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(invitation); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (tc ThreadController) DeleteInvitation(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "invitation id required", 400)
+		return
+	}
+
+	if err := mb.RevokeInvitation(comps[2]); err != nil {
+		http.Error(w, "invitation not found", 404)
+		return
+	}
+	fmt.Fprintln(w, "invitation revoked")
+}
+
+// Function RedeemInvitation adds the mailbox to the thread using
+// the invitation token in the request body, like {"token": "..."}
+func (tc ThreadController) RedeemInvitation(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	var request map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	member, err := redeemInvitation(mb, rid(r), request["token"])
+	if err != nil {
+		http.Error(w, "could not redeem invitation: "+err.Error(), 403)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(member); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// Function JoinThread adds the mailbox to an open thread and responds with
+// the membership, or files a join request if the thread takes requests and
+// responds with 202 and the request. The body may have a note for the
+// thread's admins, like {"note": "..."}
+func (tc ThreadController) JoinThread(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	var request map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	joined, err := joinThread(mb, rid(r), request["note"])
+	if err != nil {
+		http.Error(w, "could not join thread: "+err.Error(), 403)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if _, isRequest := joined.(datastore.JoinRequest); isRequest {
+		w.WriteHeader(202)
+	}
+	if err := json.NewEncoder(w).Encode(joined); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (tc ThreadController) GetJoinRequests(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	requests, err := listJoinRequests(mb, rid(r))
+	if err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(requests); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+// Function DecideJoinRequest approves or denies the request at
+// /thread/<id>/requests/<request id>, given a body like {"approve": true}
+func (tc ThreadController) DecideJoinRequest(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "join request id required", 400)
+		return
+	}
+
+	var decision struct {
+		Approve bool `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		http.Error(w, "invalid request JSON", 400)
+		return
+	}
+
+	decided, err := decideJoinRequest(mb, rid(r), comps[2], decision.Approve)
+	if err != nil {
+		http.Error(w, "could not decide join request: "+err.Error(), 403)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(decided); err != nil {
+		http.Error(w, "error marshaling response json", 500)
+	}
+}
+
+func (tc ThreadController) WithdrawJoinRequest(w http.ResponseWriter, r *http.Request, mb *datastore.Mailbox) {
+	comps := pathComponents(r)
+	if len(comps) < 3 || comps[2] == "" {
+		http.Error(w, "join request id required", 400)
+		return
+	}
+
+	if err := withdrawJoinRequest(mb, rid(r), comps[2]); err != nil {
+		http.Error(w, "could not withdraw join request: "+err.Error(), 403)
+		return
+	}
+	fmt.Fprintln(w, "join request withdrawn")
+}
+
 func (tc ThreadController) HandleUnknown(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(400)
 	fmt.Fprintln(w, "what the fuck are you talking about?")
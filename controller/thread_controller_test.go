@@ -2,6 +2,7 @@ package controller
 
 import (
 	"bytes"
+	"crypto"
 	"encoding/json"
 	"fmt"
 	"github.com/omarqazi/hearst/datastore"
@@ -252,6 +253,7 @@ func TestThreadDeleteRequest(t *testing.T) {
 		AllowRead:         true,
 		AllowWrite:        true,
 		AllowNotification: false,
+		Role:              datastore.RoleOwner,
 	}
 	if err := thread.AddMember(member); err != nil {
 		t.Fatal("Error adding thread member:", err)
@@ -389,6 +391,7 @@ func TestThreadMembersPostRequest(t *testing.T) {
 		AllowRead:         true,
 		AllowWrite:        true,
 		AllowNotification: false,
+		Role:              datastore.RoleOwner,
 	}
 
 	if err := thread.AddMember(member); err != nil {
@@ -487,6 +490,7 @@ func TestThreadMembersPutRequest(t *testing.T) {
 		AllowRead:         true,
 		AllowWrite:        true,
 		AllowNotification: false,
+		Role:              datastore.RoleOwner,
 	}
 
 	if err := thread.AddMember(&member); err != nil {
@@ -584,3 +588,234 @@ func TestThreadMembersDeleteRequest(t *testing.T) {
 	thread.Delete()
 	mailbox.Delete()
 }
+
+func TestThreadInvitationRequests(t *testing.T) {
+	owner, ownerKey := testMailbox(t)
+	invitee, inviteeKey := testMailbox(t)
+	thread := testThread(t, "invitations")
+
+	ownerMember := &datastore.ThreadMember{MailboxId: owner.Id, AllowRead: true, AllowWrite: true, AllowNotification: true, Role: datastore.RoleOwner}
+	if err := thread.AddMember(ownerMember); err != nil {
+		t.Fatal("Error adding thread member:", err)
+	}
+
+	body, _ := json.Marshal(invitationRequest{AllowRead: true, ExpiresIn: 3600, MaxUses: 1})
+	invitationsUrl := fmt.Sprintf("http://localhost:8080/thread/%s/invitations", thread.Id)
+	req := testRequest("POST", invitationsUrl, bytes.NewBuffer(body), t, ownerKey, &owner)
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when creating invitation but got", w.Code, w.Body.String())
+	}
+
+	var invitation datastore.Invitation
+	if err := json.NewDecoder(w.Body).Decode(&invitation); err != nil || invitation.Token == "" {
+		t.Fatal("Expected an invitation with a token but got", invitation, err)
+	}
+
+	// the invitee can not create invitations to a thread it is not in
+	req = testRequest("POST", invitationsUrl, bytes.NewBuffer(body), t, inviteeKey, &invitee)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Fatal("Expected 403 response when a non member creates an invitation but got", w.Code)
+	}
+
+	redeemUrl := fmt.Sprintf("http://localhost:8080/thread/%s/redeem", thread.Id)
+	redeemBody, _ := json.Marshal(map[string]string{"token": invitation.Token})
+	req = testRequest("POST", redeemUrl, bytes.NewBuffer(redeemBody), t, inviteeKey, &invitee)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when redeeming invitation but got", w.Code, w.Body.String())
+	}
+
+	member, err := thread.GetMember(invitee.Id)
+	if err != nil || !member.AllowRead || member.AllowWrite {
+		t.Fatal("Expected invitee to be a read only member but got", member, err)
+	}
+
+	req = testRequest("GET", invitationsUrl, nil, t, ownerKey, &owner)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	var invitations []datastore.Invitation
+	if err := json.NewDecoder(w.Body).Decode(&invitations); err != nil || len(invitations) != 1 || invitations[0].Uses != 1 {
+		t.Fatal("Expected one used invitation but got", invitations, err)
+	}
+
+	req = testRequest("DELETE", invitationsUrl+"/"+invitation.Id, nil, t, ownerKey, &owner)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when revoking invitation but got", w.Code)
+	}
+}
+
+func TestThreadMembersGetRequestNotMember(t *testing.T) {
+	thread := datastore.Thread{Subject: "members are private"}
+	if err := thread.Insert(); err != nil {
+		t.Fatal("Error saving thread:", err)
+	}
+	defer thread.Delete()
+
+	outsider, clientKey, err := datastore.NewMailboxWithKey()
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+
+	if err := outsider.Insert(); err != nil {
+		t.Fatal("Error saving mailbox:", err)
+	}
+	defer outsider.Delete()
+
+	requestUrl := fmt.Sprintf("http://localhost:8080/thread/%s/members", thread.Id)
+	req := testRequest("GET", requestUrl, nil, t, clientKey, &outsider)
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+
+	if w.Code != 403 {
+		t.Fatal("Expected 403 listing members of a thread as an outsider but got", w.Code)
+	}
+}
+
+func TestThreadDeleteRequestNotAdmin(t *testing.T) {
+	mailbox, clientKey, err := datastore.NewMailboxWithKey()
+	if err != nil {
+		t.Fatal("Error generating private key:", err)
+	}
+
+	if err := mailbox.Insert(); err != nil {
+		t.Fatal("Error inserting mailbox:", err)
+	}
+	defer mailbox.Delete()
+
+	thread := datastore.Thread{Subject: "only admins can delete me"}
+	if err := thread.Insert(); err != nil {
+		t.Fatal("Error saving thread:", err)
+	}
+	defer thread.Delete()
+
+	member := &datastore.ThreadMember{MailboxId: mailbox.Id, Role: datastore.RoleMember}
+	if err := thread.AddMember(member); err != nil {
+		t.Fatal("Error adding thread member:", err)
+	}
+
+	requestUrl := fmt.Sprintf("http://localhost:8080/thread/%s", thread.Id)
+	req := testRequest("DELETE", requestUrl, nil, t, clientKey, &mailbox)
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+
+	if w.Code != 403 {
+		t.Fatal("Expected 403 deleting a thread as a member but got", w.Code)
+	}
+
+	if _, err := datastore.GetThread(thread.Id); err != nil {
+		t.Fatal("Error: thread was deleted by a member", err)
+	}
+}
+
+func TestThreadJoinRequests(t *testing.T) {
+	owner, ownerKey := testMailbox(t)
+	joiner, joinerKey := testMailbox(t)
+	thread := testThread(t, "join requests")
+
+	if err := thread.AddMember(&datastore.ThreadMember{MailboxId: owner.Id, Role: datastore.RoleOwner}); err != nil {
+		t.Fatal("Error adding thread member:", err)
+	}
+
+	joinUrl := fmt.Sprintf("http://localhost:8080/thread/%s/join", thread.Id)
+	req := testRequest("POST", joinUrl, nil, t, joinerKey, &joiner)
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Fatal("Expected 403 response when joining an invite-only thread but got", w.Code)
+	}
+
+	policyBody, _ := json.Marshal(datastore.Thread{JoinPolicy: datastore.JoinOnRequest})
+	req = testRequest("PUT", fmt.Sprintf("http://localhost:8080/thread/%s", thread.Id), bytes.NewBuffer(policyBody), t, ownerKey, &owner)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when changing join policy but got", w.Code, w.Body.String())
+	}
+
+	noteBody, _ := json.Marshal(map[string]string{"note": "let me in"})
+	req = testRequest("POST", joinUrl, bytes.NewBuffer(noteBody), t, joinerKey, &joiner)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 202 {
+		t.Fatal("Expected 202 response when asking to join but got", w.Code, w.Body.String())
+	}
+
+	requestsUrl := fmt.Sprintf("http://localhost:8080/thread/%s/requests", thread.Id)
+	req = testRequest("GET", requestsUrl, nil, t, joinerKey, &joiner)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Fatal("Expected 403 response when a non admin lists join requests but got", w.Code)
+	}
+
+	req = testRequest("GET", requestsUrl, nil, t, ownerKey, &owner)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	var requests []datastore.JoinRequest
+	if err := json.NewDecoder(w.Body).Decode(&requests); err != nil || len(requests) != 1 || requests[0].MailboxId != joiner.Id {
+		t.Fatal("Expected one join request but got", requests, err)
+	}
+
+	approveBody, _ := json.Marshal(map[string]bool{"approve": true})
+	req = testRequest("POST", requestsUrl+"/"+requests[0].Id, bytes.NewBuffer(approveBody), t, joinerKey, &joiner)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Fatal("Expected 403 response when approving your own join request but got", w.Code)
+	}
+
+	req = testRequest("POST", requestsUrl+"/"+requests[0].Id, bytes.NewBuffer(approveBody), t, ownerKey, &owner)
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("Expected 200 response when approving join request but got", w.Code, w.Body.String())
+	}
+
+	if member, err := thread.GetMember(joiner.Id); err != nil || member.Role != datastore.RoleMember {
+		t.Fatal("Expected approved mailbox to be a member but got", member, err)
+	}
+}
+
+func TestThreadDirectRequest(t *testing.T) {
+	alice, aliceKey := testMailbox(t)
+	bob, bobKey := testMailbox(t)
+
+	squatter := datastore.Thread{Record: datastore.Rec(datastore.DirectThreadId(alice.Id, bob.Id)), Subject: "squatter"}
+	body, _ := json.Marshal(squatter)
+	req := testRequest("POST", "http://localhost:8080/thread/", bytes.NewBuffer(body), t, aliceKey, &alice)
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, req)
+	if err := json.NewDecoder(w.Body).Decode(&squatter); err != nil || squatter.Id == datastore.DirectThreadId(alice.Id, bob.Id) {
+		t.Fatal("Expected a new thread id instead of the one in the request but got", squatter.Id, err)
+	}
+	defer squatter.Delete()
+
+	threads := []datastore.Thread{}
+	for _, caller := range []struct {
+		mb    *datastore.Mailbox
+		key   crypto.Signer
+		other string
+	}{{&alice, aliceKey, bob.Id}, {&bob, bobKey, alice.Id}} {
+		req := testRequest("POST", "http://localhost:8080/thread/direct/"+caller.other, nil, t, caller.key, caller.mb)
+		w := httptest.NewRecorder()
+		tc.ServeHTTP(w, req)
+
+		var thread datastore.Thread
+		if err := json.NewDecoder(w.Body).Decode(&thread); err != nil || !thread.Direct {
+			t.Fatal("Expected a direct thread but got", w.Code, thread, err)
+		}
+		threads = append(threads, thread)
+	}
+	defer threads[0].Delete()
+
+	if threads[0].Id != threads[1].Id {
+		t.Fatal("Expected both mailboxes to get the same direct thread but got", threads[0].Id, threads[1].Id)
+	}
+}
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"encoding/json"
 	"github.com/gorilla/websocket"
 	"github.com/omarqazi/hearst/datastore"
 	"net/http"
@@ -18,7 +19,7 @@ type WebSocketController struct {
 }
 
 func (wsc WebSocketController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	mb, err := authorizedMailbox(r)
+	mb, session, err := authorizedSession(r)
 	if err != nil {
 		http.Error(w, "session token invalid", 403)
 		return
@@ -31,9 +32,19 @@ func (wsc WebSocketController) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 	defer conn.Close()
 
+	done := make(chan struct{})
+	defer close(done)
+	go disconnectOnRevoke(conn, &mb, session.Id(), done)
+
+	sock, err := mb.OpenSocket(session.Id(), "socket", r.RemoteAddr)
+	if err == nil {
+		defer sock.Close()
+	}
+
 	broadcastChannel := make(chan interface{}, 10)
 	go wsc.ProcessCommands(conn, broadcastChannel, &mb)
 	conn.SetPongHandler(func(appData string) error {
+		sock.StillConnected()
 		return nil
 	})
 
@@ -56,6 +67,7 @@ func (wsc WebSocketController) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 func (wsc WebSocketController) ProcessCommands(conn *websocket.Conn, broadcast chan interface{}, mb *datastore.Mailbox) {
 	defer conn.Close()
+	limiter := socketLimiter{conn: conn, mb: mb}
 
 	for {
 		var request map[string]string
@@ -63,6 +75,16 @@ func (wsc WebSocketController) ProcessCommands(conn *websocket.Conn, broadcast c
 			return
 		}
 
+		if action := requestRateLimit(request); action != "" {
+			if allowed, errorResponse := limiter.Allow(action, request["rid"]); !allowed {
+				if request["action"] == "insert" {
+					conn.ReadJSON(&map[string]interface{}{}) // skip the object that follows the request
+				}
+				wo(broadcast, errorResponse)
+				continue
+			}
+		}
+
 		if request["model"] == "mailbox" { // If mailbox
 			wsc.HandleMailbox(request, conn, broadcast, mb)
 		} else if request["model"] == "thread" {
@@ -86,18 +108,22 @@ func (wsc WebSocketController) HandleMailbox(request map[string]string, conn *we
 		if err := conn.ReadJSON(&mailbox); err != nil {
 			return
 		}
+		if !mb.Can(datastore.ActionCreate, mailbox) {
+			wsc.ErrorResponse("access denied", conn, broadcast)
+			return
+		}
 		go wsc.InsertMailbox(request, conn, broadcast, mailbox)
 	} else if action == "update" { // Insert
 		if err := conn.ReadJSON(&mailbox); err != nil {
 			return
 		}
-		if mailbox.Id != mb.Id {
+		if !mb.Can(datastore.ActionUpdate, mailbox) {
 			wsc.ErrorResponse("cannot update other users mailbox", conn, broadcast)
 			return
 		}
 		go wsc.UpdateMailbox(request, conn, broadcast, mailbox)
 	} else if action == "delete" {
-		if uuid, ok := request["delete_mailbox"]; !ok || uuid != mb.Id {
+		if uuid, ok := request["delete_mailbox"]; !ok || !mb.Can(datastore.ActionDelete, datastore.Mailbox{Record: datastore.Rec(uuid)}) {
 			wsc.ErrorResponse("cannot delete other users mailbox", conn, broadcast)
 			return
 		}
@@ -117,8 +143,7 @@ func (wsc WebSocketController) HandleThread(request map[string]string, conn *web
 			return
 		}
 
-		member, err := thread.GetMember(mb.Id)
-		if err != nil || !member.AllowRead {
+		if !mb.Can(datastore.ActionRead, &thread) {
 			wsc.ErrorResponse("access denied", conn, broadcast)
 			return
 		}
@@ -128,26 +153,29 @@ func (wsc WebSocketController) HandleThread(request map[string]string, conn *web
 		if err := conn.ReadJSON(&thread); err != nil {
 			return
 		}
+
+		if !mb.Can(datastore.ActionCreate, thread) {
+			wsc.ErrorResponse("access denied", conn, broadcast)
+			return
+		}
 		go wsc.InsertThread(request, conn, broadcast, thread, mb)
 	} else if action == "update" {
 		if err := conn.ReadJSON(&thread); err != nil {
 			return
 		}
 
-		member, err := thread.GetMember(mb.Id)
-		if err != nil || !member.AllowWrite {
+		stored, err := datastore.GetThread(thread.Id)
+		thread.KeepOmitted(stored)
+		if err != nil || mb.AuthorizeUpdate(&stored, &thread) != nil {
 			wsc.ErrorResponse("access denied", conn, broadcast)
 			return
 		}
 
 		go wsc.UpdateThread(request, conn, broadcast, thread)
 	} else if action == "delete" {
-		if uuid, ok := request["delete_thread"]; ok {
-			thread := datastore.Thread{Record: datastore.Rec(uuid)}
-			member, err := thread.GetMember(mb.Id)
-			if err != nil || !member.AllowWrite {
-				wsc.ErrorResponse("cannot delete thread", conn, broadcast)
-			}
+		uuid, ok := request["delete_thread"]
+		if ok && !mb.Can(datastore.ActionDelete, datastore.Thread{Record: datastore.Rec(uuid)}) {
+			wsc.ErrorResponse("cannot delete thread", conn, broadcast)
 			return
 		}
 		wsc.DeleteThread(request, conn, broadcast)
@@ -167,14 +195,13 @@ func (wsc WebSocketController) HandleMessage(request map[string]string, conn *we
 			return
 		}
 
-		thread, err := datastore.GetThread(message.ThreadId)
-		if err != nil {
+		if _, err := datastore.GetThread(message.ThreadId); err != nil {
 			wsc.ErrorResponse("thread not found", conn, broadcast)
 			return
 		}
 
-		member, err := thread.GetMember(mb.Id)
-		if err != nil || !member.AllowWrite {
+		message.SenderMailboxId = mb.Id
+		if !mb.Can(datastore.ActionCreate, &message) {
 			wsc.ErrorResponse("access denied", conn, broadcast)
 			return
 		}
@@ -195,16 +222,21 @@ func (wsc WebSocketController) HandleThreadMember(request map[string]string, con
 		return
 	}
 
-	tmember, err := thread.GetMember(mb.Id)
-	if err != nil {
+	if _, err := thread.GetMember(mb.Id); err != nil {
 		wsc.ErrorResponse("not member of thread", conn, broadcast)
 		return
 	}
 
 	if threadOk && mailboxOk && ok {
+		// Permissions are checked against the stored member if there is one
+		target, err := thread.GetMember(request["mailbox_id"])
+		if err != nil {
+			target = datastore.ThreadMember{ThreadId: thread.Id, MailboxId: request["mailbox_id"]}
+		}
+
 		switch action {
 		case "get":
-			if !tmember.AllowRead {
+			if !mb.Can(datastore.ActionRead, target) {
 				wsc.ErrorResponse("access denied", conn, broadcast)
 				return
 			}
@@ -213,7 +245,8 @@ func (wsc WebSocketController) HandleThreadMember(request map[string]string, con
 			if err := conn.ReadJSON(&member); err != nil {
 				return
 			}
-			if !tmember.AllowWrite {
+			member.ThreadId, member.MailboxId = target.ThreadId, target.MailboxId
+			if !mb.Can(datastore.ActionCreate, member) {
 				wsc.ErrorResponse("access denied", conn, broadcast)
 				return
 			}
@@ -223,14 +256,18 @@ func (wsc WebSocketController) HandleThreadMember(request map[string]string, con
 			if err := conn.ReadJSON(&member); err != nil {
 				return
 			}
-			if !tmember.AllowWrite {
+			member.ThreadId, member.MailboxId = target.ThreadId, target.MailboxId
+			if member.Role == "" {
+				member.Role = target.Role
+			}
+			if mb.AuthorizeUpdate(target, member) != nil {
 				wsc.ErrorResponse("access denied", conn, broadcast)
 				return
 			}
 
 			go wsc.UpdateThreadMember(request, conn, broadcast, member)
 		case "delete":
-			if !tmember.AllowWrite {
+			if !mb.Can(datastore.ActionDelete, target) {
 				wsc.ErrorResponse("access denied", conn, broadcast)
 				return
 			}
@@ -257,8 +294,7 @@ func (wsc WebSocketController) ListThread(request map[string]string, conn *webso
 		return
 	}
 
-	member, err := thread.GetMember(mb.Id)
-	if err != nil || !member.AllowRead {
+	if !mb.Can(datastore.ActionList, &thread) {
 		wsc.ErrorResponse("access denied", conn, broadcast)
 		return
 	}
@@ -270,24 +306,57 @@ func (wsc WebSocketController) ListThread(request map[string]string, conn *webso
 	}
 
 	historyTopicFilter := request["history_topic"]
+	filter, err := datastore.ParseJSONFilter(request["labels"], request["payload"])
+	if err != nil {
+		wsc.ErrorResponse(err.Error(), conn, broadcast)
+		return
+	}
 
-	messages, err := thread.RecentMessagesWithTopic(historyTopicFilter, limit)
+	reader := mb.Member(thread.Id)
+	messages, err := thread.RecentMessagesWithTopic(historyTopicFilter, limit, reader, filter)
 	if err != nil {
 		wsc.ErrorResponse(err.Error(), conn, broadcast)
 		return
 	}
 
+	messages = mb.ScopeMessages(messages)
+
 	followString, ok := request["follow"]
-	shouldFollow := ok && followString == "true"
-	var changeEvents chan datastore.Event
+	shouldFollow := ok && followString == "true" && mb.CanFollow(thread.Id)
+	var changeEvents, updateEvents chan datastore.Event
 	if shouldFollow {
 		changeEvents = datastore.Stream.EventChannel("message-insert-" + thread.Id)
+		updateEvents = datastore.Stream.EventChannel("message-update-" + thread.Id)
 	}
 
 	wo(broadcast, messages)
 
-	if shouldFollow && member.AllowNotification {
-		for evt := range changeEvents {
+	for shouldFollow {
+		select {
+		case evt := <-changeEvents:
+			var message datastore.Message
+			if err := json.Unmarshal(evt.Payload, &message); err != nil || !mb.InScope(&message) || !reader.Reads(&message) || !filter.Matches(&message) || mb.HasBlocked(message.SenderMailboxId) {
+				continue
+			}
+
+			if ok := wo(broadcast, []datastore.Event{evt}); !ok {
+				return
+			}
+		case evt := <-updateEvents:
+			var update datastore.MessageUpdate
+			if err := json.Unmarshal(evt.Payload, &update); err != nil || !filter.Matches(&update.Message) || mb.HasBlocked(update.SenderMailboxId) {
+				continue
+			}
+
+			// only send the versions of the message this mailbox may read
+			update, ok := mb.ReadableUpdate(update, reader)
+			if !ok {
+				continue
+			}
+			if evt.Payload, err = json.Marshal(update); err != nil {
+				continue
+			}
+
 			if ok := wo(broadcast, []datastore.Event{evt}); !ok {
 				return
 			}
@@ -324,14 +393,12 @@ func (wsc WebSocketController) GetMessage(request map[string]string, conn *webso
 		return
 	}
 
-	thread, err := datastore.GetThread(message.ThreadId)
-	if err != nil {
+	if _, err := datastore.GetThread(message.ThreadId); err != nil {
 		wsc.ErrorResponse("thread not found", conn, broadcast)
 		return
 	}
 
-	member, err := thread.GetMember(mb.Id)
-	if err != nil || !member.AllowRead {
+	if !mb.Can(datastore.ActionRead, &message) {
 		wsc.ErrorResponse("access denied", conn, broadcast)
 		return
 	}
@@ -372,6 +439,9 @@ func (wsc WebSocketController) InsertMailbox(request map[string]string, conn *we
 }
 
 func (wsc WebSocketController) InsertThread(request map[string]string, conn *websocket.Conn, broadcast chan interface{}, thread datastore.Thread, mb *datastore.Mailbox) {
+	// ids are always generated, so clients can not take the id of a direct thread
+	thread.Id = ""
+	thread.Direct = false
 	if err := thread.Insert(); err != nil {
 		wsc.ErrorResponse(err.Error(), conn, broadcast)
 		return
@@ -383,6 +453,7 @@ func (wsc WebSocketController) InsertThread(request map[string]string, conn *web
 		AllowRead:         true,
 		AllowWrite:        true,
 		AllowNotification: true,
+		Role:              datastore.RoleOwner,
 	}
 	if err := thread.AddMember(member); err != nil {
 		wsc.ErrorResponse(err.Error(), conn, broadcast)
@@ -443,10 +514,6 @@ func (wsc WebSocketController) UpdateMailbox(request map[string]string, conn *we
 		return
 	}
 
-	if mailbox.PublicKey == "" {
-		mailbox.PublicKey = mb.PublicKey
-	}
-
 	if mailbox.DeviceId == "" {
 		mailbox.DeviceId = mb.DeviceId
 	}
@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"errors"
+	"time"
+)
+
+// BlockKind is how much a mailbox hears from a mailbox it blocked
+type BlockKind string
+
+const (
+	KindBlock BlockKind = "block" // hide its messages and keep it from adding you to threads
+	KindMute  BlockKind = "mute"  // keep its messages but do not notify you of them
+)
+
+// Block is a mailbox that another mailbox blocked or muted
+type Block struct {
+	MailboxId string `db:"mailbox_id"`
+	BlockedId string `db:"blocked_id"`
+	Kind      BlockKind
+	CreatedAt time.Time
+}
+
+// Function Block blocks or mutes another mailbox, replacing
+// any block or mute the mailbox already had for it
+func (mb *Mailbox) Block(otherId string, kind BlockKind) error {
+	if kind != KindBlock && kind != KindMute {
+		return errors.New("invalid block kind: " + string(kind))
+	} else if otherId == "" || otherId == mb.Id {
+		return errors.New("Mailbox can not block itself")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.Exec("delete from mailbox_blocks where mailbox_id = $1 and blocked_id = $2", mb.Id, otherId)
+	tx.Exec(`
+		insert into mailbox_blocks (mailbox_id, blocked_id, kind, createdat)
+		VALUES ($1, $2, $3, now());
+	`, mb.Id, otherId, kind)
+	return tx.Commit()
+}
+
+// Function Unblock removes a block or mute of another mailbox
+func (mb *Mailbox) Unblock(otherId string) error {
+	tx := PostgresDb.MustBegin()
+	tx.Exec("delete from mailbox_blocks where mailbox_id = $1 and blocked_id = $2", mb.Id, otherId)
+	return tx.Commit()
+}
+
+// Function Blocks lists the mailboxes the mailbox blocked or muted
+func (mb *Mailbox) Blocks() (blocks []Block, err error) {
+	blocks = []Block{}
+	err = PostgresDb.Select(&blocks, "select * from mailbox_blocks where mailbox_id = $1 order by createdat desc", mb.Id)
+	return
+}
+
+// Function HasBlocked returns true if the mailbox blocked the other one
+func (mb *Mailbox) HasBlocked(otherId string) bool {
+	var blocked bool
+	err := PostgresDb.Get(&blocked, `
+		select exists (select 1 from mailbox_blocks where mailbox_id = $1 and blocked_id::text = $2 and kind = $3)
+	`, mb.Id, otherId, KindBlock)
+	return err == nil && blocked
+}
+
+// Function silencedBy returns the mailboxes that blocked or
+// muted the sender, and should not be notified of its messages
+func silencedBy(senderId string) map[string]bool {
+	silenced := map[string]bool{}
+	mailboxIds := []string{}
+	if err := PostgresDb.Select(&mailboxIds, "select mailbox_id from mailbox_blocks where blocked_id::text = $1", senderId); err == nil {
+		for _, id := range mailboxIds {
+			silenced[id] = true
+		}
+	}
+	return silenced
+}
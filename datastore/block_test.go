@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestMailboxBlocks(t *testing.T) {
+	alice, bob, carol := testMailbox(t), testMailbox(t), testMailbox(t)
+	defer alice.Unblock(bob.Id)
+	defer carol.Unblock(bob.Id)
+
+	thread := testThread(t, "block test")
+
+	for _, mb := range []*Mailbox{&alice, &bob} {
+		member := ThreadMember{MailboxId: mb.Id, Role: RoleOwner}
+		if err := thread.AddMember(&member); err != nil {
+			t.Fatal("Error adding thread member when testing blocks:", err)
+		}
+	}
+
+	message := Message{ThreadId: thread.Id, SenderMailboxId: bob.Id, Body: "hello"}
+	testMessages(t, &message)
+
+	if err := alice.Block(bob.Id, KindMute); err != nil {
+		t.Fatal("Error muting mailbox:", err)
+	}
+
+	messages, err := thread.RecentMessagesWithTopic("", 10, alice.Member(thread.Id), nil)
+	if err != nil || len(messages) != 1 || alice.HasBlocked(bob.Id) {
+		t.Fatal("Error: muted messages should stay visible but got", messages, err)
+	}
+
+	if err := alice.Block(bob.Id, KindBlock); err != nil {
+		t.Fatal("Error blocking mailbox:", err)
+	}
+
+	blocks, err := alice.Blocks()
+	if err != nil || len(blocks) != 1 || blocks[0].Kind != KindBlock {
+		t.Fatal("Error: expected block to replace mute but got", blocks, err)
+	}
+
+	messages, err = thread.RecentMessagesWithTopic("", 10, alice.Member(thread.Id), nil)
+	if err != nil || len(messages) != 0 {
+		t.Fatal("Error: blocked messages should be hidden but got", messages, err)
+	}
+
+	messages, err = thread.RecentMessagesWithTopic("", 10, bob.Member(thread.Id), nil)
+	if err != nil || len(messages) != 1 {
+		t.Fatal("Error: block should not hide messages from the sender but got", messages, err)
+	}
+
+	if err := carol.Block(bob.Id, KindBlock); err != nil {
+		t.Fatal("Error blocking mailbox:", err)
+	}
+
+	if bob.Can(ActionCreate, ThreadMember{ThreadId: thread.Id, MailboxId: carol.Id}) {
+		t.Fatal("Error: blocked mailbox can add the mailbox that blocked it to a thread")
+	}
+
+	if _, err := bob.DirectThread(carol.Id); err != ErrBlocked {
+		t.Fatal("Error: expected blocked mailbox not to get a direct thread but got", err)
+	}
+
+	if err := alice.Unblock(bob.Id); err != nil || alice.HasBlocked(bob.Id) {
+		t.Fatal("Error unblocking mailbox:", err)
+	}
+
+	if err := alice.Block(alice.Id, KindBlock); err == nil {
+		t.Fatal("Error: mailbox blocked itself")
+	}
+}
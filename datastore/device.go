@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"errors"
+)
+
+// Device is a phone, laptop or other client of a mailbox with its own key.
+// Sessions signed by a device key are valid for the device's mailbox
+type Device struct {
+	Record
+	MailboxId string `db:"mailbox_id"`
+	Name      string
+	PublicKey string `db:"public_key"`
+}
+
+func GetDevice(uuid string) (d Device, err error) {
+	d.Record = Rec(uuid)
+	err = d.Load()
+	return
+}
+
+func (d *Device) Insert() error {
+	d.RequireId()
+	if d.MailboxId == "" {
+		return errors.New("Invalid mailbox ID for new device")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		insert into mailbox_devices (id, mailbox_id, createdat, updatedat, name, public_key)
+		VALUES (:id, :mailbox_id, now(), now(), :name, :public_key);
+	`, d)
+	err := tx.Commit()
+	Stream.AnnounceEvent("device-insert-"+d.MailboxId, d)
+	return err
+}
+
+func (d *Device) Load() error {
+	dx := []Device{}
+	err := PostgresDb.Select(&dx, "select * from mailbox_devices where id = $1", d.Id)
+	if err != nil {
+		return err
+	} else if len(dx) == 0 {
+		return errors.New("No device found with that UUID")
+	}
+
+	*d = dx[0]
+	return nil
+}
+
+// Function Update saves the name of the device. Like mailbox
+// keys, device keys can not be changed after the fact
+func (d *Device) Update() error {
+	if d.Id == "" {
+		return d.Insert()
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec("update mailbox_devices set updatedat = now(), name = :name where id = :id", d)
+	err := tx.Commit()
+	Stream.AnnounceEvent("device-update-"+d.MailboxId, d)
+	return err
+}
+
+func (d *Device) Delete() error {
+	if d.Id == "" {
+		return errors.New("Cant delete device with no UUID")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec("delete from mailbox_devices where id = :id", d)
+	err := tx.Commit()
+	Stream.AnnounceEvent("device-delete-"+d.MailboxId, d)
+	return err
+}
+
+// Devices are private to their mailbox. They are created through
+// a signed registration as well as this policy
+func (d Device) Policy() Policy {
+	return Policy{
+		OwnerId: d.MailboxId,
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireOwner},
+			ActionCreate: {RequireOwner | RequireUnscoped},
+			ActionUpdate: {RequireOwner | RequireUnscoped},
+			ActionDelete: {RequireOwner | RequireUnscoped},
+		},
+	}
+}
+
+// Function Devices lists the devices registered to the mailbox
+func (mb *Mailbox) Devices() (devices []Device, err error) {
+	devices = []Device{}
+	err = PostgresDb.Select(&devices, "select * from mailbox_devices where mailbox_id = $1 order by createdat", mb.Id)
+	return
+}
+
+// Function GetDevice loads a device, making sure it belongs to the mailbox
+func (mb *Mailbox) GetDevice(deviceId string) (d Device, err error) {
+	if d, err = GetDevice(deviceId); err != nil {
+		return
+	}
+
+	if d.MailboxId != mb.Id {
+		return Device{}, errors.New("No device found with that UUID")
+	}
+	return
+}
+
+// Function RemoveDevice deletes a device of the mailbox and revokes the
+// sessions it was using. Other devices are not affected
+func (mb *Mailbox) RemoveDevice(deviceId string) error {
+	d, err := mb.GetDevice(deviceId)
+	if err != nil {
+		return err
+	}
+
+	if err = d.Delete(); err != nil {
+		return err
+	}
+
+	sessions, err := mb.ActiveSessions()
+	if err != nil {
+		return err
+	}
+
+	for _, ms := range sessions {
+		if ms.DeviceId == deviceId {
+			mb.RevokeSession(ms.Id)
+		}
+	}
+	return nil
+}
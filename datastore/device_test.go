@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"github.com/omarqazi/hearst/auth"
+	"testing"
+)
+
+func TestMailboxDevices(t *testing.T) {
+	mb, _, err := NewMailboxWithKeyType(auth.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating mailbox:", err)
+	}
+
+	if err := mb.Insert(); err != nil {
+		t.Fatal("Error inserting mailbox:", err)
+	}
+	defer mb.Delete()
+
+	devices := []Device{{Name: "phone"}, {Name: "laptop"}}
+	for i := range devices {
+		key, err := auth.GenerateKey(auth.KeyTypeEd25519)
+		if err != nil {
+			t.Fatal("Error generating device key:", err)
+		}
+
+		devices[i].MailboxId = mb.Id
+		if devices[i].PublicKey, err = auth.StringForPublicKey(key.Public()); err != nil {
+			t.Fatal("Error encoding device key:", err)
+		}
+
+		if err := devices[i].Insert(); err != nil {
+			t.Fatal("Error inserting device:", err)
+		}
+	}
+
+	dbDevices, err := mb.Devices()
+	if err != nil {
+		t.Fatal("Error listing devices:", err)
+	}
+
+	if len(dbDevices) != 2 {
+		t.Fatal("Expected 2 devices but got", dbDevices)
+	}
+
+	otherMailbox := NewMailbox()
+	if _, err := otherMailbox.GetDevice(devices[0].Id); err == nil {
+		t.Fatal("Error: got device through a mailbox it does not belong to")
+	}
+
+	if err := otherMailbox.RemoveDevice(devices[0].Id); err == nil {
+		t.Fatal("Error: removed device through a mailbox it does not belong to")
+	}
+
+	if err := mb.RemoveDevice(devices[0].Id); err != nil {
+		t.Fatal("Error removing device:", err)
+	}
+
+	if dbDevices, _ = mb.Devices(); len(dbDevices) != 1 || dbDevices[0].Id != devices[1].Id {
+		t.Fatal("Expected only the second device to remain but got", dbDevices)
+	}
+}
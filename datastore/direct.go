@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"errors"
+	"github.com/pborman/uuid"
+	"sort"
+)
+
+var ErrBlocked = errors.New("blocked by the other mailbox")
+var ErrDirectThread = errors.New("Direct threads only have their two mailboxes as members")
+
+// Namespace of the name based UUIDs of direct threads
+var directThreadNamespace = uuid.Parse("5b0f7a3e-3c61-4b8e-9d1e-6f2a4c8d9e17")
+
+// Function DirectThreadId returns the id of the direct thread between two
+// mailboxes. It is the same whichever order the mailboxes are given in
+func DirectThreadId(mailboxId string, otherId string) string {
+	pair := []string{mailboxId, otherId}
+	sort.Strings(pair)
+	return uuid.NewSHA1(directThreadNamespace, []byte(pair[0]+"/"+pair[1])).String()
+}
+
+// Function isDirectThread returns true if the thread is a direct thread.
+// Threads that can not be loaded count as direct, so they are left alone
+func isDirectThread(threadId string) bool {
+	var direct bool
+	err := PostgresDb.Get(&direct, "select direct from threads where id = $1", threadId)
+	return err != nil || direct
+}
+
+// Function DirectThread returns the direct thread between the mailbox and
+// another mailbox, creating it the first time. Both mailboxes are owners of
+// the thread, with every permission. It fails with ErrBlocked if the other
+// mailbox blocked this one
+func (mb *Mailbox) DirectThread(otherId string) (t Thread, err error) {
+	if otherId == mb.Id {
+		return t, errors.New("Mailbox can not have a direct thread with itself")
+	}
+
+	other, err := GetMailbox(otherId)
+	if err != nil {
+		return
+	} else if other.HasBlocked(mb.Id) {
+		return t, ErrBlocked
+	}
+
+	id := DirectThreadId(mb.Id, otherId)
+	t.Record = Rec(id)
+	if err = t.Load(); err != nil {
+		t = Thread{Record: Rec(id), Direct: true}
+		owners := []*ThreadMember{{MailboxId: mb.Id, Role: RoleOwner}, {MailboxId: otherId, Role: RoleOwner}}
+		insertErr := t.InsertWithMembers(owners...)
+
+		// the other mailbox may have created the thread at the same time
+		if err = t.Load(); err != nil && insertErr != nil {
+			err = insertErr
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if !t.Direct {
+		err = errors.New("Another thread has the id of the direct thread")
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"github.com/omarqazi/hearst/auth"
+	"testing"
+	"time"
+)
+
+func TestDirectThread(t *testing.T) {
+	alice, bob := testMailbox(t), testMailbox(t)
+
+	if DirectThreadId(alice.Id, bob.Id) != DirectThreadId(bob.Id, alice.Id) {
+		t.Fatal("Error: direct thread id depends on the order of the mailboxes")
+	}
+
+	thread, err := alice.DirectThread(bob.Id)
+	if err != nil || !thread.Direct {
+		t.Fatal("Error creating direct thread:", thread, err)
+	}
+	defer thread.Delete()
+
+	again, err := bob.DirectThread(alice.Id)
+	if err != nil || again.Id != thread.Id {
+		t.Fatal("Error: expected the same direct thread for both mailboxes but got", again, err)
+	}
+
+	for _, mb := range []*Mailbox{&alice, &bob} {
+		if !mb.CanRead(thread.Id) || !mb.CanWrite(thread.Id) || !mb.CanFollow(thread.Id) {
+			t.Fatal("Error: both mailboxes should be full members of the direct thread")
+		}
+	}
+
+	carol := testMailbox(t)
+	if alice.Can(ActionCreate, ThreadMember{ThreadId: thread.Id, MailboxId: carol.Id, Role: RoleMember}) {
+		t.Fatal("Error: owner can add a member to a direct thread")
+	}
+
+	bobMember := ThreadMember{ThreadId: thread.Id, MailboxId: bob.Id, Role: RoleOwner}
+	if alice.Can(ActionUpdate, bobMember) || alice.Can(ActionDelete, bobMember) || bob.Can(ActionDelete, bobMember) {
+		t.Fatal("Error: members of a direct thread can be changed")
+	}
+
+	threads, err := bob.RecentThreads(time.Time{}, 10, 0)
+	if err != nil || len(threads) != 1 || !threads[0].Direct {
+		t.Fatal("Error: expected direct thread in recent threads but got", threads, err)
+	}
+
+	if _, err := alice.DirectThread(alice.Id); err == nil {
+		t.Fatal("Error: mailbox got a direct thread with itself")
+	}
+}
+
+func TestDirectThreadStaysClosed(t *testing.T) {
+	alice, bob, carol := testMailbox(t), testMailbox(t), testMailbox(t)
+	thread, err := alice.DirectThread(bob.Id)
+	if err != nil {
+		t.Fatal("Error creating direct thread:", err)
+	}
+	defer thread.Delete()
+
+	group := Group{Name: "direct group"}
+	if err := group.Insert(); err != nil {
+		t.Fatal("Error inserting group:", err)
+	}
+	defer group.Delete()
+
+	if err := group.AddMember(&GroupMember{MailboxId: alice.Id, Admin: true}); err != nil {
+		t.Fatal("Error adding group member:", err)
+	}
+
+	if alice.Can(ActionCreate, ThreadGroup{ThreadId: thread.Id, GroupId: group.Id, AllowRead: true}) {
+		t.Fatal("Error: owner can add a group to a direct thread")
+	}
+
+	if alice.Can(ActionCreate, Invitation{ThreadId: thread.Id, CreatorId: alice.Id}) {
+		t.Fatal("Error: owner can invite mailboxes to a direct thread")
+	}
+
+	listed := true
+	for _, update := range []Thread{
+		{Record: thread.Record, Direct: true, JoinPolicy: JoinOpen, Listed: thread.Listed},
+		{Record: thread.Record, Direct: true, JoinPolicy: thread.JoinPolicy, Listed: &listed},
+	} {
+		if alice.AuthorizeUpdate(&thread, &update) == nil {
+			t.Fatal("Error: owner can change the join policy or listing of a direct thread", update.Policy().Settings)
+		}
+	}
+
+	unchanged := thread
+	unchanged.Subject = "renamed"
+	if err := alice.AuthorizeUpdate(&thread, &unchanged); err != nil {
+		t.Fatal("Error: owner can not update a direct thread without changing its settings:", err)
+	}
+
+	// a thread that was opened some other way still can not be joined
+	opened := thread
+	opened.JoinPolicy = JoinOpen
+	if _, err := carol.Join(&opened); err != ErrDirectThread {
+		t.Fatal("Expected joining a direct thread to fail but got", err)
+	}
+
+	request := JoinRequest{ThreadId: thread.Id, MailboxId: carol.Id}
+	if err := request.Insert(); err != nil {
+		t.Fatal("Error inserting join request:", err)
+	}
+	defer request.Delete()
+
+	if _, err := request.Approve(); err != ErrDirectThread {
+		t.Fatal("Expected approving a request to join a direct thread to fail but got", err)
+	}
+
+	serverKey, err := auth.GenerateKey(auth.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating server key:", err)
+	}
+
+	inv := Invitation{ThreadId: thread.Id, CreatorId: alice.Id, AllowRead: true, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := inv.Sign(serverKey); err != nil {
+		t.Fatal("Error signing invitation:", err)
+	}
+
+	if err := inv.Insert(); err != nil {
+		t.Fatal("Error inserting invitation:", err)
+	}
+	defer alice.RevokeInvitation(inv.Id)
+
+	grant, err := auth.ParseInvitation(inv.Token, serverKey.Public())
+	if err != nil {
+		t.Fatal("Error parsing invitation token:", err)
+	}
+
+	if _, err := carol.RedeemInvitation(grant); err != ErrDirectThread {
+		t.Fatal("Expected redeeming an invitation to a direct thread to fail but got", err)
+	}
+
+	if carol.CanRead(thread.Id) {
+		t.Fatal("Error: a third mailbox got into the direct thread")
+	}
+}
@@ -0,0 +1,42 @@
+package datastore
+
+// Most threads returned by one directory search
+const MaxDirectoryLimit = 100
+
+// Function SearchThreads lists the threads that are publicly listed, most
+// recently updated first. If query is not blank only threads whose identifier,
+// subject or a label contain it are returned, and if label is not blank only
+// threads with that label
+func SearchThreads(query string, label string, limit int, offset int) (threads []Thread, err error) {
+	threads = []Thread{}
+	if limit <= 0 || limit > MaxDirectoryLimit {
+		limit = MaxDirectoryLimit
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	err = PostgresDb.Unsafe().Select(&threads, `
+		select * from threads where listed
+		 and ($1 = '' or strpos(lower(identifier), lower($1)) > 0 or strpos(lower(subject), lower($1)) > 0
+		 or exists (select 1 from unnest(labels) as l where strpos(lower(l), lower($1)) > 0))
+		 and ($2 = '' or $2 = any(labels))
+		 order by updatedat desc, id limit $3 offset $4
+	`, query, label, limit, offset)
+	return
+}
+
+// Function PreviewMessages returns the latest N messages of the thread that
+// anyone may read, which leaves out whispers. Callers must have checked that
+// the thread is listed
+func (t *Thread) PreviewMessages(limit int) (mx []Message, err error) {
+	mx = []Message{}
+	err = PostgresDb.Select(&mx, `
+	select * from (
+		select * from messages where thread_id = $1 and (recipients is null or recipients = '{}') and `+unexpired+`
+		order by index desc limit $2
+	) as sub order by index asc;
+	`, t.Id, limit)
+	return
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestSearchThreads(t *testing.T) {
+	isListed := true
+	listed := Thread{Subject: "Search Test Subject", Listed: &isListed, Labels: []string{"search-label"}}
+	unlisted := Thread{Subject: "Search Test Subject"}
+	for _, thread := range []*Thread{&listed, &unlisted} {
+		if err := thread.Insert(); err != nil {
+			t.Fatal("Error inserting thread when testing search:", err)
+		}
+		defer thread.Delete()
+	}
+
+	found := func(threads []Thread, id string) bool {
+		for _, thread := range threads {
+			if thread.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	threads, err := SearchThreads("test subject", "", 0, 0)
+	if err != nil || !found(threads, listed.Id) || found(threads, unlisted.Id) {
+		t.Fatal("Error: expected only the listed thread when searching by subject but got", threads, err)
+	}
+
+	if threads, err = SearchThreads("", "search-label", 10, 0); err != nil || !found(threads, listed.Id) {
+		t.Fatal("Error: expected listed thread when searching by label but got", threads, err)
+	}
+
+	if threads, err = SearchThreads("", "other-label", 10, 0); err != nil || found(threads, listed.Id) {
+		t.Fatal("Error: found thread by a label it does not have", threads, err)
+	}
+
+	if threads, err = SearchThreads(listed.Identifier, "", 10, 1); err != nil || found(threads, listed.Id) {
+		t.Fatal("Error: expected offset to skip the only match but got", threads, err)
+	}
+}
+
+func TestUpdateKeepsListing(t *testing.T) {
+	isListed := true
+	thread := Thread{Subject: "Listing Test Subject", Listed: &isListed, Labels: []string{"keep-label"}}
+	if err := thread.Insert(); err != nil {
+		t.Fatal("Error inserting thread:", err)
+	}
+	defer thread.Delete()
+
+	update := Thread{Record: thread.Record, Identifier: thread.Identifier, Subject: "New Listing Subject"}
+	if update.KeepOmitted(thread); update.Policy().Settings != thread.Policy().Settings {
+		t.Fatal("Error: omitted settings changed the thread settings to", update.Policy().Settings)
+	}
+
+	update = Thread{Record: thread.Record, Identifier: thread.Identifier, Subject: "New Listing Subject"}
+	if err := update.Update(); err != nil {
+		t.Fatal("Error updating thread:", err)
+	}
+
+	stored, err := GetThread(thread.Id)
+	if err != nil {
+		t.Fatal("Error getting thread after update:", err)
+	}
+
+	if !stored.IsListed() || len(stored.Labels) != 1 || stored.Labels[0] != "keep-label" {
+		t.Fatal("Error: update without listing settings changed them to", stored.Listed, stored.Labels)
+	}
+}
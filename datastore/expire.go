@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"github.com/lib/pq"
+	"log"
+	"time"
+)
+
+// Condition on messages that leaves out the ones past their expiry,
+// so they are hidden as soon as they expire and before they are reaped
+const unexpired = "(expiresat is null or expiresat > now())"
+
+// Number of messages the reaper deletes in one statement
+const ReapBatchSize = 500
+
+// Function Expired returns true if the message has an expiry that has passed
+func (m Message) Expired() bool {
+	return m.ExpiresAt.Valid && !m.ExpiresAt.Time.After(time.Now())
+}
+
+// Function applyExpiresIn sets the expiry of the message to ExpiresIn
+// seconds from now, if it was given
+func (m *Message) applyExpiresIn() {
+	if m.ExpiresIn > 0 {
+		m.ExpiresAt = pq.NullTime{Time: time.Now().Add(time.Duration(m.ExpiresIn) * time.Second), Valid: true}
+		m.ExpiresIn = 0
+	}
+}
+
+// Function ReapExpiredMessages deletes up to limit expired messages with
+// their revisions and announces a message-delete event for each. It returns how many it deleted
+func ReapExpiredMessages(limit int) (int, error) {
+	mx := []Message{}
+	tx := PostgresDb.MustBegin()
+	err := tx.Select(&mx, `
+		delete from messages where id in (
+			select id from messages where expiresat <= now() order by expiresat limit $1
+		) returning *;
+	`, limit)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	ids := []string{}
+	for _, m := range mx {
+		ids = append(ids, m.Id)
+	}
+	tx.Exec("delete from message_revisions where message_id::text = any($1)", pq.Array(ids))
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for i := range mx {
+		Stream.AnnounceEvent("message-delete-"+mx[i].ThreadId, &mx[i])
+	}
+	return len(mx), nil
+}
+
+// Function ReapExpiredMessagesEvery deletes expired messages in batches on a
+// schedule. It never returns, so it should be run in a goroutine
+func ReapExpiredMessagesEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		for {
+			reaped, err := ReapExpiredMessages(ReapBatchSize)
+			if err != nil {
+				log.Println("Error reaping expired messages:", err)
+			}
+
+			if err != nil || reaped < ReapBatchSize {
+				break
+			}
+		}
+	}
+}
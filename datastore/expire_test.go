@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiredMessages(t *testing.T) {
+	sender := testMailbox(t)
+	thread := testThread(t, "expiry test")
+
+	kept := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Body: "kept"}
+	expiring := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Body: "expiring", ExpiresIn: 3600}
+	testMessages(t, &kept, &expiring)
+
+	if !expiring.ExpiresAt.Valid || expiring.Expired() {
+		t.Fatal("Error: expected message to expire in an hour but got", expiring.ExpiresAt)
+	}
+
+	edit := Message{Id: expiring.Id, ThreadId: thread.Id, SenderMailboxId: sender.Id, Body: "still expiring"}
+	edit.Labels.Scan("{}")
+	edit.Payload.Scan("{}")
+	if err := edit.Update(); err != nil || !edit.ExpiresAt.Valid {
+		t.Fatal("Error: update without an expiry removed the stored one", edit.ExpiresAt, err)
+	}
+
+	expiring.ExpiresAt.Time = time.Now().Add(-time.Minute)
+	if err := expiring.Update(); err != nil || !expiring.Expired() {
+		t.Fatal("Error expiring message:", err)
+	}
+
+	if m, err := GetMessage(expiring.Id); err == nil {
+		t.Fatal("Error: expected expired message to be hidden but got", m)
+	}
+
+	messages, err := thread.MessagesSince(0, 10, "", nil, nil)
+	if err != nil || len(messages) != 1 || messages[0].Id != kept.Id {
+		t.Fatal("Error: expected only the unexpired message but got", messages, err)
+	}
+
+	es := NewStream(RedisDb)
+	defer es.Close()
+
+	events := es.EventChannel("message-delete-" + thread.Id)
+	if reaped, err := ReapExpiredMessages(ReapBatchSize); err != nil || reaped < 1 {
+		t.Fatal("Error reaping expired messages:", reaped, err)
+	}
+
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("Error: expected message-delete event for reaped message")
+	}
+
+	if _, err := GetMessage(kept.Id); err != nil {
+		t.Fatal("Error: reaper deleted a message that has not expired:", err)
+	}
+}
@@ -0,0 +1,137 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx/types"
+	"reflect"
+)
+
+// JSONFilter matches messages whose labels and payload contain the given
+// JSON, the way the postgres @> operator does. For example, a filter with
+// Labels {"kind": "order"} matches messages labeled as orders. Blank fields
+// match every message
+type JSONFilter struct {
+	Labels  types.JSONText
+	Payload types.JSONText
+}
+
+// Function ParseJSONFilter returns the filter for the given labels and
+// payload JSON, or nil if both are blank
+func ParseJSONFilter(labels string, payload string) (*JSONFilter, error) {
+	if labels == "" && payload == "" {
+		return nil, nil
+	}
+
+	f := &JSONFilter{}
+	if labels != "" {
+		f.Labels = types.JSONText(labels)
+	}
+
+	if payload != "" {
+		f.Payload = types.JSONText(payload)
+	}
+
+	for _, j := range []types.JSONText{f.Labels, f.Payload} {
+		if len(j) > 0 && !json.Valid(j) {
+			return nil, errors.New("invalid JSON filter")
+		}
+	}
+	return f, nil
+}
+
+// Function filterArgs returns the query arguments for containsFilter
+func filterArgs(f *JSONFilter) (labels interface{}, payload interface{}) {
+	if f == nil {
+		return nil, nil
+	}
+
+	if len(f.Labels) > 0 {
+		labels = string(f.Labels)
+	}
+
+	if len(f.Payload) > 0 {
+		payload = string(f.Payload)
+	}
+	return
+}
+
+// Function containsFilter returns a condition on messages that matches the
+// ones whose labels and payload contain the filter, given the numbers of the
+// query arguments from filterArgs. It is answered by the GIN indexes
+func containsFilter(labelsArg int, payloadArg int) string {
+	return fmt.Sprintf(`($%[1]d::jsonb is null or labels @> $%[1]d::jsonb)
+		and ($%[2]d::jsonb is null or payload @> $%[2]d::jsonb)`, labelsArg, payloadArg)
+}
+
+// Function Matches returns true if the labels and payload of the message
+// contain the filter. A nil filter matches every message
+func (f *JSONFilter) Matches(m *Message) bool {
+	if f == nil {
+		return true
+	}
+	return jsonContains(m.Labels, f.Labels) && jsonContains(m.Payload, f.Payload)
+}
+
+// Function jsonContains returns true if the JSON document contains the
+// filter, or if the filter is blank
+func jsonContains(document types.JSONText, filter types.JSONText) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	var d, f interface{}
+	if json.Unmarshal(document, &d) != nil || json.Unmarshal(filter, &f) != nil {
+		return false
+	}
+	return contains(d, f, true)
+}
+
+// Function contains follows the containment rules of postgres: objects contain
+// objects with a subset of their keys whose values they contain, and arrays
+// contain arrays whose elements they each contain. As a special case, an array
+// at the top level contains the scalars that are among its elements
+func contains(container interface{}, contained interface{}, topLevel bool) bool {
+	switch contained := contained.(type) {
+	case map[string]interface{}:
+		object, ok := container.(map[string]interface{})
+		if !ok {
+			return false
+		}
+
+		for key, value := range contained {
+			if v, found := object[key]; !found || !contains(v, value, false) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		array, ok := container.([]interface{})
+		if !ok {
+			return false
+		}
+
+		for _, value := range contained {
+			if !containsElement(array, value) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if array, ok := container.([]interface{}); ok && topLevel {
+		return containsElement(array, contained)
+	}
+	return reflect.DeepEqual(container, contained)
+}
+
+// Function containsElement returns true if any element of the array contains value
+func containsElement(array []interface{}, value interface{}) bool {
+	for _, element := range array {
+		if contains(element, value, false) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"github.com/jmoiron/sqlx/types"
+	"testing"
+)
+
+func TestJSONFilterMatches(t *testing.T) {
+	message := Message{
+		Labels:  types.JSONText(`{"kind": "order", "tags": ["rush", "gift"], "count": 2}`),
+		Payload: types.JSONText(`{"items": [{"sku": "a1", "qty": 1}, {"sku": "b2", "qty": 3}]}`),
+	}
+
+	cases := []struct {
+		labels  string
+		payload string
+		matches bool
+	}{
+		{"", "", true},
+		{`{"kind": "order"}`, "", true},
+		{`{"kind": "refund"}`, "", false},
+		{`{"tags": ["gift"]}`, "", true},
+		{`{"tags": ["gift", "late"]}`, "", false},
+		{`{"tags": "gift"}`, "", false},
+		{`{"count": 2}`, "", true},
+		{`{"count": "2"}`, "", false},
+		{`{"missing": null}`, "", false},
+		{"", `{"items": [{"sku": "b2"}]}`, true},
+		{`{"kind": "order"}`, `{"items": [{"sku": "c3"}]}`, false},
+	}
+
+	for _, c := range cases {
+		filter, err := ParseJSONFilter(c.labels, c.payload)
+		if err != nil {
+			t.Fatal("Error parsing JSON filter:", err)
+		}
+
+		if got := filter.Matches(&message); got != c.matches {
+			t.Error("Error: filter", c.labels, c.payload, "should match", c.matches, "but got", got)
+		}
+	}
+
+	if _, err := ParseJSONFilter(`{"kind":`, ""); err == nil {
+		t.Fatal("Error: invalid JSON filter was accepted")
+	}
+
+	if !jsonContains(types.JSONText(`["a", "b"]`), types.JSONText(`"a"`)) {
+		t.Fatal("Error: top level array should contain its scalar elements")
+	}
+}
+
+func TestMessagesWithJSONFilter(t *testing.T) {
+	sender := testMailbox(t)
+	thread := testThread(t, "json filter test")
+
+	order := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat"}
+	order.Labels.Scan(`{"kind": "order"}`)
+	order.Payload.Scan(`{"total": 10}`)
+	chat := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat"}
+	chat.Labels.Scan(`{"kind": "chat"}`)
+	testMessages(t, &order, &chat)
+
+	filter, _ := ParseJSONFilter(`{"kind": "order"}`, `{"total": 10}`)
+	recent, err := thread.RecentMessagesWithTopic("", 10, nil, filter)
+	if err != nil || len(recent) != 1 || recent[0].Id != order.Id {
+		t.Fatal("Error: expected only the order in recent messages but got", recent, err)
+	}
+
+	since, err := thread.MessagesSince(0, 10, "", nil, filter)
+	if err != nil || len(since) != 1 || since[0].Id != order.Id {
+		t.Fatal("Error: expected only the order in messages since but got", since, err)
+	}
+
+	all, err := thread.RecentMessagesSince(0, 10, "", nil, nil)
+	if err != nil || len(all) != 2 {
+		t.Fatal("Error: expected every message without a filter but got", all, err)
+	}
+}
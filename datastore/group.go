@@ -0,0 +1,390 @@
+package datastore
+
+import (
+	"errors"
+)
+
+// Group is a named set of mailboxes that can be given access to threads
+// as a unit. Its members get the access the group has to each thread, and
+// lose it when they leave the group
+type Group struct {
+	Record
+	Name string
+}
+
+// GroupMember is a mailbox in a group. Group admins add and remove
+// members and add the group to threads
+type GroupMember struct {
+	GroupId   string `db:"group_id"`
+	MailboxId string `db:"mailbox_id"`
+	Admin     bool
+}
+
+// ThreadGroup gives the members of a group access to a thread. Groups grant
+// every topic and never an owner or admin role
+type ThreadGroup struct {
+	ThreadId          string `db:"thread_id"`
+	GroupId           string `db:"group_id"`
+	AllowRead         bool   `db:"allow_read"`
+	AllowWrite        bool   `db:"allow_write"`
+	AllowNotification bool   `db:"allow_notification"`
+}
+
+func GetGroup(uuid string) (g Group, err error) {
+	g.Record = Rec(uuid)
+	err = g.Load()
+	return
+}
+
+func (g *Group) Insert() error {
+	g.RequireId()
+	if g.Name == "" {
+		return errors.New("Group must have a name")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		insert into mailbox_groups (id, createdat, updatedat, name)
+		VALUES (:id, now(), now(), :name);
+	`, g)
+	err := tx.Commit()
+	Stream.AnnounceEvent("group-insert-"+g.Id, g)
+	return err
+}
+
+func (g *Group) Load() error {
+	gx := []Group{}
+	err := PostgresDb.Select(&gx, "select * from mailbox_groups where id = $1", g.Id)
+	if err != nil {
+		return err
+	} else if len(gx) == 0 {
+		return errors.New("No group found with that UUID")
+	}
+
+	*g = gx[0]
+	return nil
+}
+
+func (g *Group) Update() error {
+	if g.Id == "" {
+		return g.Insert()
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec("update mailbox_groups set updatedat = now(), name = :name where id = :id", g)
+	err := tx.Commit()
+	Stream.AnnounceEvent("group-update-"+g.Id, g)
+	return err
+}
+
+// Function Delete deletes the group, so its members lose
+// the access it had to threads
+func (g *Group) Delete() error {
+	if g.Id == "" {
+		return errors.New("Cant delete group with no UUID")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec("delete from mailbox_groups where id = :id", g)
+	tx.NamedExec("delete from group_members where group_id = :id", g)
+	tx.NamedExec("delete from thread_groups where group_id = :id", g)
+	err := tx.Commit()
+	Stream.AnnounceEvent("group-delete-"+g.Id, g)
+	return err
+}
+
+// Groups can be seen by their members and changed by their admins
+func (g Group) Policy() Policy {
+	return Policy{
+		GroupId: g.Id,
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireGroupMember},
+			ActionCreate: {RequireUnscoped},
+			ActionUpdate: {RequireGroupAdmin | RequireUnscoped},
+			ActionDelete: {RequireGroupAdmin | RequireUnscoped},
+			ActionList:   {RequireGroupMember},
+		},
+	}
+}
+
+// Function AddMember adds a mailbox to the group
+func (g *Group) AddMember(m *GroupMember) error {
+	m.GroupId = g.Id
+	if m.MailboxId == "" {
+		return errors.New("Invalid mailbox ID for new group member")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		insert into group_members (group_id, mailbox_id, admin)
+		VALUES (:group_id, :mailbox_id, :admin);
+	`, m)
+	err := tx.Commit()
+	Stream.AnnounceEvent("groupmember-insert-"+g.Id, m)
+	return err
+}
+
+func (g *Group) GetMember(mailboxId string) (GroupMember, error) {
+	members := []GroupMember{}
+	err := PostgresDb.Select(&members, "select * from group_members where group_id = $1 and mailbox_id = $2", g.Id, mailboxId)
+	if err != nil {
+		return GroupMember{}, err
+	} else if len(members) > 0 {
+		return members[0], nil
+	}
+
+	return GroupMember{}, errors.New("No group member found with that mailbox id")
+}
+
+func (g *Group) GetAllMembers() ([]GroupMember, error) {
+	members := []GroupMember{}
+	err := PostgresDb.Select(&members, "select * from group_members where group_id = $1", g.Id)
+	return members, err
+}
+
+// Function Threads lists the access the group has to threads
+func (g *Group) Threads() ([]ThreadGroup, error) {
+	grants := []ThreadGroup{}
+	err := PostgresDb.Select(&grants, "select * from thread_groups where group_id = $1", g.Id)
+	return grants, err
+}
+
+func (m *GroupMember) Insert() error {
+	if m.GroupId == "" {
+		return errors.New("No group ID in new group member")
+	}
+
+	g := Group{Record: Rec(m.GroupId)}
+	return g.AddMember(m)
+}
+
+func (m *GroupMember) Load() error {
+	g := Group{Record: Rec(m.GroupId)}
+	dbm, err := g.GetMember(m.MailboxId)
+	if err != nil {
+		return err
+	}
+
+	*m = dbm
+	return nil
+}
+
+// Function Update saves whether the member is an admin of the group
+func (m *GroupMember) Update() error {
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		update group_members set admin = :admin
+		where group_id = :group_id and mailbox_id = :mailbox_id;
+	`, m)
+	err := tx.Commit()
+	Stream.AnnounceEvent("groupmember-update-"+m.GroupId, m)
+	return err
+}
+
+func (m *GroupMember) Delete() error {
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		delete from group_members
+		where group_id = :group_id and mailbox_id = :mailbox_id;
+	`, m)
+	err := tx.Commit()
+	Stream.AnnounceEvent("groupmember-delete-"+m.GroupId, m)
+	return err
+}
+
+// Group admins manage members, but can not add mailboxes that
+// blocked them. Members can see each other and leave the group
+func (m GroupMember) Policy() Policy {
+	return Policy{
+		OwnerId: m.MailboxId,
+		GroupId: m.GroupId,
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireGroupMember},
+			ActionCreate: {RequireGroupAdmin | RequireUnblocked},
+			ActionUpdate: {RequireGroupAdmin},
+			ActionDelete: {RequireGroupAdmin, RequireOwner},
+		},
+	}
+}
+
+// Function AddGroup gives the members of the group the access in g
+func (t *Thread) AddGroup(g *ThreadGroup) error {
+	g.ThreadId = t.Id
+	if g.GroupId == "" {
+		return errors.New("Invalid group ID for thread group")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		insert into thread_groups (thread_id, group_id, allow_read, allow_write, allow_notification)
+		VALUES (:thread_id, :group_id, :allow_read, :allow_write, :allow_notification);
+	`, g)
+	err := tx.Commit()
+	Stream.AnnounceEvent("threadgroup-insert-"+t.Id, g)
+	return err
+}
+
+func (t *Thread) GetGroups() ([]ThreadGroup, error) {
+	groups := []ThreadGroup{}
+	err := PostgresDb.Select(&groups, "select * from thread_groups where thread_id = $1", t.Id)
+	return groups, err
+}
+
+func (g *ThreadGroup) Insert() error {
+	if g.ThreadId == "" {
+		return errors.New("No thread ID in new thread group")
+	}
+
+	t := Thread{Record: Rec(g.ThreadId)}
+	return t.AddGroup(g)
+}
+
+func (g *ThreadGroup) Load() error {
+	gx := []ThreadGroup{}
+	err := PostgresDb.Select(&gx, "select * from thread_groups where thread_id = $1 and group_id = $2", g.ThreadId, g.GroupId)
+	if err != nil {
+		return err
+	} else if len(gx) == 0 {
+		return errors.New("No thread group found with that group id")
+	}
+
+	*g = gx[0]
+	return nil
+}
+
+// Function Update saves the access the group has to the thread
+func (g *ThreadGroup) Update() error {
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		update thread_groups set allow_read = :allow_read, allow_write = :allow_write,
+		allow_notification = :allow_notification
+		where thread_id = :thread_id and group_id = :group_id;
+	`, g)
+	err := tx.Commit()
+	Stream.AnnounceEvent("threadgroup-update-"+g.ThreadId, g)
+	return err
+}
+
+func (g *ThreadGroup) Delete() error {
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		delete from thread_groups
+		where thread_id = :thread_id and group_id = :group_id;
+	`, g)
+	err := tx.Commit()
+	Stream.AnnounceEvent("threadgroup-delete-"+g.ThreadId, g)
+	return err
+}
+
+// Groups are added to a thread by its owners and admins, who must also
+// be admins of the group, but never to a direct thread. Either side can
+// take the access away
+func (g ThreadGroup) Policy() Policy {
+	return Policy{
+		ThreadId: g.ThreadId,
+		GroupId:  g.GroupId,
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireRead, RequireGroupMember},
+			ActionCreate: {RequireManage | RequireGroupAdmin | RequireNotDirect},
+			ActionUpdate: {RequireManage},
+			ActionDelete: {RequireManage, RequireGroupAdmin},
+		},
+	}
+}
+
+// Function grant adds the access a group has to the thread to the member's.
+// Groups grant every topic, so a grant lifts the member's topic limits
+func (m *ThreadMember) grant(g ThreadGroup) {
+	if g.AllowRead {
+		m.AllowRead, m.ReadTopics = true, nil
+	}
+
+	if g.AllowWrite {
+		m.AllowWrite, m.WriteTopics = true, nil
+	}
+
+	m.AllowNotification = m.AllowNotification || g.AllowNotification
+}
+
+// Function accessOf returns the access mailboxes have to the thread, directly
+// and through groups, with one entry per mailbox. If mailboxId is not blank
+// only that mailbox is returned
+func (t *Thread) accessOf(mailboxId string) ([]ThreadMember, error) {
+	return memberAccess(t.Id, mailboxId)
+}
+
+// Function memberAccess returns the access mailboxes have to threads, directly
+// and through groups, with one entry per mailbox and thread. A blank threadId
+// or mailboxId matches every thread or mailbox
+func memberAccess(threadId string, mailboxId string) ([]ThreadMember, error) {
+	direct := []ThreadMember{}
+	err := PostgresDb.Select(&direct, `
+		select * from thread_members
+		 where ($1 = '' or thread_id::text = $1) and ($2 = '' or mailbox_id::text = $2)
+	`, threadId, mailboxId)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := []struct {
+		ThreadGroup
+		MailboxId string `db:"mailbox_id"`
+	}{}
+	err = PostgresDb.Select(&grants, `
+		select thread_groups.*, group_members.mailbox_id from thread_groups
+		 inner join group_members on group_members.group_id = thread_groups.group_id
+		 where ($1 = '' or thread_groups.thread_id::text = $1) and ($2 = '' or group_members.mailbox_id::text = $2)
+	`, threadId, mailboxId)
+	if err != nil {
+		return nil, err
+	}
+
+	members := direct
+	index := map[[2]string]int{}
+	for i, member := range direct {
+		index[[2]string{member.ThreadId, member.MailboxId}] = i
+	}
+
+	for _, g := range grants {
+		key := [2]string{g.ThreadId, g.MailboxId}
+		i, ok := index[key]
+		if !ok {
+			i = len(members)
+			index[key] = i
+			members = append(members, ThreadMember{ThreadId: g.ThreadId, MailboxId: g.MailboxId})
+		}
+		members[i].grant(g.ThreadGroup)
+	}
+	return members, nil
+}
+
+// Function Access returns the access the mailbox has to the thread, as a
+// member and through its groups. Mailboxes that are only in the thread
+// through groups are members or viewers
+func (t *Thread) Access(mailboxId string) (ThreadMember, error) {
+	members, err := t.accessOf(mailboxId)
+	if err != nil {
+		return ThreadMember{}, err
+	} else if len(members) == 0 {
+		return ThreadMember{}, errors.New("No member found with that mailbox id")
+	}
+	return members[0], nil
+}
+
+// Function GroupMembership returns the membership of the mailbox in the group
+func (mb *Mailbox) GroupMembership(groupId string) (GroupMember, error) {
+	g := Group{Record: Rec(groupId)}
+	return g.GetMember(mb.Id)
+}
+
+// Function Groups lists the groups the mailbox is in
+func (mb *Mailbox) Groups() (groups []Group, err error) {
+	groups = []Group{}
+	err = PostgresDb.Select(&groups, `
+		select mailbox_groups.* from group_members
+		 inner join mailbox_groups on group_members.group_id = mailbox_groups.id
+		 where group_members.mailbox_id = $1
+		 order by mailbox_groups.name
+	`, mb.Id)
+	return
+}
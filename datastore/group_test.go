@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupThreadAccess(t *testing.T) {
+	admin, teammate, outsider := testMailbox(t), testMailbox(t), testMailbox(t)
+
+	group := Group{Name: "team"}
+	if err := group.Insert(); err != nil {
+		t.Fatal("Error inserting group:", err)
+	}
+	defer group.Delete()
+
+	for _, member := range []*GroupMember{{MailboxId: admin.Id, Admin: true}, {MailboxId: teammate.Id}} {
+		if err := group.AddMember(member); err != nil {
+			t.Fatal("Error adding group member:", err)
+		}
+	}
+
+	thread := testThread(t, "group test")
+
+	if err := thread.AddMember(&ThreadMember{MailboxId: admin.Id, Role: RoleOwner, ReadTopics: []string{"chat"}}); err != nil {
+		t.Fatal("Error adding thread owner:", err)
+	}
+
+	grant := ThreadGroup{ThreadId: thread.Id, GroupId: group.Id, AllowRead: true, AllowNotification: true}
+	if teammate.Can(ActionCreate, grant) || outsider.Can(ActionCreate, grant) || !admin.Can(ActionCreate, grant) {
+		t.Fatal("Error: only thread admins who are group admins should add groups to threads")
+	}
+
+	if err := thread.AddGroup(&grant); err != nil {
+		t.Fatal("Error adding group to thread:", err)
+	}
+
+	if !teammate.CanRead(thread.Id) || !teammate.CanFollow(thread.Id) || teammate.CanWrite(thread.Id) {
+		t.Fatal("Error: group member should read and follow but not write the thread")
+	}
+
+	if outsider.CanRead(thread.Id) {
+		t.Fatal("Error: mailbox outside the group can read the thread")
+	}
+
+	if !admin.CanReadTopic(thread.Id, "telemetry") {
+		t.Fatal("Error: group access should lift the member's topic limits")
+	}
+
+	members, err := thread.MembersToNotify()
+	notified := map[string]bool{}
+	for _, member := range members {
+		notified[member.MailboxId] = true
+	}
+	if err != nil || len(members) != 2 || !notified[teammate.Id] || !notified[admin.Id] {
+		t.Fatal("Error: expected owner and group member to be notified but got", members, err)
+	}
+
+	threads, err := teammate.RecentThreads(time.Time{}, 10, 0)
+	if err != nil || len(threads) != 1 || threads[0].Id != thread.Id {
+		t.Fatal("Error: expected thread in group member's recent threads but got", threads, err)
+	}
+
+	membership := GroupMember{GroupId: group.Id, MailboxId: teammate.Id}
+	if err := membership.Delete(); err != nil {
+		t.Fatal("Error removing group member:", err)
+	}
+
+	if teammate.CanRead(thread.Id) {
+		t.Fatal("Error: mailbox kept access to the thread after leaving the group")
+	}
+}
@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"crypto"
+	"errors"
+	"github.com/omarqazi/hearst/auth"
+	"time"
+)
+
+// Invitation lets any mailbox that has its token join a thread with the
+// permissions it grants, until it expires or has been used MaxUses times
+type Invitation struct {
+	Record
+	ThreadId          string    `db:"thread_id"`
+	CreatorId         string    `db:"creator_id"`
+	ExpiresAt         time.Time `db:"expires_at"`
+	AllowRead         bool      `db:"allow_read"`
+	AllowWrite        bool      `db:"allow_write"`
+	AllowNotification bool      `db:"allow_notification"`
+	MaxUses           int       `db:"max_uses"` // 0 if the invitation can be used any number of times
+	Uses              int
+	Token             string // the signed invitation to share with invitees
+}
+
+func GetInvitation(uuid string) (inv Invitation, err error) {
+	inv.Record = Rec(uuid)
+	err = inv.Load()
+	return
+}
+
+// Function Sign sets the token of the invitation, signed with signer
+func (inv *Invitation) Sign(signer crypto.Signer) (err error) {
+	inv.RequireId()
+	inv.Token, err = inv.Grant().Token(signer)
+	return
+}
+
+// Function Grant returns what the invitation grants, as stored in its token
+func (inv *Invitation) Grant() auth.Invitation {
+	return auth.Invitation{
+		Id:                inv.Id,
+		ThreadId:          inv.ThreadId,
+		AllowRead:         inv.AllowRead,
+		AllowWrite:        inv.AllowWrite,
+		AllowNotification: inv.AllowNotification,
+		ExpiresAt:         inv.ExpiresAt,
+		MaxUses:           inv.MaxUses,
+	}
+}
+
+// Invitations are created by thread owners and admins, except to direct
+// threads, and can only be seen and revoked by their creator
+func (inv Invitation) Policy() Policy {
+	return Policy{
+		OwnerId:  inv.CreatorId,
+		ThreadId: inv.ThreadId,
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireOwner},
+			ActionCreate: {RequireOwner | RequireManage | RequireNotDirect},
+			ActionDelete: {RequireOwner},
+		},
+	}
+}
+
+func (inv *Invitation) Insert() error {
+	if inv.Token == "" {
+		return errors.New("Invitation must be signed before it is inserted")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		insert into thread_invitations
+		(id, thread_id, creator_id, createdat, updatedat, expires_at, allow_read, allow_write, allow_notification, max_uses, uses, token)
+		VALUES (:id, :thread_id, :creator_id, now(), now(), :expires_at, :allow_read, :allow_write, :allow_notification, :max_uses, 0, :token);
+	`, inv)
+	return tx.Commit()
+}
+
+func (inv *Invitation) Load() error {
+	ix := []Invitation{}
+	err := PostgresDb.Select(&ix, "select * from thread_invitations where id = $1", inv.Id)
+	if err != nil {
+		return err
+	} else if len(ix) == 0 {
+		return errors.New("No invitation found with that UUID")
+	}
+
+	*inv = ix[0]
+	return nil
+}
+
+func (inv *Invitation) Delete() error {
+	if inv.Id == "" {
+		return errors.New("Cant delete invitation with no UUID")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec("delete from thread_invitations where id = :id", inv)
+	return tx.Commit()
+}
+
+// Function Invitations lists the unexpired invitations the mailbox has
+// created. If threadId is not blank only invitations to that thread are listed
+func (mb *Mailbox) Invitations(threadId string) (invitations []Invitation, err error) {
+	invitations = []Invitation{}
+	err = PostgresDb.Select(&invitations, `
+		select * from thread_invitations
+		 where creator_id = $1 and ($2 = '' or thread_id::text = $2) and expires_at > now()
+		 order by createdat desc
+	`, mb.Id, threadId)
+	return
+}
+
+// Function RevokeInvitation deletes an invitation the mailbox created,
+// so its token can no longer be redeemed
+func (mb *Mailbox) RevokeInvitation(invitationId string) error {
+	inv, err := GetInvitation(invitationId)
+	if err != nil {
+		return err
+	}
+
+	if inv.CreatorId != mb.Id {
+		return errors.New("No invitation found with that UUID")
+	}
+	return inv.Delete()
+}
+
+// Function RedeemInvitation adds the mailbox to the invitation's thread with
+// the permissions the invitation grants and counts the use. The caller must
+// have checked the invitation's signature
+func (mb *Mailbox) RedeemInvitation(grant auth.Invitation) (member ThreadMember, err error) {
+	thread := Thread{Record: Rec(grant.ThreadId)}
+	if isDirectThread(thread.Id) {
+		return member, ErrDirectThread
+	} else if _, err = thread.GetMember(mb.Id); err == nil {
+		return member, errors.New("Mailbox is already a member of the thread")
+	}
+
+	// the use is only counted if the mailbox is added
+	tx := PostgresDb.MustBegin()
+	ix := []Invitation{}
+	err = tx.Select(&ix, `
+		update thread_invitations set uses = uses + 1, updatedat = now()
+		 where id = $1 and thread_id = $2 and expires_at > now()
+		 and (max_uses = 0 or uses < max_uses)
+		 returning *
+	`, grant.Id, grant.ThreadId)
+	if err != nil {
+		tx.Rollback()
+		return
+	} else if len(ix) == 0 {
+		tx.Rollback()
+		return member, errors.New("Invitation has expired, been used up or been revoked")
+	}
+
+	member = ThreadMember{
+		MailboxId:         mb.Id,
+		AllowRead:         ix[0].AllowRead,
+		AllowWrite:        ix[0].AllowWrite,
+		AllowNotification: ix[0].AllowNotification,
+	}
+	if err = thread.addMember(tx, &member); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = tx.Commit(); err == nil {
+		Stream.AnnounceEvent("threadmember-insert-"+thread.Id, member)
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package datastore
+
+import (
+	"github.com/omarqazi/hearst/auth"
+	"testing"
+	"time"
+)
+
+func TestRedeemInvitation(t *testing.T) {
+	serverKey, err := auth.GenerateKey(auth.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating server key:", err)
+	}
+
+	thread := testThread(t, "")
+
+	creator, first, second := NewMailbox(), NewMailbox(), NewMailbox()
+	inv := Invitation{
+		ThreadId:   thread.Id,
+		CreatorId:  creator.Id,
+		AllowRead:  true,
+		AllowWrite: true,
+		ExpiresAt:  time.Now().Add(time.Hour),
+		MaxUses:    1,
+	}
+
+	if err := inv.Sign(serverKey); err != nil {
+		t.Fatal("Error signing invitation:", err)
+	}
+
+	if err := inv.Insert(); err != nil {
+		t.Fatal("Error inserting invitation:", err)
+	}
+
+	grant, err := auth.ParseInvitation(inv.Token, serverKey.Public())
+	if err != nil {
+		t.Fatal("Error parsing invitation token:", err)
+	}
+
+	member, err := first.RedeemInvitation(grant)
+	if err != nil {
+		t.Fatal("Error redeeming invitation:", err)
+	}
+
+	if !member.AllowRead || !member.AllowWrite || member.AllowNotification {
+		t.Fatal("Error: member did not get the permissions of the invitation", member)
+	}
+
+	if _, err := second.RedeemInvitation(grant); err == nil {
+		t.Fatal("Error: invitation was redeemed more than MaxUses times")
+	}
+
+	if invitations, _ := creator.Invitations(thread.Id); len(invitations) != 1 || invitations[0].Uses != 1 {
+		t.Fatal("Expected creator to see one used invitation but got", invitations)
+	}
+
+	if err := second.RevokeInvitation(inv.Id); err == nil {
+		t.Fatal("Error: invitation revoked by a mailbox that did not create it")
+	}
+
+	if err := creator.RevokeInvitation(inv.Id); err != nil {
+		t.Fatal("Error revoking invitation:", err)
+	}
+}
@@ -0,0 +1,173 @@
+package datastore
+
+import (
+	"errors"
+)
+
+// JoinPolicy decides how mailboxes that were not invited can join a thread
+type JoinPolicy string
+
+const (
+	JoinInviteOnly JoinPolicy = "invite-only" // only members and invitations add mailboxes
+	JoinOpen       JoinPolicy = "open"        // any mailbox can add itself with default permissions
+	JoinOnRequest  JoinPolicy = "request"     // mailboxes ask to join and owners or admins decide
+)
+
+// Function ParseJoinPolicy returns the join policy with the given
+// name. A blank name is the default, invite-only
+func ParseJoinPolicy(name string) (JoinPolicy, error) {
+	switch p := JoinPolicy(name); p {
+	case "":
+		return JoinInviteOnly, nil
+	case JoinInviteOnly, JoinOpen, JoinOnRequest:
+		return p, nil
+	}
+	return "", errors.New("invalid join policy: " + name)
+}
+
+// JoinRequest is a request by a mailbox to join a thread
+// whose join policy is "request"
+type JoinRequest struct {
+	Record
+	ThreadId  string `db:"thread_id"`
+	MailboxId string `db:"mailbox_id"`
+	Note      string // a message from the mailbox to the thread's admins
+}
+
+func GetJoinRequest(uuid string) (r JoinRequest, err error) {
+	r.Record = Rec(uuid)
+	err = r.Load()
+	return
+}
+
+// Join requests can be seen by the mailbox that filed them, which can also
+// withdraw them, and by the owners and admins of the thread, who decide them
+func (r JoinRequest) Policy() Policy {
+	return Policy{
+		OwnerId:  r.MailboxId,
+		ThreadId: r.ThreadId,
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireOwner, RequireManage},
+			ActionCreate: {RequireOwner | RequireUnscoped},
+			ActionUpdate: {RequireManage},
+			ActionDelete: {RequireOwner},
+		},
+	}
+}
+
+func (r *JoinRequest) Insert() error {
+	r.RequireId()
+	if r.ThreadId == "" || r.MailboxId == "" {
+		return errors.New("Join request needs a thread and a mailbox")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		insert into thread_join_requests (id, thread_id, mailbox_id, createdat, updatedat, note)
+		VALUES (:id, :thread_id, :mailbox_id, now(), now(), :note);
+	`, r)
+	err := tx.Commit()
+	Stream.AnnounceEvent("threadmember-request-"+r.ThreadId, r)
+	return err
+}
+
+func (r *JoinRequest) Load() error {
+	rx := []JoinRequest{}
+	err := PostgresDb.Select(&rx, "select * from thread_join_requests where id = $1", r.Id)
+	if err != nil {
+		return err
+	} else if len(rx) == 0 {
+		return errors.New("No join request found with that UUID")
+	}
+
+	*r = rx[0]
+	return nil
+}
+
+// Function Delete withdraws the request without a decision
+func (r *JoinRequest) Delete() error {
+	if r.Id == "" {
+		return errors.New("Cant delete join request with no UUID")
+	}
+
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec("delete from thread_join_requests where id = :id", r)
+	return tx.Commit()
+}
+
+// Function Approve adds the mailbox that filed the request to
+// the thread as a member and removes the request
+func (r *JoinRequest) Approve() (member ThreadMember, err error) {
+	if isDirectThread(r.ThreadId) {
+		return member, ErrDirectThread
+	}
+
+	thread := Thread{Record: Rec(r.ThreadId)}
+	member = ThreadMember{MailboxId: r.MailboxId, Role: RoleMember}
+	if err = thread.AddMember(&member); err != nil {
+		return
+	}
+
+	if err = r.Delete(); err != nil {
+		return
+	}
+	Stream.AnnounceEvent("threadmember-approve-"+r.ThreadId, r)
+	return
+}
+
+// Function Deny removes the request without adding the mailbox
+func (r *JoinRequest) Deny() error {
+	if err := r.Delete(); err != nil {
+		return err
+	}
+	return Stream.AnnounceEvent("threadmember-deny-"+r.ThreadId, r)
+}
+
+// Function JoinRequests lists the pending requests to join the thread
+func (t *Thread) JoinRequests() (requests []JoinRequest, err error) {
+	requests = []JoinRequest{}
+	err = PostgresDb.Select(&requests, `
+		select * from thread_join_requests where thread_id = $1 order by createdat
+	`, t.Id)
+	return
+}
+
+// Function Join adds the mailbox to an open thread with default member
+// permissions. The thread must have been loaded to know its join policy
+func (mb *Mailbox) Join(t *Thread) (member ThreadMember, err error) {
+	if t.Direct {
+		return member, ErrDirectThread
+	} else if t.JoinPolicy != JoinOpen {
+		return member, errors.New("Thread is not open to join")
+	} else if _, err = t.GetMember(mb.Id); err == nil {
+		return member, errors.New("Mailbox is already a member of the thread")
+	}
+
+	member = ThreadMember{MailboxId: mb.Id, Role: RoleMember}
+	err = t.AddMember(&member)
+	return
+}
+
+// Function RequestToJoin files a request to join a thread that takes
+// requests. If the mailbox already has one pending, that one is returned
+func (mb *Mailbox) RequestToJoin(t *Thread, note string) (request JoinRequest, err error) {
+	if t.Direct {
+		return request, ErrDirectThread
+	} else if t.JoinPolicy != JoinOnRequest {
+		return request, errors.New("Thread does not take join requests")
+	} else if _, err = t.GetMember(mb.Id); err == nil {
+		return request, errors.New("Mailbox is already a member of the thread")
+	}
+
+	rx := []JoinRequest{}
+	err = PostgresDb.Select(&rx, "select * from thread_join_requests where thread_id = $1 and mailbox_id = $2", t.Id, mb.Id)
+	if err != nil {
+		return
+	} else if len(rx) > 0 {
+		return rx[0], nil
+	}
+
+	request = JoinRequest{ThreadId: t.Id, MailboxId: mb.Id, Note: note}
+	err = request.Insert()
+	return
+}
@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestParseJoinPolicy(t *testing.T) {
+	if p, err := ParseJoinPolicy(""); err != nil || p != JoinInviteOnly {
+		t.Fatal("Error: blank join policy should be invite-only but got", p, err)
+	}
+
+	if p, err := ParseJoinPolicy("open"); err != nil || p != JoinOpen {
+		t.Fatal("Error parsing open join policy:", p, err)
+	}
+
+	if _, err := ParseJoinPolicy("anyone"); err == nil {
+		t.Fatal("Error: invalid join policy was parsed")
+	}
+}
+
+func TestJoinThread(t *testing.T) {
+	owner, joiner := testMailbox(t), testMailbox(t)
+	thread := testThread(t, "join test")
+
+	if err := thread.AddMember(&ThreadMember{MailboxId: owner.Id, Role: RoleOwner}); err != nil {
+		t.Fatal("Error adding thread owner:", err)
+	}
+
+	if thread.JoinPolicy != JoinInviteOnly || joiner.Can(ActionJoin, thread) {
+		t.Fatal("Error: new threads should be invite-only but got", thread.JoinPolicy)
+	}
+
+	if joiner.AuthorizeUpdate(thread, Thread{Record: thread.Record, JoinPolicy: JoinOpen}) == nil {
+		t.Fatal("Error: mailbox outside the thread could open it")
+	}
+
+	thread.JoinPolicy = JoinOpen
+	if err := thread.Update(); err != nil {
+		t.Fatal("Error opening thread:", err)
+	}
+
+	if !joiner.Can(ActionJoin, thread) {
+		t.Fatal("Error: mailbox can not join open thread")
+	}
+
+	member, err := joiner.Join(&thread)
+	if err != nil || member.Role != RoleMember || !member.AllowRead || !member.AllowWrite {
+		t.Fatal("Error: expected joiner to be a member with default permissions but got", member, err)
+	}
+
+	if _, err := joiner.Join(&thread); err == nil {
+		t.Fatal("Error: mailbox joined a thread twice")
+	}
+
+	if err := member.Remove(); err != nil {
+		t.Fatal("Error removing member:", err)
+	}
+
+	if _, err := joiner.RequestToJoin(&thread, "hi"); err == nil {
+		t.Fatal("Error: open thread took a join request")
+	}
+
+	thread.JoinPolicy = JoinOnRequest
+	if err := thread.Update(); err != nil {
+		t.Fatal("Error updating join policy:", err)
+	}
+
+	request, err := joiner.RequestToJoin(&thread, "let me in")
+	if err != nil {
+		t.Fatal("Error filing join request:", err)
+	}
+
+	if again, err := joiner.RequestToJoin(&thread, "please"); err != nil || again.Id != request.Id {
+		t.Fatal("Error: expected the pending request again but got", again, err)
+	}
+
+	if joiner.Can(ActionUpdate, request) || !owner.Can(ActionUpdate, request) {
+		t.Fatal("Error: only thread admins should decide join requests")
+	}
+
+	requests, err := thread.JoinRequests()
+	if err != nil || len(requests) != 1 || requests[0].Note != "let me in" {
+		t.Fatal("Error: expected one pending join request but got", requests, err)
+	}
+
+	if err := request.Deny(); err != nil {
+		t.Fatal("Error denying join request:", err)
+	}
+
+	if _, err := thread.GetMember(joiner.Id); err == nil {
+		t.Fatal("Error: denied mailbox was added to the thread")
+	}
+
+	request, err = joiner.RequestToJoin(&thread, "")
+	if err != nil {
+		t.Fatal("Error filing join request:", err)
+	}
+
+	if member, err = request.Approve(); err != nil || member.MailboxId != joiner.Id {
+		t.Fatal("Error approving join request:", member, err)
+	}
+
+	if requests, err = thread.JoinRequests(); err != nil || len(requests) != 0 {
+		t.Fatal("Error: approved request is still pending", requests, err)
+	}
+}
@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/omarqazi/hearst/auth"
+	"github.com/pborman/uuid"
+	"time"
+)
+
+const keyRingCacheLocation = "hearst-env-server-key-ring"
+const keyRingLockLocation = "hearst-env-server-key-ring-lock"
+
+// Longest a server holds the key ring lock, in case it dies while holding it
+const keyRingLockTimeout = 30 * time.Second
+
+var ErrKeyRingLocked = errors.New("another server is changing the key ring")
+
+// Before the key ring existed the server kept a single key here
+const legacyKeyCacheLocation = "hearst-env-server-session-key"
+
+// Function LoadKeyRing reads the server key ring from redis. If there is no
+// ring yet but there is a key from before key rings, that key is imported
+// so sessions it signed keep working. The ring may be empty
+func LoadKeyRing() (kr auth.KeyRing, err error) {
+	kr = auth.KeyRing{}
+	ringJSON, err := RedisDb.Get(keyRingCacheLocation).Result()
+	if err == nil {
+		err = json.Unmarshal([]byte(ringJSON), &kr)
+		return
+	}
+
+	legacyKeyString, erx := RedisDb.Get(legacyKeyCacheLocation).Result()
+	if erx != nil {
+		return kr, nil // no keys at all
+	}
+
+	legacyKey, err := auth.PrivateKeyFromString(legacyKeyString)
+	if err != nil {
+		return
+	}
+
+	sk := auth.ServerKey{Signer: legacyKey}
+	if sk.Id, err = auth.KeyId(legacyKey.Public()); err != nil {
+		return
+	}
+
+	kr = append(kr, sk)
+	return
+}
+
+// Function SaveKeyRing writes the server key ring to redis
+func SaveKeyRing(kr auth.KeyRing) error {
+	ringJSON, err := json.Marshal(kr)
+	if err != nil {
+		return err
+	}
+
+	return RedisDb.Set(keyRingCacheLocation, string(ringJSON), 0).Err()
+}
+
+// Function LockKeyRing takes the lock that keeps servers from changing the
+// key ring at the same time, so one server can not overwrite the key another
+// just added. It returns ErrKeyRingLocked if another server holds the lock,
+// and otherwise a function that releases it
+func LockKeyRing() (unlock func(), err error) {
+	token := uuid.New()
+	locked, err := RedisDb.SetNX(keyRingLockLocation, token, keyRingLockTimeout).Result()
+	if err != nil {
+		return nil, err
+	} else if !locked {
+		return nil, ErrKeyRingLocked
+	}
+
+	return func() { // only release the lock if it has not timed out and been taken by another server
+		RedisDb.Eval(`
+			if redis.call("get", KEYS[1]) == ARGV[1] then
+				return redis.call("del", KEYS[1])
+			end
+			return 0
+		`, []string{keyRingLockLocation}, []string{token})
+	}, nil
+}
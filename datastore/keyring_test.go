@@ -0,0 +1,31 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestKeyRingRoundTrip(t *testing.T) {
+	kr, err := LoadKeyRing()
+	if err != nil {
+		t.Fatal("Error loading key ring:", err)
+	}
+
+	if err := SaveKeyRing(kr); err != nil {
+		t.Fatal("Error saving key ring:", err)
+	}
+
+	loaded, err := LoadKeyRing()
+	if err != nil {
+		t.Fatal("Error loading saved key ring:", err)
+	}
+
+	if len(loaded) != len(kr) {
+		t.Fatal("Expected", len(kr), "keys but loaded", len(loaded))
+	}
+
+	for i := range kr {
+		if loaded[i].Id != kr[i].Id {
+			t.Fatal("Expected key", kr[i].Id, "but loaded", loaded[i].Id)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package datastore
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"errors"
 	"github.com/omarqazi/hearst/auth"
 	"time"
@@ -9,31 +9,32 @@ import (
 
 type Mailbox struct {
 	Record
+	Profile
 	ConnectedAt time.Time
-	PublicKey   string `db:"public_key"`
-	DeviceId    string `db:"device_id"`
+	PublicKey   string     `db:"public_key"`
+	DeviceId    string     `db:"device_id"`
+	Scope       auth.Scope `db:"-" json:"-"` // limits of the session the mailbox was authorized with
+	SessionId   string     `db:"-" json:"-"` // id of the session the mailbox was authorized with
+	Device      *Device    `db:"-" json:"-"` // device that signed the session, nil for the mailbox key
 }
 
+const previousKeyPrefix = "hearst-previous-mailbox-key-"
+
 func NewMailbox() (mb Mailbox) {
 	mb.RequireId()
 	return
 }
 
-func NewMailboxWithKey() (Mailbox, *rsa.PrivateKey, error) {
-	mb := NewMailbox()
-
-	clientKey, err := auth.GeneratePrivateKey(2048)
-	if err != nil {
-		return mb, nil, err
-	}
-
-	pubKey, err := auth.StringForPublicKey(&clientKey.PublicKey)
-	if err != nil {
-		return mb, clientKey, err
-	}
+func NewMailboxWithKey() (Mailbox, crypto.Signer, error) {
+	return NewMailboxWithKeyType(auth.KeyTypeRSA)
+}
 
-	mb.PublicKey = pubKey
-	return mb, clientKey, nil
+// Function NewMailboxWithKeyType creates a new mailbox with a freshly
+// generated key of the given type (see the auth.KeyType constants)
+func NewMailboxWithKeyType(keyType string) (Mailbox, crypto.Signer, error) {
+	mb := NewMailbox()
+	clientKey, err := mb.GenerateNewKeyOfType(keyType)
+	return mb, clientKey, err
 }
 
 // Function GetMailbox retrieves a Mailbox
@@ -46,16 +47,29 @@ func GetMailbox(uuid string) (mb Mailbox, err error) {
 
 // Function GenerateNewKey generates a new private key and sets the mailboxes
 // public key to match. It returns the newly generated private key
-func (mb *Mailbox) GenerateNewKey() (key *rsa.PrivateKey, err error) {
-	if key, err = auth.GeneratePrivateKey(2048); err != nil { // generate a new key
+func (mb *Mailbox) GenerateNewKey() (key crypto.Signer, err error) {
+	key, err = mb.GenerateNewKeyOfType(auth.KeyTypeRSA)
+	return
+}
+
+// Function GenerateNewKeyOfType works like GenerateNewKey but lets the caller
+// pick an RSA, ECDSA or Ed25519 key
+func (mb *Mailbox) GenerateNewKeyOfType(keyType string) (key crypto.Signer, err error) {
+	if key, err = auth.GenerateKey(keyType); err != nil { // generate a new key
 		return
 	}
 
-	mb.PublicKey, err = auth.StringForPublicKey(&key.PublicKey)
+	mb.PublicKey, err = auth.StringForPublicKey(key.Public())
 	return
 }
 
-func (mb *Mailbox) SessionToken(duration time.Duration, mailboxKey *rsa.PrivateKey, serverSessionKey *rsa.PrivateKey) (string, error) {
+func (mb *Mailbox) SessionToken(duration time.Duration, mailboxKey crypto.Signer, serverSessionKey crypto.Signer) (string, error) {
+	return mb.ScopedSessionToken(duration, auth.Scope{}, mailboxKey, serverSessionKey)
+}
+
+// Function ScopedSessionToken returns a session string that
+// can only be used within the limits of scope
+func (mb *Mailbox) ScopedSessionToken(duration time.Duration, scope auth.Scope, mailboxKey crypto.Signer, serverSessionKey crypto.Signer) (string, error) {
 	token, err := auth.NewToken(serverSessionKey)
 	if err != nil {
 		return "", err
@@ -64,6 +78,7 @@ func (mb *Mailbox) SessionToken(duration time.Duration, mailboxKey *rsa.PrivateK
 	session := auth.Session{
 		Token:    token,
 		Duration: duration,
+		Scope:    scope,
 	}
 	sigBytes, err := session.SignatureFor(mailboxKey)
 	if err != nil {
@@ -78,9 +93,19 @@ func (mb *Mailbox) SessionToken(duration time.Duration, mailboxKey *rsa.PrivateK
 // to add the mailbox to the database
 func (mb *Mailbox) Insert() error {
 	mb.RequireId()
+	if err := mb.Profile.validate(); err != nil {
+		return err
+	}
+
+	if err := mb.checkHandle(mb.Handle); err != nil {
+		return err
+	}
 
 	tx := PostgresDb.MustBegin()
-	tx.NamedExec("insert into mailboxes (id, createdat, updatedat, connectedat, public_key, device_id) VALUES (:id, now(), now(), now(), :public_key, :device_id)", mb)
+	tx.NamedExec(`
+		insert into mailboxes (id, createdat, updatedat, connectedat, public_key, device_id, handle, display_name, avatar, profile)
+		VALUES (:id, now(), now(), now(), :public_key, :device_id, :handle, :display_name, :avatar, :profile)
+	`, mb)
 	err := tx.Commit()
 	Stream.AnnounceEvent("mailbox-insert-"+mb.Id, mb)
 	return err
@@ -98,20 +123,60 @@ func (mb *Mailbox) Load() error {
 		mb.PublicKey = mdb.PublicKey
 		mb.DeviceId = mdb.DeviceId
 		mb.Record = mdb.Record
+		mb.Profile = mdb.Profile
 		return nil
 	}
 
 	return errors.New("No mailbox found with that UUID")
 }
 
+// Function Update saves changes to the mailbox. The public key
+// is not changed, use RotateKey for that
 func (mb *Mailbox) Update() (err error) {
 	err = mb.ExecuteUpdateQuery(`
 		update mailboxes set updatedat = now(), connectedat = now(),
-		public_key = :public_key, device_id = :device_id where id = :id;
+		device_id = :device_id where id = :id;
 	`)
 	return
 }
 
+// Function RotateKey replaces the public key of the mailbox. The old key
+// keeps working for gracePeriod, so sessions signed with it do not stop
+// immediately. Callers must check the rotation was signed by the old key
+func (mb *Mailbox) RotateKey(publicKey string, gracePeriod time.Duration) error {
+	previousKey := mb.PublicKey
+	mb.PublicKey = publicKey
+	if err := mb.ExecuteUpdateQuery("update mailboxes set updatedat = now(), public_key = :public_key where id = :id;"); err != nil {
+		return err
+	}
+
+	if gracePeriod > auth.MaxKeyGracePeriod {
+		gracePeriod = auth.MaxKeyGracePeriod
+	}
+
+	if gracePeriod <= 0 || previousKey == "" {
+		return RedisDb.Del(previousKeyPrefix + mb.Id).Err()
+	}
+	return RedisDb.Set(previousKeyPrefix+mb.Id, previousKey, gracePeriod).Err()
+}
+
+// Function PublicKeys returns the keys sessions for the mailbox may be
+// signed with: the current key, and the previous key during its grace period
+func (mb *Mailbox) PublicKeys() (keys []crypto.PublicKey, err error) {
+	current, err := auth.PublicKeyFromString(mb.PublicKey)
+	if err != nil {
+		return
+	}
+	keys = append(keys, current)
+
+	if previousKey, err := RedisDb.Get(previousKeyPrefix + mb.Id).Result(); err == nil {
+		if previous, err := auth.PublicKeyFromString(previousKey); err == nil {
+			keys = append(keys, previous)
+		}
+	}
+	return keys, nil
+}
+
 func (mb *Mailbox) StillConnected() (err error) {
 	err = mb.ExecuteUpdateQuery("update mailboxes set updatedat = now(), connectedat = now() where id = :id;")
 	return
@@ -138,6 +203,9 @@ func (mb *Mailbox) Delete() error {
 	tx.NamedExec(`
 		delete from mailboxes where id = :id;
 	`, mb)
+	tx.NamedExec(`
+		delete from mailbox_devices where mailbox_id = :id;
+	`, mb)
 	err := tx.Commit()
 	Stream.AnnounceEvent("mailbox-delete-"+mb.Id, mb)
 	return err
@@ -149,30 +217,53 @@ func (mb *Mailbox) GetAllThreadMembers() (members []ThreadMember, err error) {
 	return
 }
 
+// Function RecentThreads lists the threads the mailbox is in, directly or
+// through its groups, that were updated after lastUpdated
 func (mb *Mailbox) RecentThreads(lastUpdated time.Time, limit int, offset int) (threads []Thread, err error) {
 	threads = []Thread{}
 	err = PostgresDb.Select(&threads, `
-		select threads.* from thread_members
-		 inner join threads on thread_members.thread_id = threads.id
-		 where thread_members.mailbox_id = $1 
-		 and threads.updatedat > $2
-		 order by threads.updatedat desc
+		select * from threads where id in (
+			select thread_id from thread_members where mailbox_id = $1
+			union
+			select thread_groups.thread_id from thread_groups
+			 inner join group_members on group_members.group_id = thread_groups.group_id
+			 where group_members.mailbox_id = $1
+		 )
+		 and updatedat > $2
+		 order by updatedat desc
 		 limit $3 offset $4
 	`, mb.Id, lastUpdated, limit, offset)
 	return
 }
 
-func (mb Mailbox) PermissionThreadId() string {
-	return "" // Permissions are unlimited
+// Mailboxes are public, but only the mailbox itself may change them.
+// Sessions limited to some threads can not create new mailboxes
+func (mb Mailbox) Policy() Policy {
+	return Policy{
+		OwnerId: mb.Id,
+		Rules: map[Action][]Requirement{
+			ActionRead:   {Anyone},
+			ActionCreate: {RequireUnscoped},
+			ActionUpdate: {RequireOwner | RequireUnscoped},
+			ActionDelete: {RequireOwner | RequireUnscoped},
+			ActionList:   {RequireOwner},
+		},
+	}
 }
 
+// Function CanRead returns true if the mailbox may read the thread. A blank
+// thread id refers to objects that are not part of a thread, like mailboxes
 func (mb *Mailbox) CanRead(threadId string) bool {
 	if threadId == "" {
 		return true
 	}
 
+	if !mb.Scope.AllowsThread(threadId) {
+		return false
+	}
+
 	dbThread := Thread{Record: Rec(threadId)}
-	member, err := dbThread.GetMember(mb.Id)
+	member, err := dbThread.Access(mb.Id)
 	if err != nil || !member.AllowRead {
 		return false
 	}
@@ -180,13 +271,23 @@ func (mb *Mailbox) CanRead(threadId string) bool {
 	return true
 }
 
+// Function CanWrite returns true if the mailbox may write to the thread.
+// Sessions with a restricted scope can not write outside of a thread
 func (mb *Mailbox) CanWrite(threadId string) bool {
+	if mb.Scope.ReadOnly {
+		return false
+	}
+
 	if threadId == "" {
-		return true
+		return !mb.Scope.Restricted()
+	}
+
+	if !mb.Scope.AllowsThread(threadId) {
+		return false
 	}
 
 	dbThread := Thread{Record: Rec(threadId)}
-	member, err := dbThread.GetMember(mb.Id)
+	member, err := dbThread.Access(mb.Id)
 	if err != nil || !member.AllowWrite {
 		return false
 	}
@@ -194,16 +295,80 @@ func (mb *Mailbox) CanWrite(threadId string) bool {
 	return true
 }
 
+// Function CanReadTopic returns true if the mailbox may read
+// messages with the topic in the thread
+func (mb *Mailbox) CanReadTopic(threadId string, topic string) bool {
+	if !mb.Scope.AllowsThread(threadId) {
+		return false
+	}
+
+	dbThread := Thread{Record: Rec(threadId)}
+	member, err := dbThread.Access(mb.Id)
+	return err == nil && member.AllowRead && member.ReadsTopic(topic)
+}
+
+// Function CanWriteTopic returns true if the mailbox may write
+// messages with the topic to the thread
+func (mb *Mailbox) CanWriteTopic(threadId string, topic string) bool {
+	if mb.Scope.ReadOnly || !mb.Scope.AllowsThread(threadId) {
+		return false
+	}
+
+	dbThread := Thread{Record: Rec(threadId)}
+	member, err := dbThread.Access(mb.Id)
+	return err == nil && member.AllowWrite && member.WritesTopic(topic)
+}
+
 func (mb *Mailbox) CanFollow(threadId string) bool {
 	if threadId == "" {
 		return true
 	}
 
+	if !mb.Scope.AllowsThread(threadId) {
+		return false
+	}
+
 	dbThread := Thread{Record: Rec(threadId)}
-	member, err := dbThread.GetMember(mb.Id)
+	member, err := dbThread.Access(mb.Id)
 	if err != nil || !member.AllowNotification {
 		return false
 	}
 
 	return true
 }
+
+// Function InScope returns true if the session scope allows seeing the
+// message. Unlike Authorize it does not check thread membership
+func (mb *Mailbox) InScope(m *Message) bool {
+	return mb.Scope.AllowsThread(m.ThreadId) && mb.Scope.AllowsTopic(m.Topic)
+}
+
+// Function ScopeMessages removes messages outside the session scope
+func (mb *Mailbox) ScopeMessages(mx []Message) []Message {
+	if !mb.Scope.Restricted() {
+		return mx
+	}
+
+	scoped := []Message{}
+	for i := range mx {
+		if mb.InScope(&mx[i]) {
+			scoped = append(scoped, mx[i])
+		}
+	}
+	return scoped
+}
+
+// Function ScopeThreads removes threads outside the session scope
+func (mb *Mailbox) ScopeThreads(threads []Thread) []Thread {
+	if len(mb.Scope.Threads) == 0 {
+		return threads
+	}
+
+	scoped := []Thread{}
+	for _, t := range threads {
+		if mb.Scope.AllowsThread(t.Id) {
+			scoped = append(scoped, t)
+		}
+	}
+	return scoped
+}
@@ -82,6 +82,65 @@ func TestMailboxUpdate(t *testing.T) {
 	}
 }
 
+func TestMailboxRotateKey(t *testing.T) {
+	mb, _, err := NewMailboxWithKeyType(auth.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating mailbox:", err)
+	}
+
+	if err := mb.Insert(); err != nil {
+		t.Fatal("Error inserting mailbox:", err)
+	}
+	defer mb.Delete()
+
+	previousKey := mb.PublicKey
+	newKey, err := auth.GenerateKey(auth.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating new key:", err)
+	}
+
+	newPublicKey, err := auth.StringForPublicKey(newKey.Public())
+	if err != nil {
+		t.Fatal("Error encoding new key:", err)
+	}
+
+	// Update must not be able to change the key
+	mb.PublicKey = newPublicKey
+	if err := mb.Update(); err != nil {
+		t.Fatal("Error updating mailbox:", err)
+	}
+
+	if mbx, _ := GetMailbox(mb.Id); mbx.PublicKey != previousKey {
+		t.Fatal("Error: Update changed the mailbox public key")
+	}
+
+	mb.PublicKey = previousKey
+	if err := mb.RotateKey(newPublicKey, 1*time.Minute); err != nil {
+		t.Fatal("Error rotating mailbox key:", err)
+	}
+
+	mbx, err := GetMailbox(mb.Id)
+	if err != nil {
+		t.Fatal("Error getting mailbox after key rotation:", err)
+	}
+
+	if mbx.PublicKey != newPublicKey {
+		t.Fatal("Error: expected rotated public key but got", mbx.PublicKey)
+	}
+
+	if keys, err := mbx.PublicKeys(); err != nil || len(keys) != 2 {
+		t.Fatal("Error: expected the new and the previous key during the grace period but got", keys, err)
+	}
+
+	if err := mbx.RotateKey(previousKey, 0); err != nil {
+		t.Fatal("Error rotating mailbox key:", err)
+	}
+
+	if keys, err := mbx.PublicKeys(); err != nil || len(keys) != 1 {
+		t.Fatal("Error: expected only the current key without a grace period but got", keys, err)
+	}
+}
+
 // mb.StillConnected should update the UpdatedAt and ConnectedAt fields,
 // but not any other fields.
 func TestMailboxStillConnected(t *testing.T) {
@@ -327,6 +386,57 @@ func TestCanMethods(t *testing.T) {
 	}
 }
 
+func TestScopedCanMethods(t *testing.T) {
+	mb := Mailbox{}
+	if err := mb.Insert(); err != nil {
+		t.Fatal("Could not insert mailbox when testing scoped Can methods", err)
+	}
+
+	thread, otherThread := Thread{}, Thread{}
+	for _, th := range []*Thread{&thread, &otherThread} {
+		if err := th.Insert(); err != nil {
+			t.Fatal("Could not insert thread when testing scoped Can methods", err)
+		}
+
+		member := &ThreadMember{MailboxId: mb.Id, ThreadId: th.Id, AllowRead: true, AllowWrite: true, AllowNotification: true}
+		if err := th.AddMember(member); err != nil {
+			t.Fatal("Error adding thread member", err)
+		}
+	}
+
+	mb.Scope = auth.Scope{Threads: []string{thread.Id}, Topics: []string{"telemetry.*"}}
+	if !mb.CanRead(thread.Id) || !mb.CanWrite(thread.Id) || !mb.CanFollow(thread.Id) {
+		t.Fatal("Error: scoped mailbox can not access thread in its scope")
+	}
+
+	if mb.CanRead(otherThread.Id) || mb.CanWrite(otherThread.Id) || mb.CanFollow(otherThread.Id) {
+		t.Fatal("Error: scoped mailbox can access thread outside of its scope")
+	}
+
+	if mb.CanWrite("") {
+		t.Fatal("Error: scoped mailbox can write objects outside of a thread")
+	}
+
+	inTopic := Message{ThreadId: thread.Id, SenderMailboxId: mb.Id, Topic: "telemetry.gps"}
+	outOfTopic := Message{ThreadId: thread.Id, SenderMailboxId: mb.Id, Topic: "chat"}
+	if !mb.Can(ActionRead, &inTopic) || !mb.Can(ActionCreate, &inTopic) {
+		t.Fatal("Error: scoped mailbox can not access message with topic in its scope")
+	}
+
+	if mb.Can(ActionRead, &outOfTopic) || mb.Can(ActionCreate, &outOfTopic) {
+		t.Fatal("Error: scoped mailbox can access message with topic outside of its scope")
+	}
+
+	if scoped := mb.ScopeMessages([]Message{inTopic, outOfTopic}); len(scoped) != 1 {
+		t.Fatal("Error: expected ScopeMessages to keep 1 message but got", len(scoped))
+	}
+
+	mb.Scope = auth.Scope{ReadOnly: true}
+	if !mb.CanRead(otherThread.Id) || mb.CanWrite(otherThread.Id) {
+		t.Fatal("Error: read only mailbox should be able to read but not write")
+	}
+}
+
 func CleanUpMailbox(t *testing.T) {
 	if testMailboxId != "" {
 		mb, err := GetMailbox(testMailboxId)
@@ -16,61 +16,100 @@ type Message struct {
 	CreatedAt       time.Time
 	UpdatedAt       time.Time   `json:"-"`
 	ExpiresAt       pq.NullTime `json:"-"`
+	ExpiresIn       int         `db:"-" json:",omitempty"` // seconds until the message expires, set by clients posting or changing it
 	Topic           string
 	Body            string
 	Labels          types.JSONText
 	Payload         types.JSONText
 	Index           int
+	Recipients      pq.StringArray // mailboxes that may read the message besides the sender, everyone in the thread if empty
+	Edited          bool           // the message was changed after it was posted
+	EditCount       int            `db:"edit_count"` // how many times the message was changed, and its number of revisions
 }
 
 // Get the latest N messages in the thread
 func (t *Thread) RecentMessages(limit int) (mx []Message, err error) {
 	mx = []Message{}
 	err = PostgresDb.Select(&mx, `
-		select * from (select * from messages where thread_id = $1 order by index desc limit $2) as sub order by index asc;
+		select * from (select * from messages where thread_id = $1 and `+unexpired+` order by index desc limit $2) as sub order by index asc;
 		`, t.Id, limit)
 	return
 }
 
 // Get the latest N messages in the thread with topic matching (LIKE) the topicFilter
-func (t *Thread) RecentMessagesWithTopic(topicFilter string, limit int) (mx []Message, err error) {
+// Only messages the reader may read are returned, all if reader is nil, and
+// only the ones matching the filter if it is not nil
+func (t *Thread) RecentMessagesWithTopic(topicFilter string, limit int, reader *ThreadMember, filter *JSONFilter) (mx []Message, err error) {
 	mx = []Message{}
 	if topicFilter == "" {
 		topicFilter = "%"
 	}
 
+	readTopics, readerId := readerArgs(reader)
+	labels, payload := filterArgs(filter)
 	err = PostgresDb.Select(&mx, `
-	select * from (select * from messages where thread_id = $1 and topic LIKE $2 order by index desc limit $3) as sub order by index asc;
-	`, t.Id, topicFilter, limit)
+	select * from (
+		select * from messages where thread_id = $1 and topic LIKE $2 and `+unexpired+`
+		and `+readableBy(4, 5)+` and `+containsFilter(6, 7)+` order by index desc limit $3
+	) as sub order by index asc;
+	`, t.Id, topicFilter, limit, readTopics, readerId, labels, payload)
 	return
 }
 
 // Get the latest N messages in the thread with topic matching (LIKE) the topicFilter
 // Return only messages with an index greater than lastSequence so we don't send messages we already have
-func (t *Thread) RecentMessagesSince(lastSequence int64, limit int, topicFilter string) (mx []Message, err error) {
+// and that the reader may read, all if reader is nil, and match the filter if it is not nil
+func (t *Thread) RecentMessagesSince(lastSequence int64, limit int, topicFilter string, reader *ThreadMember, filter *JSONFilter) (mx []Message, err error) {
 	mx = []Message{}
 	if topicFilter == "" {
 		topicFilter = "%"
 	}
 
+	readTopics, readerId := readerArgs(reader)
+	labels, payload := filterArgs(filter)
 	err = PostgresDb.Select(&mx, `
 	select * from (
-		select * from messages where thread_id = $1 and topic LIKE $2 and index > $3 order by index desc limit $4
+		select * from messages where thread_id = $1 and topic LIKE $2 and index > $3 and `+unexpired+`
+		and `+readableBy(5, 6)+` and `+containsFilter(7, 8)+` order by index desc limit $4
 	) as sub order by index asc;
-	`, t.Id, topicFilter, lastSequence, limit)
+	`, t.Id, topicFilter, lastSequence, limit, readTopics, readerId, labels, payload)
 	return
 }
 
 // Get the first N messages with index > lastSequence, topic LIKE topicFilter
-func (t *Thread) MessagesSince(lastSequence int64, limit int, topicFilter string) (mx []Message, err error) {
+// that the reader may read, all if reader is nil, and that match the filter if it is not nil
+func (t *Thread) MessagesSince(lastSequence int64, limit int, topicFilter string, reader *ThreadMember, filter *JSONFilter) (mx []Message, err error) {
 	mx = []Message{}
 	if topicFilter == "" {
 		topicFilter = "%"
 	}
 
+	readTopics, readerId := readerArgs(reader)
+	labels, payload := filterArgs(filter)
 	err = PostgresDb.Select(&mx, `
-	select * from messages where thread_id = $1 and index > $2 and topic LIKE $3 order by index asc limit $4;
-	`, t.Id, lastSequence, topicFilter, limit)
+	select * from messages where thread_id = $1 and index > $2 and topic LIKE $3 and `+unexpired+`
+	and `+readableBy(5, 6)+` and `+containsFilter(7, 8)+` order by index asc limit $4;
+	`, t.Id, lastSequence, topicFilter, limit, readTopics, readerId, labels, payload)
+	return
+}
+
+// Get the latest N messages with index < firstSequence and topic LIKE topicFilter, to page back
+// through the history of the thread. Only messages that the reader may read are returned, all if
+// reader is nil, and only the ones that match the filter if it is not nil
+func (t *Thread) MessagesBefore(firstSequence int64, limit int, topicFilter string, reader *ThreadMember, filter *JSONFilter) (mx []Message, err error) {
+	mx = []Message{}
+	if topicFilter == "" {
+		topicFilter = "%"
+	}
+
+	readTopics, readerId := readerArgs(reader)
+	labels, payload := filterArgs(filter)
+	err = PostgresDb.Select(&mx, `
+	select * from (
+		select * from messages where thread_id = $1 and topic LIKE $2 and index < $3 and `+unexpired+`
+		and `+readableBy(5, 6)+` and `+containsFilter(7, 8)+` order by index desc limit $4
+	) as sub order by index asc;
+	`, t.Id, topicFilter, firstSequence, limit, readTopics, readerId, labels, payload)
 	return
 }
 
@@ -107,15 +146,16 @@ func (m Message) JSONStringToObject(j []byte) ([]byte, error) {
 func (m *Message) Insert() error {
 	m.RequireId()
 	m.UnquoteJSON()
+	m.applyExpiresIn()
 	m.CreatedAt = time.Now()
 	thread := &Thread{Record: Rec(m.ThreadId)}
 	tx := PostgresDb.MustBegin()
 	sequenceName := thread.SequenceName()
 	query := fmt.Sprintf(`
 	insert into messages 
-		(id, thread_id, sender_mailbox_id, createdat, updatedat, expiresat, topic, body, labels, payload, index)
+		(id, thread_id, sender_mailbox_id, createdat, updatedat, expiresat, topic, body, labels, payload, index, recipients)
 	VALUES
-		(:id, :thread_id, :sender_mailbox_id, now(), now(), :expiresat, :topic, :body, :labels, :payload, nextval('%s'))
+		(:id, :thread_id, :sender_mailbox_id, now(), now(), :expiresat, :topic, :body, :labels, :payload, nextval('%s'), :recipients)
 	`, sequenceName)
 	_, err := tx.NamedExec(query, m)
 	if err != nil {
@@ -133,7 +173,11 @@ func (m *Message) Insert() error {
 	m.Load()
 	Stream.AnnounceEvent("message-insert-"+m.ThreadId, m)
 	if members, exx := thread.MembersToNotify(); exx == nil {
+		silenced := silencedBy(m.SenderMailboxId)
 		for _, member := range members {
+			if !member.ReadsTopic(m.Topic) || !m.IsRecipient(member.MailboxId) || silenced[member.MailboxId] {
+				continue
+			}
 			Stream.AnnounceEvent("message-notification-"+member.MailboxId, m)
 		}
 	}
@@ -143,7 +187,7 @@ func (m *Message) Insert() error {
 
 func (m *Message) Load() error {
 	mx := []Message{}
-	err := PostgresDb.Select(&mx, "select * from messages where id = $1", m.Id)
+	err := PostgresDb.Select(&mx, "select * from messages where id = $1 and "+unexpired, m.Id)
 	if err != nil {
 		return err
 	} else if len(mx) > 0 {
@@ -158,29 +202,47 @@ func (m *Message) Load() error {
 		m.Labels = mdb.Labels
 		m.Payload = mdb.Payload
 		m.Index = mdb.Index
+		m.Recipients = mdb.Recipients
+		m.Edited = mdb.Edited
+		m.EditCount = mdb.EditCount
 		return nil
 	}
 
 	return errors.New("No message found with that UUID")
 }
 
+// Function Update saves the changes to the message. The version it
+// replaces is kept in the revisions of the message, and sent with the
+// message-update event. The stored expiry is kept unless a new one is given,
+// and nil Recipients keep the stored recipients. Empty, non-nil Recipients
+// let everyone in the thread read the message
 func (m *Message) Update() error {
 	if m.Id == "" {
 		return m.Insert()
 	}
 	m.UnquoteJSON()
+	m.applyExpiresIn()
 
 	tx := PostgresDb.MustBegin()
-	_, err := tx.NamedExec(`
-		update messages set updatedat = now(), expiresat = :expiresat, topic = :topic, body = :body,
-		labels = :labels, payload = :payload where id = :id;
+	previous, err := m.saveRevision(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.NamedExec(`
+		update messages set updatedat = now(), expiresat = coalesce(:expiresat, expiresat), topic = :topic, body = :body,
+		labels = :labels, payload = :payload, recipients = coalesce(:recipients, recipients),
+		edited = true, edit_count = edit_count + 1 where id = :id;
 	`, m)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
 	err = tx.Commit()
-	Stream.AnnounceEvent("message-update-"+m.ThreadId, m)
+	m.Load()
+	Stream.AnnounceEvent("message-update-"+m.ThreadId, MessageUpdate{Message: *m, Previous: previous})
 	return err
 }
 
@@ -193,13 +255,52 @@ func (m *Message) Delete() error {
 	tx.NamedExec(`
 		delete from messages where id = :id;
 	`, m)
+	tx.NamedExec(`
+		delete from message_revisions where message_id = :id;
+	`, m)
 	err := tx.Commit()
 	Stream.AnnounceEvent("message-delete-"+m.ThreadId, m)
 	return err
 }
 
-func (m Message) PermissionThreadId() string {
-	return m.ThreadId
+// Messages can be read by the readers of their thread, or only by the
+// recipients of a whisper. Only the sender can post, change or delete
+// a message, while it can write
+func (m Message) Policy() Policy {
+	return Policy{
+		OwnerId:    m.SenderMailboxId,
+		ThreadId:   m.ThreadId,
+		Topic:      m.Topic,
+		HasTopic:   true,
+		Recipients: m.Recipients,
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireRead | RequireRecipient},
+			ActionCreate: {RequireOwner | RequireWrite},
+			ActionUpdate: {RequireOwner | RequireWrite},
+			ActionDelete: {RequireOwner | RequireWrite},
+		},
+	}
+}
+
+// Function IsWhisper returns true if only some members may read the message
+func (m Message) IsWhisper() bool {
+	return len(m.Recipients) > 0
+}
+
+// Function IsRecipient returns true if the mailbox receives the message,
+// either because it is not a whisper or because the mailbox is a recipient.
+// The sender of a whisper is not a recipient
+func (m Message) IsRecipient(mailboxId string) bool {
+	if !m.IsWhisper() {
+		return true
+	}
+
+	for _, recipient := range m.Recipients {
+		if recipient == mailboxId {
+			return true
+		}
+	}
+	return false
 }
 
 func (m *Message) RequireId() string {
@@ -172,7 +172,7 @@ func TestRecentMessagesWithTopic(t *testing.T) {
 		return
 	}
 
-	messages, err := tr.RecentMessagesWithTopic(originalTopic, 1000)
+	messages, err := tr.RecentMessagesWithTopic(originalTopic, 1000, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting recent messages with topic:", err)
 	}
@@ -181,7 +181,7 @@ func TestRecentMessagesWithTopic(t *testing.T) {
 		t.Fatal("Expected 60 messages with topic", originalTopic, "but got", len(messages))
 	}
 
-	messages, err = tr.RecentMessagesWithTopic(newTopic, 1000)
+	messages, err = tr.RecentMessagesWithTopic(newTopic, 1000, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting recent messages with topic:", err)
 	}
@@ -190,6 +190,15 @@ func TestRecentMessagesWithTopic(t *testing.T) {
 		t.Fatal("Expected 40 messages with topic", originalTopic, "but got", len(messages))
 	}
 
+	messages, err = tr.RecentMessagesWithTopic("", 1000, &ThreadMember{ReadTopics: []string{"location-*"}}, nil)
+	if err != nil {
+		t.Fatal("Error getting recent messages with read topics:", err)
+	}
+
+	if len(messages) != 40 {
+		t.Fatal("Expected 40 messages the member may read but got", len(messages))
+	}
+
 	CleanUpMessages(t)
 }
 
@@ -204,7 +213,7 @@ func TestMessagesSince(t *testing.T) {
 		return
 	}
 
-	messages, err := tr.MessagesSince(0, 1000, originalTopic)
+	messages, err := tr.MessagesSince(0, 1000, originalTopic, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting recent messages with topic:", err)
 	}
@@ -213,7 +222,7 @@ func TestMessagesSince(t *testing.T) {
 		t.Fatal("Expected 60 messages with topic", originalTopic, "but got", len(messages))
 	}
 
-	messages, err = tr.MessagesSince(0, 1000, newTopic)
+	messages, err = tr.MessagesSince(0, 1000, newTopic, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting recent messages with topic:", err)
 	}
@@ -222,7 +231,7 @@ func TestMessagesSince(t *testing.T) {
 		t.Fatal("Expected 40 messages with topic", originalTopic, "but got", len(messages))
 	}
 
-	messages, err = tr.MessagesSince(70, 1000, originalTopic)
+	messages, err = tr.MessagesSince(70, 1000, originalTopic, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting recent messages with topic:", err)
 	}
@@ -231,7 +240,7 @@ func TestMessagesSince(t *testing.T) {
 		t.Fatal("Expected less than 60 messages after providing sequence number but found", len(messages))
 	}
 
-	messages, err = tr.MessagesSince(70, 1000, newTopic)
+	messages, err = tr.MessagesSince(70, 1000, newTopic, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting messages since with topic:", err)
 	}
@@ -240,7 +249,7 @@ func TestMessagesSince(t *testing.T) {
 		t.Fatal("Expected less than 40 messages after providing sequence number but found", len(messages))
 	}
 
-	messages, err = tr.MessagesSince(70, 1000, "")
+	messages, err = tr.MessagesSince(70, 1000, "", nil, nil)
 	if err != nil {
 		t.Fatal("Error getting messages since without topic:", err)
 	}
@@ -249,6 +258,15 @@ func TestMessagesSince(t *testing.T) {
 		t.Fatal("Error: Expected exactly 30 messages but found", len(messages))
 	}
 
+	messages, err = tr.MessagesSince(0, 1000, "", &ThreadMember{ReadTopics: []string{"chat-*"}}, nil)
+	if err != nil {
+		t.Fatal("Error getting messages since with read topics:", err)
+	}
+
+	if len(messages) != 60 {
+		t.Fatal("Expected 60 messages the member may read but found", len(messages))
+	}
+
 	CleanUpMessages(t)
 }
 
@@ -263,7 +281,7 @@ func TestRecentMessagesSince(t *testing.T) {
 		return
 	}
 
-	messages, err := tr.RecentMessagesSince(0, 1000, originalTopic)
+	messages, err := tr.RecentMessagesSince(0, 1000, originalTopic, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting recent messages with topic:", err)
 	}
@@ -272,7 +290,7 @@ func TestRecentMessagesSince(t *testing.T) {
 		t.Fatal("Expected 60 messages with topic", originalTopic, "but got", len(messages))
 	}
 
-	messages, err = tr.RecentMessagesSince(0, 1000, newTopic)
+	messages, err = tr.RecentMessagesSince(0, 1000, newTopic, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting recent messages with topic:", err)
 	}
@@ -281,7 +299,7 @@ func TestRecentMessagesSince(t *testing.T) {
 		t.Fatal("Expected 40 messages with topic", originalTopic, "but got", len(messages))
 	}
 
-	messages, err = tr.RecentMessagesSince(70, 1000, originalTopic)
+	messages, err = tr.RecentMessagesSince(70, 1000, originalTopic, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting recent messages with topic:", err)
 	}
@@ -290,7 +308,7 @@ func TestRecentMessagesSince(t *testing.T) {
 		t.Fatal("Expected less than 60 messages after providing sequence number but found", len(messages))
 	}
 
-	messages, err = tr.RecentMessagesSince(70, 1000, newTopic)
+	messages, err = tr.RecentMessagesSince(70, 1000, newTopic, nil, nil)
 	if err != nil {
 		t.Fatal("Error getting messages since with topic:", err)
 	}
@@ -299,7 +317,7 @@ func TestRecentMessagesSince(t *testing.T) {
 		t.Fatal("Expected less than 40 messages after providing sequence number but found", len(messages))
 	}
 
-	messages, err = tr.RecentMessagesSince(70, 1000, "")
+	messages, err = tr.RecentMessagesSince(70, 1000, "", nil, nil)
 	if err != nil {
 		t.Fatal("Error getting messages since without topic:", err)
 	}
@@ -311,6 +329,34 @@ func TestRecentMessagesSince(t *testing.T) {
 	CleanUpMessages(t)
 }
 
+func TestMessagesBefore(t *testing.T) {
+	setupDualTopicTestMessages(t)
+	defer CleanUpMessages(t)
+
+	tr, err := GetThread(testThreadId)
+	if err != nil {
+		t.Fatal("Error getting thread for messages before:", err)
+	}
+
+	messages, err := tr.MessagesBefore(71, 20, "", nil, nil)
+	if err != nil {
+		t.Fatal("Error getting messages before sequence number:", err)
+	}
+
+	if len(messages) != 20 || messages[0].Index != 51 || messages[19].Index != 70 {
+		t.Fatal("Expected messages 51 through 70 in order but got", len(messages), "messages")
+	}
+
+	messages, err = tr.MessagesBefore(71, 1000, "location-update", nil, nil)
+	if err != nil {
+		t.Fatal("Error getting messages before with topic:", err)
+	}
+
+	if len(messages) != 10 {
+		t.Fatal("Error: Expected exactly 10 messages but found", len(messages))
+	}
+}
+
 func TestDeleteMessage(t *testing.T) {
 	TestInsertMessage(t)
 	defer CleanUpMessages(t)
@@ -364,3 +410,82 @@ func TestUnquoteJson(t *testing.T) {
 		t.Error("Expected labels to be unchanged object but got", message.Labels[0])
 	}
 }
+
+func TestWhisper(t *testing.T) {
+	sender, recipient, bystander := testMailbox(t), testMailbox(t), testMailbox(t)
+	thread := testThread(t, "whispers")
+
+	for _, mb := range []*Mailbox{&sender, &recipient, &bystander} {
+		if err := thread.AddMember(&ThreadMember{MailboxId: mb.Id, Role: RoleMember}); err != nil {
+			t.Fatal("Error adding thread member:", err)
+		}
+	}
+
+	whisper := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Recipients: []string{recipient.Id}}
+	shout := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat"}
+	testMessages(t, &whisper, &shout)
+
+	if dbWhisper, err := GetMessage(whisper.Id); err != nil || !dbWhisper.IsWhisper() {
+		t.Fatal("Error: whisper recipients were not saved", dbWhisper.Recipients, err)
+	}
+
+	if !sender.Can(ActionRead, whisper) || !recipient.Can(ActionRead, whisper) || bystander.Can(ActionRead, whisper) {
+		t.Fatal("Error: whisper should only be readable by its sender and recipients")
+	}
+
+	if !bystander.Can(ActionRead, shout) {
+		t.Fatal("Error: message without recipients should be readable by every member")
+	}
+
+	for _, mb := range []*Mailbox{&sender, &recipient, &bystander} {
+		expected := 2
+		if mb.Id == bystander.Id {
+			expected = 1
+		}
+
+		recent, err := thread.RecentMessagesWithTopic("", 100, mb.Member(thread.Id), nil)
+		if err != nil {
+			t.Fatal("Error getting recent messages:", err)
+		}
+
+		since, err := thread.MessagesSince(0, 100, "", mb.Member(thread.Id), nil)
+		if err != nil {
+			t.Fatal("Error getting messages since:", err)
+		}
+
+		if len(recent) != expected || len(since) != expected {
+			t.Fatal("Expected", expected, "messages but got", len(recent), "and", len(since))
+		}
+	}
+}
+
+func TestWhisperEditKeepsRecipients(t *testing.T) {
+	sender, recipient, bystander := testMailbox(t), testMailbox(t), testMailbox(t)
+	thread := testThread(t, "edited whispers")
+
+	for _, mb := range []*Mailbox{&sender, &recipient, &bystander} {
+		if err := thread.AddMember(&ThreadMember{MailboxId: mb.Id, Role: RoleMember}); err != nil {
+			t.Fatal("Error adding thread member:", err)
+		}
+	}
+
+	whisper := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "secret", Recipients: []string{recipient.Id}}
+	testMessages(t, &whisper)
+
+	// an edit from a client that leaves out the recipients
+	edit := Message{Id: whisper.Id, ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "still secret"}
+	edit.Labels.Scan("{}")
+	edit.Payload.Scan("{}")
+	if err := edit.Update(); err != nil {
+		t.Fatal("Error updating whisper:", err)
+	}
+
+	edited, err := GetMessage(whisper.Id)
+	if err != nil || !edited.IsWhisper() || edited.Body != "still secret" {
+		t.Fatal("Error: whisper edited without recipients is no longer a whisper", edited, err)
+	}
+
+	if !recipient.Can(ActionRead, edited) || bystander.Can(ActionRead, edited) {
+		t.Fatal("Error: edited whisper should only be readable by its sender and recipients")
+	}
+}
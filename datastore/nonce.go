@@ -0,0 +1,20 @@
+package datastore
+
+import (
+	"gopkg.in/redis.v3"
+	"time"
+)
+
+const spentNoncePrefix = "hearst-spent-nonce-"
+
+// RedisNonceStore implements auth.NonceStore by recording
+// spent token nonces in redis until they expire
+type RedisNonceStore struct {
+	Client *redis.Client
+}
+
+// Function SpendNonce atomically records the nonce and returns
+// false if it had already been recorded
+func (ns RedisNonceStore) SpendNonce(nonce string, expiration time.Duration) (bool, error) {
+	return ns.Client.SetNX(spentNoncePrefix+nonce, "1", expiration).Result()
+}
@@ -0,0 +1,29 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpendNonce(t *testing.T) {
+	store := RedisNonceStore{Client: RedisDb}
+	nonce := NewUUID()
+
+	fresh, err := store.SpendNonce(nonce, 1*time.Second)
+	if err != nil {
+		t.Fatal("Error spending nonce:", err)
+	}
+
+	if !fresh {
+		t.Fatal("Error: new nonce was reported as already spent")
+	}
+
+	fresh, err = store.SpendNonce(nonce, 1*time.Second)
+	if err != nil {
+		t.Fatal("Error spending nonce a second time:", err)
+	}
+
+	if fresh {
+		t.Fatal("Error: nonce could be spent twice")
+	}
+}
@@ -0,0 +1,195 @@
+package datastore
+
+import (
+	"errors"
+)
+
+// Action is something a mailbox can do to an object
+type Action string
+
+const (
+	ActionRead   Action = "read"
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+	ActionList   Action = "list" // list the objects that belong to this one, like the messages of a thread
+	ActionJoin   Action = "join" // become a member of the object, or ask to, without an invitation
+)
+
+// Requirement is a set of conditions a mailbox must all meet
+type Requirement int
+
+const (
+	RequireOwner       Requirement = 1 << iota // the mailbox owns the object
+	RequireRead                                // the mailbox may read the object's thread
+	RequireWrite                               // the mailbox may write to the object's thread
+	RequireUnscoped                            // the session is not limited to some threads or topics
+	RequireManage                              // the mailbox is an owner or admin of the thread who manages the object's role
+	RequireRecipient                           // the mailbox owns the object or is one of its recipients
+	RequireGroupMember                         // the mailbox is in the object's group
+	RequireGroupAdmin                          // the mailbox is an admin of the object's group
+	RequireUnblocked                           // the object's owner has not blocked the mailbox
+	RequireNotDirect                           // the object's thread is not a direct thread
+
+	Anyone Requirement = 0 // any signed in mailbox
+)
+
+var ErrNotAllowed = errors.New("not allowed")
+
+// Policy describes who may act on an object. Each action maps to a list of
+// requirements, and a mailbox may perform the action if it meets any one of
+// them. Actions that are not in Rules are not allowed at all
+type Policy struct {
+	OwnerId    string   // the mailbox that owns the object, if any
+	ThreadId   string   // the thread whose membership controls access, if any
+	GroupId    string   // the group whose membership controls access, if any
+	Topic      string   // the topic of the object, if HasTopic is set
+	HasTopic   bool     // the topic is checked against session scopes and member topics, even when blank
+	Role       Role     // the thread role the object has, if any
+	Recipients []string // the only mailboxes besides the owner that RequireRecipient allows, everyone if empty
+	Settings   string   // settings that only owners and admins may change, and nobody on direct threads, like the join policy of a thread
+	Rules      map[Action][]Requirement
+}
+
+// Authorizable objects declare their policy
+type Authorizable interface {
+	Policy() Policy
+}
+
+// Function Authorize returns nil if the mailbox may perform
+// the action on obj, and ErrNotAllowed otherwise
+func (mb *Mailbox) Authorize(action Action, obj Authorizable) error {
+	p := obj.Policy()
+	if action != ActionRead && action != ActionList && mb.Scope.ReadOnly {
+		return ErrNotAllowed
+	}
+
+	if (p.ThreadId != "" && !mb.Scope.AllowsThread(p.ThreadId)) || (p.HasTopic && !mb.Scope.AllowsTopic(p.Topic)) {
+		return ErrNotAllowed
+	}
+
+	for _, requirement := range p.Rules[action] {
+		if mb.meets(requirement, p) {
+			return nil
+		}
+	}
+	return ErrNotAllowed
+}
+
+// Function Can is a shortcut for Authorize that returns a bool
+func (mb *Mailbox) Can(action Action, obj Authorizable) bool {
+	return mb.Authorize(action, obj) == nil
+}
+
+// Function AuthorizeUpdate checks an update against the stored object, whose
+// owner and thread can be trusted, and the scope, role and settings of the
+// updated object
+func (mb *Mailbox) AuthorizeUpdate(stored Authorizable, updated Authorizable) error {
+	if err := mb.Authorize(ActionUpdate, stored); err != nil {
+		return err
+	}
+
+	p, sp := updated.Policy(), stored.Policy()
+	threadId := sp.ThreadId
+	if p.Settings != "" && p.Settings != sp.Settings && !mb.meets(RequireManage|RequireNotDirect, sp) {
+		return ErrNotAllowed
+	}
+
+	if p.HasTopic && (!mb.Scope.AllowsTopic(p.Topic) || !mb.CanWriteTopic(threadId, p.Topic)) {
+		return ErrNotAllowed
+	}
+
+	if p.Role != "" && !mb.ThreadRole(threadId).Manages(p.Role) {
+		return ErrNotAllowed
+	}
+	return nil
+}
+
+func (mb *Mailbox) meets(requirement Requirement, p Policy) bool {
+	if requirement&RequireOwner != 0 && (p.OwnerId == "" || p.OwnerId != mb.Id) {
+		return false
+	}
+
+	if requirement&RequireRead != 0 && (p.ThreadId == "" ||
+		(p.HasTopic && !mb.CanReadTopic(p.ThreadId, p.Topic)) || (!p.HasTopic && !mb.CanRead(p.ThreadId))) {
+		return false
+	}
+
+	if requirement&RequireWrite != 0 && (p.ThreadId == "" ||
+		(p.HasTopic && !mb.CanWriteTopic(p.ThreadId, p.Topic)) || (!p.HasTopic && !mb.CanWrite(p.ThreadId))) {
+		return false
+	}
+
+	if requirement&RequireUnscoped != 0 && mb.Scope.Restricted() {
+		return false
+	}
+
+	if requirement&RequireRecipient != 0 && !mb.isRecipient(p) {
+		return false
+	}
+
+	if requirement&RequireManage != 0 && (p.ThreadId == "" || !mb.ThreadRole(p.ThreadId).Manages(p.Role)) {
+		return false
+	}
+
+	if requirement&RequireUnblocked != 0 && p.OwnerId != "" && p.OwnerId != mb.Id {
+		owner := Mailbox{Record: Rec(p.OwnerId)}
+		if owner.HasBlocked(mb.Id) {
+			return false
+		}
+	}
+
+	if requirement&RequireNotDirect != 0 && (p.ThreadId == "" || isDirectThread(p.ThreadId)) {
+		return false
+	}
+
+	if requirement&(RequireGroupMember|RequireGroupAdmin) != 0 {
+		membership, err := mb.GroupMembership(p.GroupId)
+		if p.GroupId == "" || err != nil || (requirement&RequireGroupAdmin != 0 && !membership.Admin) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (mb *Mailbox) isRecipient(p Policy) bool {
+	if len(p.Recipients) == 0 || p.OwnerId == mb.Id {
+		return true
+	}
+
+	for _, recipient := range p.Recipients {
+		if recipient == mb.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// Function Stored loads the stored version of an object
+// using the identifying fields of obj
+func Stored(obj Recordable) (stored Recordable, err error) {
+	switch obj := obj.(type) {
+	case *Mailbox:
+		stored = &Mailbox{Record: Rec(obj.Id)}
+	case *Thread:
+		stored = &Thread{Record: Rec(obj.Id), Identifier: obj.Identifier}
+	case *Message:
+		stored = &Message{Id: obj.Id}
+	case *ThreadMember:
+		stored = &ThreadMember{ThreadId: obj.ThreadId, MailboxId: obj.MailboxId}
+	case *Device:
+		stored = &Device{Record: Rec(obj.Id)}
+	case *Group:
+		stored = &Group{Record: Rec(obj.Id)}
+	case *GroupMember:
+		stored = &GroupMember{GroupId: obj.GroupId, MailboxId: obj.MailboxId}
+	case *ThreadGroup:
+		stored = &ThreadGroup{ThreadId: obj.ThreadId, GroupId: obj.GroupId}
+	default:
+		return nil, errors.New("unknown object type")
+	}
+
+	err = stored.Load()
+	return
+}
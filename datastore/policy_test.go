@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"github.com/omarqazi/hearst/auth"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyMatrix(t *testing.T) {
+	owner, reader, outsider := testMailbox(t), testMailbox(t), testMailbox(t)
+	thread := testThread(t, "policy test")
+
+	ownerMember := ThreadMember{MailboxId: owner.Id, Role: RoleOwner}
+	readerMember := ThreadMember{MailboxId: reader.Id, AllowRead: true}
+	for _, member := range []*ThreadMember{&ownerMember, &readerMember} {
+		if err := thread.AddMember(member); err != nil {
+			t.Fatal("Error adding thread member when testing policies:", err)
+		}
+	}
+
+	message := Message{ThreadId: thread.Id, SenderMailboxId: owner.Id, Topic: "chat"}
+	device := Device{MailboxId: owner.Id, Name: "phone"}
+	invitation := Invitation{ThreadId: thread.Id, CreatorId: owner.Id, ExpiresAt: time.Now().Add(time.Hour)}
+
+	actors := map[string]*Mailbox{"owner": &owner, "reader": &reader, "outsider": &outsider}
+	cases := []struct {
+		name    string
+		obj     Authorizable
+		action  Action
+		allowed string
+	}{
+		{"mailbox", owner, ActionRead, "owner reader outsider"},
+		{"mailbox", owner, ActionCreate, "owner reader outsider"},
+		{"mailbox", owner, ActionUpdate, "owner"},
+		{"mailbox", owner, ActionDelete, "owner"},
+		{"mailbox", owner, ActionList, "owner"},
+		{"thread", thread, ActionRead, "owner reader"},
+		{"thread", thread, ActionCreate, "owner reader outsider"},
+		{"thread", thread, ActionUpdate, "owner"},
+		{"thread", thread, ActionDelete, "owner"},
+		{"thread", thread, ActionList, "owner reader"},
+		{"message", message, ActionRead, "owner reader"},
+		{"message", message, ActionCreate, "owner"},
+		{"message", message, ActionUpdate, "owner"},
+		{"message", message, ActionDelete, "owner"},
+		{"message", message, ActionList, ""},
+		{"threadmember", readerMember, ActionRead, "owner reader"},
+		{"threadmember", readerMember, ActionCreate, "owner"},
+		{"threadmember", readerMember, ActionUpdate, "owner"},
+		{"threadmember", readerMember, ActionDelete, "owner reader"},
+		{"threadmember", readerMember, ActionList, ""},
+		{"device", device, ActionRead, "owner"},
+		{"device", device, ActionCreate, "owner"},
+		{"device", device, ActionUpdate, "owner"},
+		{"device", device, ActionDelete, "owner"},
+		{"device", device, ActionList, ""},
+		{"invitation", invitation, ActionRead, "owner"},
+		{"invitation", invitation, ActionCreate, "owner"},
+		{"invitation", invitation, ActionUpdate, ""},
+		{"invitation", invitation, ActionDelete, "owner"},
+		{"invitation", invitation, ActionList, ""},
+	}
+
+	for _, c := range cases {
+		allowed := strings.Fields(c.allowed)
+		for name, mb := range actors {
+			expected := false
+			for _, a := range allowed {
+				expected = expected || a == name
+			}
+
+			if got := mb.Can(c.action, c.obj); got != expected {
+				t.Error("Error:", name, c.action, c.name, "should be", expected, "but got", got)
+			}
+		}
+	}
+}
+
+func TestPolicyScopes(t *testing.T) {
+	mb := NewMailbox()
+	if err := mb.Insert(); err != nil {
+		t.Fatal("Error inserting mailbox when testing policy scopes:", err)
+	}
+	defer mb.Delete()
+
+	thread, otherThread := Thread{}, Thread{}
+	for _, th := range []*Thread{&thread, &otherThread} {
+		if err := th.Insert(); err != nil {
+			t.Fatal("Error inserting thread when testing policy scopes:", err)
+		}
+		defer th.Delete()
+
+		member := &ThreadMember{MailboxId: mb.Id, AllowRead: true, AllowWrite: true, AllowNotification: true}
+		if err := th.AddMember(member); err != nil {
+			t.Fatal("Error adding thread member:", err)
+		}
+	}
+
+	inTopic := Message{ThreadId: thread.Id, SenderMailboxId: mb.Id, Topic: "telemetry.gps"}
+	outOfTopic := Message{ThreadId: thread.Id, SenderMailboxId: mb.Id, Topic: "chat"}
+
+	mb.Scope = auth.Scope{Threads: []string{thread.Id}, Topics: []string{"telemetry.*"}}
+	if !mb.Can(ActionUpdate, thread) || mb.Can(ActionRead, otherThread) {
+		t.Fatal("Error: thread scope not applied to threads")
+	}
+
+	if !mb.Can(ActionCreate, inTopic) || mb.Can(ActionRead, outOfTopic) {
+		t.Fatal("Error: topic scope not applied to messages")
+	}
+
+	if mb.AuthorizeUpdate(inTopic, outOfTopic) == nil {
+		t.Fatal("Error: scoped mailbox could move a message out of its topics")
+	}
+
+	if mb.Can(ActionUpdate, mb) || mb.Can(ActionCreate, Thread{}) || mb.Can(ActionCreate, Device{MailboxId: mb.Id}) {
+		t.Fatal("Error: scoped mailbox can change objects outside of a thread")
+	}
+
+	mb.Scope = auth.Scope{ReadOnly: true}
+	if !mb.Can(ActionRead, thread) || !mb.Can(ActionList, mb) {
+		t.Fatal("Error: read only mailbox can not read")
+	}
+
+	if mb.Can(ActionUpdate, thread) || mb.Can(ActionCreate, inTopic) || mb.Can(ActionDelete, mb) {
+		t.Fatal("Error: read only mailbox can write")
+	}
+}
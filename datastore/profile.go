@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/jmoiron/sqlx/types"
+	"regexp"
+	"strings"
+)
+
+// Profile is how a mailbox presents itself to others. Every field is optional
+type Profile struct {
+	Handle      string         // a unique name the mailbox can be found by
+	DisplayName string         `db:"display_name"`
+	Avatar      string         // a URL or other reference to the mailbox's picture
+	Fields      types.JSONText `db:"profile"` // any other profile fields, as a JSON object
+}
+
+// Largest size of the JSON profile fields, in bytes
+const MaxProfileFieldsSize = 8192
+
+var ErrHandleTaken = errors.New("handle is already taken")
+
+var handleRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,31}$`)
+
+// Function ParseHandle returns the handle in lower case, or an error if it
+// is not 3 to 32 letters, digits, dots, dashes or underscores starting with
+// a letter or digit. A blank handle means the mailbox has none
+func ParseHandle(handle string) (string, error) {
+	handle = strings.ToLower(strings.TrimPrefix(handle, "@"))
+	if handle != "" && !handleRegexp.MatchString(handle) {
+		return "", errors.New("invalid handle: " + handle)
+	}
+	return handle, nil
+}
+
+// Function validate normalizes the handle and checks the profile fields
+func (p *Profile) validate() (err error) {
+	if p.Handle, err = ParseHandle(p.Handle); err != nil {
+		return
+	}
+
+	if len(p.Fields) == 0 {
+		p.Fields = types.JSONText("{}")
+	} else if len(p.Fields) > MaxProfileFieldsSize {
+		return errors.New("profile fields are too large")
+	}
+
+	var fields map[string]interface{}
+	if json.Unmarshal(p.Fields, &fields) != nil {
+		return errors.New("profile fields must be a JSON object")
+	}
+	return nil
+}
+
+// Function GetMailboxByHandle finds the mailbox with the handle
+func GetMailboxByHandle(handle string) (mb Mailbox, err error) {
+	if handle, err = ParseHandle(handle); err != nil {
+		return
+	} else if handle == "" {
+		return mb, errors.New("No mailbox found with that handle")
+	}
+
+	mbx := []Mailbox{}
+	if err = PostgresDb.Unsafe().Select(&mbx, "select * from mailboxes where handle = $1", handle); err != nil {
+		return
+	} else if len(mbx) == 0 {
+		return mb, errors.New("No mailbox found with that handle")
+	}
+	return mbx[0], nil
+}
+
+// Function checkHandle returns ErrHandleTaken if another mailbox has the handle
+func (mb *Mailbox) checkHandle(handle string) error {
+	if handle == "" {
+		return nil
+	}
+
+	if owner, err := GetMailboxByHandle(handle); err == nil && owner.Id != mb.Id {
+		return ErrHandleTaken
+	}
+	return nil
+}
+
+// Function UpdateProfile replaces the profile of the mailbox
+// and announces the change to everyone following the mailbox
+func (mb *Mailbox) UpdateProfile(p Profile) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	if err := mb.checkHandle(p.Handle); err != nil {
+		return err
+	}
+
+	mb.Profile = p
+	tx := PostgresDb.MustBegin()
+	tx.NamedExec(`
+		update mailboxes set updatedat = now(), handle = :handle, display_name = :display_name,
+		avatar = :avatar, profile = :profile where id = :id;
+	`, mb)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return Stream.AnnounceEvent("mailbox-profile-"+mb.Id, mb)
+}
@@ -0,0 +1,49 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestParseHandle(t *testing.T) {
+	valid := map[string]string{"Omar": "omar", "@omar.q": "omar.q", "": "", "a_b-c": "a_b-c"}
+	for handle, expected := range valid {
+		if parsed, err := ParseHandle(handle); err != nil || parsed != expected {
+			t.Error("Error parsing handle", handle, "expected", expected, "but got", parsed, err)
+		}
+	}
+
+	for _, handle := range []string{"ab", "-omar", "omar qazi", "thishandleiswaytoolongtobeahandle!"} {
+		if _, err := ParseHandle(handle); err == nil {
+			t.Error("Error: invalid handle was parsed:", handle)
+		}
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	mb, other := testMailbox(t), testMailbox(t)
+
+	if err := mb.UpdateProfile(Profile{Handle: "ProfileTester", Avatar: "https://example.com/a.png"}); err != nil {
+		t.Fatal("Error updating profile:", err)
+	}
+
+	if err := other.UpdateProfile(Profile{Handle: "profiletester"}); err != ErrHandleTaken {
+		t.Fatal("Error: expected handle to be taken but got", err)
+	}
+
+	if err := other.UpdateProfile(Profile{Fields: []byte(`["not", "an", "object"]`)}); err == nil {
+		t.Fatal("Error: profile fields that are not an object were saved")
+	}
+
+	found, err := GetMailboxByHandle("@profiletester")
+	if err != nil || found.Id != mb.Id || found.Avatar != "https://example.com/a.png" {
+		t.Fatal("Error finding mailbox by handle:", found, err)
+	}
+
+	if err := mb.UpdateProfile(Profile{}); err != nil {
+		t.Fatal("Error clearing profile:", err)
+	}
+
+	if _, err := GetMailboxByHandle("profiletester"); err == nil {
+		t.Fatal("Error: found mailbox by a handle it gave up")
+	}
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"errors"
+	"gopkg.in/redis.v3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rateLimitPrefix = "hearst-rate-limit-"
+
+// RateLimit is a token bucket that holds Burst tokens and refills
+// completely over Period. Each request takes one token
+type RateLimit struct {
+	Burst  int64
+	Period time.Duration
+}
+
+// RateLimitBucket is the bucket with the given key, like
+// "message-mailbox-<id>", limited by Limit
+type RateLimitBucket struct {
+	Key   string
+	Limit RateLimit
+}
+
+// takeTokens refills the buckets in KEYS for the time since they were last
+// used and, only if every one of them has a token, takes a token from each.
+// ARGV is the current time in milliseconds followed by the burst and the
+// refill rate in tokens per millisecond of each bucket. It returns 1 if the
+// tokens were taken and the milliseconds until every bucket has one otherwise
+var takeTokens = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local buckets = {}
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local burst = tonumber(ARGV[i * 2])
+	local rate = tonumber(ARGV[i * 2 + 1])
+	local bucket = redis.call("HMGET", key, "tokens", "at")
+	local tokens = tonumber(bucket[1]) or burst
+	local at = tonumber(bucket[2]) or now
+	tokens = math.min(burst, tokens + math.max(0, now - at) * rate)
+	if tokens < 1 then
+		wait = math.max(wait, math.ceil((1 - tokens) / rate))
+	end
+	buckets[i] = {burst = burst, rate = rate, tokens = tokens}
+end
+
+local allowed = 0
+if wait == 0 then
+	allowed = 1
+end
+
+for i, key in ipairs(KEYS) do
+	local bucket = buckets[i]
+	local tokens = bucket.tokens - allowed
+	redis.call("HMSET", key, "tokens", tostring(tokens), "at", tostring(now))
+	redis.call("PEXPIRE", key, math.ceil(bucket.burst / bucket.rate))
+end
+return {allowed, wait}
+`)
+
+// Function ParseRateLimit parses limits like "60/1m", meaning
+// bursts of 60 requests and 60 requests per minute after that
+func ParseRateLimit(limit string) (rl RateLimit, err error) {
+	comps := strings.Split(limit, "/")
+	if len(comps) != 2 {
+		return rl, errors.New("rate limit must look like 60/1m")
+	}
+
+	if rl.Burst, err = strconv.ParseInt(comps[0], 10, 64); err != nil {
+		return
+	}
+
+	if rl.Period, err = time.ParseDuration(comps[1]); err != nil {
+		return
+	}
+
+	if rl.Burst <= 0 || rl.Period <= 0 {
+		return rl, errors.New("rate limit burst and period must be positive")
+	}
+
+	// buckets refill by the millisecond, so shorter periods would never run out
+	if rl.Period < time.Millisecond {
+		return rl, errors.New("rate limit period must be at least 1ms")
+	}
+	return
+}
+
+// Function Allow takes a token from the bucket with the given key, like
+// "message-mailbox-<id>". If the bucket is empty it returns false and how
+// long until the next token is available
+func (rl RateLimit) Allow(key string) (allowed bool, retryAfter time.Duration, err error) {
+	return AllowAll(RateLimitBucket{Key: key, Limit: rl})
+}
+
+// Function AllowAll takes a token from each of the buckets if all of them
+// have one. If any bucket is empty no tokens are taken, and it returns false
+// and how long until every bucket has a token again
+func AllowAll(buckets ...RateLimitBucket) (allowed bool, retryAfter time.Duration, err error) {
+	if len(buckets) == 0 {
+		return true, 0, nil
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	keys := []string{}
+	args := []string{strconv.FormatInt(now, 10)}
+	for _, bucket := range buckets {
+		rl := bucket.Limit
+		rate := float64(rl.Burst) / float64(rl.Period/time.Millisecond)
+		keys = append(keys, rateLimitPrefix+bucket.Key)
+		args = append(args, strconv.FormatInt(rl.Burst, 10), strconv.FormatFloat(rate, 'g', -1, 64))
+	}
+
+	result, err := takeTokens.Run(RedisDb, keys, args).Result()
+	if err != nil {
+		return
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, errors.New("unexpected rate limit script result")
+	}
+
+	allowedInt, _ := values[0].(int64)
+	waitMillis, _ := values[1].(int64)
+	return allowedInt == 1, time.Duration(waitMillis) * time.Millisecond, nil
+}
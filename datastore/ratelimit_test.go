@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	rl, err := ParseRateLimit("60/1m")
+	if err != nil {
+		t.Fatal("Error parsing rate limit:", err)
+	}
+
+	if rl.Burst != 60 || rl.Period != time.Minute {
+		t.Fatal("Expected 60 requests per minute but got", rl)
+	}
+
+	for _, invalid := range []string{"", "60", "sixty/1m", "60/soon", "0/1m", "60/-1m", "60/500us"} {
+		if _, err := ParseRateLimit(invalid); err == nil {
+			t.Fatal("Error: invalid rate limit was parsed:", invalid)
+		}
+	}
+}
+
+func TestRateLimitAllow(t *testing.T) {
+	rl := RateLimit{Burst: 3, Period: 300 * time.Millisecond}
+	key := "test-" + NewUUID()
+
+	for i := 0; i < 3; i++ {
+		if allowed, _, err := rl.Allow(key); err != nil || !allowed {
+			t.Fatal("Error: request within burst was not allowed", err)
+		}
+	}
+
+	allowed, retryAfter, err := rl.Allow(key)
+	if err != nil {
+		t.Fatal("Error checking rate limit:", err)
+	}
+
+	if allowed || retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Fatal("Expected request over the limit to wait up to 100ms but got", allowed, retryAfter)
+	}
+
+	if allowed, _, _ := rl.Allow("test-" + NewUUID()); !allowed {
+		t.Fatal("Error: rate limit applied to another key")
+	}
+
+	time.Sleep(retryAfter)
+	if allowed, _, err := rl.Allow(key); err != nil || !allowed {
+		t.Fatal("Error: request was not allowed after the bucket refilled", err)
+	}
+}
+
+func TestRateLimitAllowAll(t *testing.T) {
+	strict := RateLimitBucket{Key: "test-" + NewUUID(), Limit: RateLimit{Burst: 1, Period: time.Hour}}
+	loose := RateLimitBucket{Key: "test-" + NewUUID(), Limit: RateLimit{Burst: 2, Period: time.Hour}}
+
+	if allowed, _, err := AllowAll(strict, loose); err != nil || !allowed {
+		t.Fatal("Error: request within both limits was not allowed", err)
+	}
+
+	allowed, retryAfter, err := AllowAll(strict, loose)
+	if err != nil || allowed || retryAfter <= 0 {
+		t.Fatal("Expected request over the strict limit to wait but got", allowed, retryAfter, err)
+	}
+
+	// the rejected request must not have taken the loose bucket's last token
+	if allowed, _, err := loose.Limit.Allow(loose.Key); err != nil || !allowed {
+		t.Fatal("Error: rejected request took a token from the other bucket", err)
+	}
+}
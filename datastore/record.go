@@ -15,7 +15,7 @@ type Recordable interface {
 	Insert() error
 	Update() error
 	Delete() error
-	PermissionThreadId() string // A thread id used to control permissions for the object
+	Authorizable
 }
 
 func Rec(uuid string) (r Record) {
@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+	"time"
+)
+
+// MessageRevision is a version of a message that was replaced by an edit.
+// Revision 0 is the message as it was first posted
+type MessageRevision struct {
+	MessageId  string `db:"message_id"`
+	Revision   int
+	CreatedAt  time.Time // when this version was posted or edited in
+	Topic      string
+	Body       string
+	Labels     types.JSONText
+	Payload    types.JSONText
+	Recipients pq.StringArray // the recipients of this version, everyone in the thread if empty
+}
+
+// MessageUpdate is the payload of message-update events: the
+// message as it is now, and the version the update replaced
+type MessageUpdate struct {
+	Message
+	Previous MessageRevision
+}
+
+// Function saveRevision copies the stored version of the message into
+// its revisions, in the transaction that is about to replace it
+func (m *Message) saveRevision(tx *sqlx.Tx) (previous MessageRevision, err error) {
+	err = tx.Get(&previous, `
+		insert into message_revisions (message_id, revision, createdat, topic, body, labels, payload, recipients)
+		select id, edit_count, updatedat, topic, body, labels, payload, recipients from messages where id = $1
+		returning *;
+	`, m.Id)
+	return
+}
+
+// Function Revisions lists the earlier versions of the message, oldest first
+func (m *Message) Revisions() (revisions []MessageRevision, err error) {
+	revisions = []MessageRevision{}
+	err = PostgresDb.Select(&revisions, `
+		select * from message_revisions where message_id = $1 order by revision
+	`, m.Id)
+	return
+}
+
+// Function version returns the message as it was in the revision
+func (r MessageRevision) version(m *Message) Message {
+	return Message{
+		Id:              m.Id,
+		ThreadId:        m.ThreadId,
+		SenderMailboxId: m.SenderMailboxId,
+		Topic:           r.Topic,
+		Body:            r.Body,
+		Labels:          r.Labels,
+		Payload:         r.Payload,
+		Recipients:      r.Recipients,
+	}
+}
+
+// Function readsVersion returns true if the mailbox, with the reader's access
+// to the thread, may see the message as it was in the revision
+func (mb *Mailbox) readsVersion(reader *ThreadMember, r MessageRevision, m *Message) bool {
+	v := r.version(m)
+	return mb.InScope(&v) && reader.Reads(&v)
+}
+
+// Function ReadableRevisions lists the earlier versions of the message the
+// mailbox may read, oldest first. Versions in topics it does not read, or
+// whispered to other mailboxes, are left out
+func (mb *Mailbox) ReadableRevisions(m *Message) ([]MessageRevision, error) {
+	revisions, err := m.Revisions()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := mb.Member(m.ThreadId)
+	readable := []MessageRevision{}
+	for _, r := range revisions {
+		if mb.readsVersion(reader, r, m) {
+			readable = append(readable, r)
+		}
+	}
+	return readable, nil
+}
+
+// Function ReadableUpdate returns a message-update event as the mailbox may
+// see it, with the reader's access to the thread. The previous version is
+// blank if the mailbox could not read it, and ok is false if it may not
+// read the message as it is now
+func (mb *Mailbox) ReadableUpdate(update MessageUpdate, reader *ThreadMember) (readable MessageUpdate, ok bool) {
+	if !mb.InScope(&update.Message) || !reader.Reads(&update.Message) {
+		return update, false
+	}
+
+	if !mb.readsVersion(reader, update.Previous, &update.Message) {
+		update.Previous = MessageRevision{MessageId: update.Previous.MessageId, Revision: update.Previous.Revision}
+	}
+	return update, true
+}
@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMessageRevisions(t *testing.T) {
+	sender := testMailbox(t)
+	thread := testThread(t, "revision test")
+	message := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "first"}
+	testMessages(t, &message)
+
+	if message.Edited || message.EditCount != 0 {
+		t.Fatal("Error: new message is marked as edited:", message)
+	}
+
+	es := NewStream(RedisDb)
+	defer es.Close()
+	events := es.EventChannel("message-update-" + thread.Id)
+
+	for _, body := range []string{"second", "third"} {
+		message.Body = body
+		if err := message.Update(); err != nil {
+			t.Fatal("Error updating message when testing revisions:", err)
+		}
+	}
+
+	if !message.Edited || message.EditCount != 2 || message.Body != "third" {
+		t.Fatal("Error: expected message edited twice but got", message)
+	}
+
+	revisions, err := message.Revisions()
+	if err != nil || len(revisions) != 2 {
+		t.Fatal("Error: expected two revisions but got", revisions, err)
+	}
+
+	if revisions[0].Revision != 0 || revisions[0].Body != "first" || revisions[1].Body != "second" {
+		t.Fatal("Error: expected the replaced versions oldest first but got", revisions)
+	}
+
+	select {
+	case evt := <-events:
+		var update MessageUpdate
+		if err := json.Unmarshal(evt.Payload, &update); err != nil || update.Body != "second" || update.Previous.Body != "first" {
+			t.Fatal("Error: expected update event with old and new versions but got", update, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error: expected message-update event")
+	}
+}
+
+func TestReadableRevisions(t *testing.T) {
+	sender, recipient, bystander := testMailbox(t), testMailbox(t), testMailbox(t)
+	thread := testThread(t, "whispered revisions")
+
+	for _, mb := range []*Mailbox{&sender, &recipient, &bystander} {
+		if err := thread.AddMember(&ThreadMember{MailboxId: mb.Id, Role: RoleMember}); err != nil {
+			t.Fatal("Error adding thread member:", err)
+		}
+	}
+
+	// a whisper that is later shared with the whole thread
+	message := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "secret", Recipients: []string{recipient.Id}}
+	testMessages(t, &message)
+
+	message.Body = "public"
+	message.Recipients = []string{}
+	if err := message.Update(); err != nil {
+		t.Fatal("Error updating message:", err)
+	}
+
+	for _, mb := range []*Mailbox{&sender, &recipient, &bystander} {
+		revisions, err := mb.ReadableRevisions(&message)
+		if err != nil {
+			t.Fatal("Error getting readable revisions:", err)
+		}
+
+		expected := 1
+		if mb.Id == bystander.Id {
+			expected = 0
+		}
+		if len(revisions) != expected {
+			t.Fatal("Expected", expected, "readable revisions but got", revisions)
+		}
+	}
+
+	revisions, err := message.Revisions()
+	if err != nil || len(revisions) != 1 || len(revisions[0].Recipients) != 1 {
+		t.Fatal("Error: expected the revision to keep its recipients but got", revisions, err)
+	}
+
+	update := MessageUpdate{Message: message, Previous: revisions[0]}
+	if seen, ok := recipient.ReadableUpdate(update, recipient.Member(thread.Id)); !ok || seen.Previous.Body != "secret" {
+		t.Fatal("Error: recipient should see the previous version but got", seen.Previous)
+	}
+
+	seen, ok := bystander.ReadableUpdate(update, bystander.Member(thread.Id))
+	if !ok || seen.Body != "public" || seen.Previous.Body != "" || seen.Previous.Revision != 0 {
+		t.Fatal("Error: bystander should see the update without the whisper but got", seen)
+	}
+}
+
+func TestEditedWhisperRevisions(t *testing.T) {
+	sender, recipient, bystander := testMailbox(t), testMailbox(t), testMailbox(t)
+	thread := testThread(t, "edited whisper revisions")
+
+	for _, mb := range []*Mailbox{&sender, &recipient, &bystander} {
+		if err := thread.AddMember(&ThreadMember{MailboxId: mb.Id, Role: RoleMember}); err != nil {
+			t.Fatal("Error adding thread member:", err)
+		}
+	}
+
+	message := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "secret", Recipients: []string{recipient.Id}}
+	testMessages(t, &message)
+
+	message.Body = "edited secret"
+	message.Recipients = nil
+	if err := message.Update(); err != nil {
+		t.Fatal("Error updating message:", err)
+	}
+
+	if !recipient.Can(ActionRead, message) || bystander.Can(ActionRead, message) {
+		t.Fatal("Error: edit without recipients made the whisper readable by", message.Recipients)
+	}
+
+	if revisions, err := recipient.ReadableRevisions(&message); err != nil || len(revisions) != 1 {
+		t.Fatal("Error: expected the recipient to read the earlier version but got", revisions, err)
+	}
+
+	if revisions, err := bystander.ReadableRevisions(&message); err != nil || len(revisions) != 0 {
+		t.Fatal("Error: expected the bystander to read no earlier versions but got", revisions, err)
+	}
+}
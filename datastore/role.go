@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"errors"
+	"github.com/jmoiron/sqlx"
+)
+
+// Role is the part a thread member plays in the thread
+type Role string
+
+const (
+	RoleOwner  Role = "owner"  // manages every member, including other owners, and can delete the thread
+	RoleAdmin  Role = "admin"  // manages members and viewers and can delete the thread
+	RoleMember Role = "member" // reads and writes messages
+	RoleViewer Role = "viewer" // only reads messages
+)
+
+var ErrLastOwner = errors.New("thread must keep at least one owner")
+
+// Function ParseRole returns the role with the given name
+func ParseRole(name string) (Role, error) {
+	switch r := Role(name); r {
+	case RoleOwner, RoleAdmin, RoleMember, RoleViewer:
+		return r, nil
+	}
+	return "", errors.New("invalid thread role: " + name)
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 3
+	case RoleAdmin:
+		return 2
+	case RoleMember:
+		return 1
+	}
+	return 0
+}
+
+// Function CanManage returns true if the role can change membership
+// of the thread and delete it
+func (r Role) CanManage() bool {
+	return r == RoleOwner || r == RoleAdmin
+}
+
+// Function Manages returns true if a member with role r may add, change or
+// remove members with the other role. Owners manage everyone, admins manage
+// roles below their own. A blank role is managed by any owner or admin
+func (r Role) Manages(other Role) bool {
+	if r == RoleOwner {
+		return true
+	}
+	return r.CanManage() && other.rank() < r.rank()
+}
+
+// Function MemberRole returns the role of the member. Members saved without
+// a role are members if they can write and viewers otherwise
+func (m ThreadMember) MemberRole() Role {
+	if m.Role != "" {
+		return m.Role
+	} else if m.AllowWrite {
+		return RoleMember
+	}
+	return RoleViewer
+}
+
+// Function applyRole sets the role of the member and makes its permissions
+// match it. A role given without any permissions gets the role's defaults
+func (m *ThreadMember) applyRole() error {
+	if _, err := ParseRole(string(m.MemberRole())); err != nil {
+		return err
+	}
+
+	if m.Role != "" && !m.AllowRead && !m.AllowWrite && !m.AllowNotification {
+		m.AllowRead, m.AllowNotification = true, true
+		m.AllowWrite = m.Role != RoleViewer
+	}
+
+	m.Role = m.MemberRole()
+	switch m.Role {
+	case RoleOwner, RoleAdmin:
+		m.AllowRead, m.AllowWrite = true, true
+	case RoleViewer:
+		m.AllowWrite = false
+	}
+	return nil
+}
+
+// Function keepsOwner returns ErrLastOwner if the member is the only owner
+// of its thread and would stop being one by taking newRole. A blank newRole
+// means the member is being removed. The owners stay locked until tx ends,
+// so two owners can not step down at the same time
+func (m *ThreadMember) keepsOwner(tx *sqlx.Tx, newRole Role) error {
+	if newRole == RoleOwner {
+		return nil
+	}
+
+	owners := []string{}
+	err := tx.Select(&owners, `
+		select mailbox_id from thread_members where thread_id = $1 and role = $2 for update
+	`, m.ThreadId, RoleOwner)
+	if err != nil {
+		return err
+	}
+
+	for _, owner := range owners {
+		if owner == m.MailboxId && len(owners) <= 1 {
+			return ErrLastOwner
+		}
+	}
+	return nil
+}
+
+// Function ThreadRole returns the role of the mailbox in the thread,
+// or a blank role if it is not a member
+func (mb *Mailbox) ThreadRole(threadId string) Role {
+	if threadId == "" {
+		return ""
+	}
+
+	dbThread := Thread{Record: Rec(threadId)}
+	member, err := dbThread.GetMember(mb.Id)
+	if err != nil {
+		return ""
+	}
+	return member.MemberRole()
+}
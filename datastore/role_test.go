@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestRoleManages(t *testing.T) {
+	cases := []struct {
+		role    Role
+		other   Role
+		manages bool
+	}{
+		{RoleOwner, RoleOwner, true},
+		{RoleOwner, RoleAdmin, true},
+		{RoleAdmin, RoleOwner, false},
+		{RoleAdmin, RoleAdmin, false},
+		{RoleAdmin, RoleMember, true},
+		{RoleAdmin, RoleViewer, true},
+		{RoleMember, RoleViewer, false},
+		{RoleViewer, RoleViewer, false},
+		{"", RoleViewer, false},
+	}
+
+	for _, c := range cases {
+		if got := c.role.Manages(c.other); got != c.manages {
+			t.Error("Error:", c.role, "manages", c.other, "should be", c.manages, "but got", got)
+		}
+	}
+
+	if _, err := ParseRole("superuser"); err == nil {
+		t.Fatal("Error: parsed invalid role")
+	}
+}
+
+func TestThreadRoles(t *testing.T) {
+	owner, admin, viewer := testMailbox(t), testMailbox(t), testMailbox(t)
+	thread := testThread(t, "roles")
+
+	ownerMember := ThreadMember{MailboxId: owner.Id, Role: RoleOwner}
+	adminMember := ThreadMember{MailboxId: admin.Id, Role: RoleAdmin}
+	viewerMember := ThreadMember{MailboxId: viewer.Id, AllowRead: true, AllowWrite: true, Role: RoleViewer}
+	for _, member := range []*ThreadMember{&ownerMember, &adminMember, &viewerMember} {
+		if err := thread.AddMember(member); err != nil {
+			t.Fatal("Error adding thread member:", err)
+		}
+	}
+
+	if !ownerMember.AllowWrite || !ownerMember.AllowNotification {
+		t.Fatal("Error: owner added without permissions did not get the owner defaults")
+	}
+
+	if viewerMember.AllowWrite || viewer.CanWrite(thread.Id) {
+		t.Fatal("Error: viewer can write to thread")
+	}
+
+	legacy := ThreadMember{MailboxId: NewUUID(), AllowRead: true, AllowWrite: true}
+	if err := thread.AddMember(&legacy); err != nil || legacy.Role != RoleMember {
+		t.Fatal("Error: expected member added without a role to be a member but got", legacy.Role, err)
+	}
+
+	if admin.Can(ActionDelete, ownerMember) || admin.AuthorizeUpdate(viewerMember, ThreadMember{ThreadId: thread.Id, MailboxId: viewer.Id, Role: RoleOwner}) == nil {
+		t.Fatal("Error: admin can remove an owner or promote a member to owner")
+	}
+
+	if !admin.Can(ActionDelete, viewerMember) || !admin.Can(ActionDelete, thread) {
+		t.Fatal("Error: admin can not remove a viewer or delete the thread")
+	}
+
+	if viewer.Can(ActionDelete, thread) || viewer.Can(ActionCreate, ThreadMember{ThreadId: thread.Id, MailboxId: NewUUID()}) {
+		t.Fatal("Error: viewer can delete the thread or add members")
+	}
+
+	ownerMember.Role = RoleAdmin
+	if err := ownerMember.UpdatePermissions(); err != ErrLastOwner {
+		t.Fatal("Expected ErrLastOwner demoting the only owner but got", err)
+	}
+
+	if err := ownerMember.Remove(); err != ErrLastOwner {
+		t.Fatal("Expected ErrLastOwner removing the only owner but got", err)
+	}
+
+	adminMember.Role = RoleOwner
+	if err := adminMember.UpdatePermissions(); err != nil {
+		t.Fatal("Error promoting admin to owner:", err)
+	}
+
+	if err := ownerMember.Remove(); err != nil {
+		t.Fatal("Error removing an owner that is not the last one:", err)
+	}
+}
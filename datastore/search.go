@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"github.com/lib/pq"
+	"github.com/omarqazi/hearst/auth"
+	"strings"
+	"time"
+)
+
+// Most messages returned by one search
+const MaxSearchLimit = 100
+
+// The text search document of a message, with words in the body ranked above
+// words in the topic. It must match the expression of the messages_search
+// index, which keeps it up to date without a column that every select of
+// messages would have to know about
+const messageDocument = `(setweight(to_tsvector('english', coalesce(body, '')), 'A') ||
+	setweight(to_tsvector('english', coalesce(topic, '')), 'B'))`
+
+// Options of ts_headline for the snippets of search results, which mark
+// the matching words with <b> and </b>
+const snippetOptions = "MaxFragments=2, MaxWords=20, MinWords=5"
+
+// The body of a message with HTML escaped, so the only markup in
+// a snippet is the marks ts_headline adds
+const escapedBody = `replace(replace(replace(replace(coalesce(body, ''),
+	'&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;')`
+
+// MessageSearch is a full text search of the messages a mailbox may read
+type MessageSearch struct {
+	Query    string    // the words to search for
+	ThreadId string    // only search this thread, every readable thread if blank
+	SenderId string    // only return messages from this mailbox, if not blank
+	Since    time.Time // only return messages created at or after this time, if not zero
+	Until    time.Time // only return messages created before this time, if not zero
+	Limit    int
+	Offset   int
+}
+
+// SearchResult is a message that matched a search, with how well it matched
+// and the parts of its body that matched
+type SearchResult struct {
+	Message
+	Rank    float64
+	Snippet string // HTML of the matching parts of the body, escaped, with the matching words in <b>
+}
+
+// Function SearchMessages returns the messages the mailbox may read that
+// match the search, best match first. Topic rules, whispers, blocks and the
+// session scope are applied the same way as when listing messages
+func (mb *Mailbox) SearchMessages(search MessageSearch) (results []SearchResult, err error) {
+	results = []SearchResult{}
+	if search.Limit <= 0 || search.Limit > MaxSearchLimit {
+		search.Limit = MaxSearchLimit
+	}
+
+	if search.Offset < 0 {
+		search.Offset = 0
+	}
+
+	access, err := mb.readableThreads(search.ThreadId)
+	if err != nil || len(access) == 0 || strings.TrimSpace(search.Query) == "" {
+		return
+	}
+
+	threadIds, threadTopics := []string{}, []string{}
+	for _, member := range access {
+		threadIds = append(threadIds, member.ThreadId)
+		threadTopics = append(threadTopics, topicsRegexp(member.ReadTopics))
+	}
+
+	since := pq.NullTime{Time: search.Since, Valid: !search.Since.IsZero()}
+	until := pq.NullTime{Time: search.Until, Valid: !search.Until.IsZero()}
+	err = PostgresDb.Select(&results, `
+		select messages.*, ts_rank(`+messageDocument+`, query) as rank,
+		 ts_headline('english', `+escapedBody+`, query, $11) as snippet
+		 from messages
+		 inner join unnest($1::uuid[], $2::text[]) as readable(thread_id, topics) on readable.thread_id = messages.thread_id
+		 cross join plainto_tsquery('english', $3) as query
+		 where `+messageDocument+` @@ query and `+unexpired+`
+		 and (readable.topics = '' or topic ~ readable.topics)
+		 and `+readableBy(4, 5)+`
+		 and ($6 = '' or sender_mailbox_id::text = $6)
+		 and ($7::timestamptz is null or createdat >= $7)
+		 and ($8::timestamptz is null or createdat < $8)
+		 order by rank desc, createdat desc, messages.id limit $9 offset $10
+	`, pq.Array(threadIds), pq.Array(threadTopics), search.Query, topicRegexps(mb.Scope.Topics), mb.Id,
+		search.SenderId, since, until, search.Limit, search.Offset, snippetOptions)
+	return
+}
+
+// Function topicsRegexp combines topic patterns into one regular expression
+// that matches any of them, or returns a blank string if there are none
+func topicsRegexp(patterns []string) string {
+	regexps := []string{}
+	for _, pattern := range patterns {
+		regexps = append(regexps, auth.TopicRegexp(pattern))
+	}
+	return strings.Join(regexps, "|")
+}
+
+// Function readableThreads returns the access the mailbox has to the threads
+// it may read in its session scope, directly and through groups. If threadId
+// is not blank only that thread is returned
+func (mb *Mailbox) readableThreads(threadId string) ([]ThreadMember, error) {
+	members, err := memberAccess(threadId, mb.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	readable := []ThreadMember{}
+	for _, member := range members {
+		if member.AllowRead && mb.Scope.AllowsThread(member.ThreadId) {
+			readable = append(readable, member)
+		}
+	}
+	return readable, nil
+}
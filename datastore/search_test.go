@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchMessages(t *testing.T) {
+	sender, reader := testMailbox(t), testMailbox(t)
+	thread, otherThread := testThread(t, "search test"), testThread(t, "other search test")
+
+	member := ThreadMember{MailboxId: reader.Id, AllowRead: true, ReadTopics: []string{"chat"}}
+	if err := thread.AddMember(&member); err != nil {
+		t.Fatal("Error adding thread member when testing search:", err)
+	}
+
+	match := Message{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "the quick brown fox jumps <i>"}
+	hidden := []Message{
+		{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "secret", Body: "a fox in another topic"},
+		{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "a whispered fox", Recipients: []string{sender.Id}},
+		{ThreadId: otherThread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "a fox in another thread"},
+		{ThreadId: thread.Id, SenderMailboxId: sender.Id, Topic: "chat", Body: "nothing to see here"},
+	}
+	for i := range hidden {
+		testMessages(t, &hidden[i])
+	}
+	testMessages(t, &match)
+
+	results, err := reader.SearchMessages(MessageSearch{Query: "foxes"})
+	if err != nil || len(results) != 1 || results[0].Body != match.Body {
+		t.Fatal("Error: expected only the readable matching message but got", results, err)
+	}
+
+	if !strings.Contains(results[0].Snippet, "<b>fox</b>") || strings.Contains(results[0].Snippet, "<i>") || results[0].Rank <= 0 {
+		t.Fatal("Error: expected ranked result with escaped, highlighted snippet but got", results[0])
+	}
+
+	results, err = reader.SearchMessages(MessageSearch{Query: "fox", ThreadId: thread.Id, SenderId: reader.Id})
+	if err != nil || len(results) != 0 {
+		t.Fatal("Error: expected sender filter to leave out other senders but got", results, err)
+	}
+
+	results, err = reader.SearchMessages(MessageSearch{Query: "fox", Until: time.Now().Add(-time.Hour)})
+	if err != nil || len(results) != 0 {
+		t.Fatal("Error: expected date filter to leave out newer messages but got", results, err)
+	}
+
+	results, err = sender.SearchMessages(MessageSearch{Query: "fox"})
+	if err != nil || len(results) != 0 {
+		t.Fatal("Error: expected no results in threads the mailbox does not read but got", results, err)
+	}
+}
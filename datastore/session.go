@@ -0,0 +1,231 @@
+package datastore
+
+import (
+	"encoding/json"
+	"github.com/omarqazi/hearst/auth"
+	"strconv"
+	"time"
+)
+
+const sessionsCachePrefix = "hearst-sessions-"
+const socketsCachePrefix = "hearst-sockets-"
+const revokedSessionPrefix = "hearst-revoked-session-"
+const sessionsRevokedBeforePrefix = "hearst-sessions-revoked-before-"
+const sessionsRevokedExceptPrefix = "hearst-sessions-revoked-except-"
+
+// Sockets that have not answered a ping for this long are considered gone
+const socketTimeout = 1 * time.Minute
+
+// MailboxSession describes a session that has been used to access a mailbox
+type MailboxSession struct {
+	Id        string
+	MailboxId string
+	DeviceId  string `json:",omitempty"` // the device that signed the session, if any
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	LastSeen  time.Time
+	Except    string `json:",omitempty"` // in revocation events, a session that is not revoked
+}
+
+// MailboxSocket describes a socket connection that is open for a mailbox
+type MailboxSocket struct {
+	Id          string
+	MailboxId   string
+	SessionId   string
+	Endpoint    string // the API the socket is connected to, sock or socket
+	RemoteAddr  string
+	ConnectedAt time.Time
+	LastSeen    time.Time
+}
+
+// Function TrackSession records that the session was used to access the
+// mailbox, so it shows up in ActiveSessions
+func (mb *Mailbox) TrackSession(s auth.Session) error {
+	ms := MailboxSession{
+		Id:        s.Id(),
+		MailboxId: mb.Id,
+		LastSeen:  time.Now(),
+	}
+	if mb.Device != nil {
+		ms.DeviceId = mb.Device.Id
+	}
+	ms.IssuedAt, _ = s.IssuedAt()
+	ms.ExpiresAt, _ = s.ExpiresAt()
+
+	sessionJSON, err := json.Marshal(ms)
+	if err != nil {
+		return err
+	}
+
+	key := sessionsCachePrefix + mb.Id
+	if err = RedisDb.HSet(key, ms.Id, string(sessionJSON)).Err(); err != nil {
+		return err
+	}
+	return RedisDb.Expire(key, auth.MaxSessionDuration).Err()
+}
+
+// Function SessionRevoked returns true if the session was revoked on its
+// own, or if all sessions of the mailbox were revoked after it was issued
+func (mb *Mailbox) SessionRevoked(s auth.Session) bool {
+	if revoked, err := RedisDb.Exists(mb.revokedSessionKey(s.Id())).Result(); err != nil || revoked {
+		return true
+	}
+
+	revokedAt, err := RedisDb.Get(sessionsRevokedBeforePrefix + mb.Id).Int64()
+	if err != nil {
+		return false // no sessions have been revoked
+	}
+
+	if except, err := RedisDb.Get(sessionsRevokedExceptPrefix + mb.Id).Result(); err == nil && except == s.Id() {
+		return false
+	}
+
+	issuedAt, err := s.IssuedAt()
+	return err != nil || !issuedAt.After(time.Unix(0, revokedAt))
+}
+
+// Function revokedSessionKey returns where the revocation of one of the
+// mailbox's sessions is stored
+func (mb *Mailbox) revokedSessionKey(sessionId string) string {
+	return revokedSessionPrefix + mb.Id + "-" + sessionId
+}
+
+// Function ActiveSessions returns the sessions that have been used with the
+// mailbox and have neither expired nor been revoked
+func (mb *Mailbox) ActiveSessions() (sessions []MailboxSession, err error) {
+	sessions = []MailboxSession{}
+	key := sessionsCachePrefix + mb.Id
+	sessionMap, err := RedisDb.HGetAllMap(key).Result()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for sessionId, sessionJSON := range sessionMap {
+		var ms MailboxSession
+		err := json.Unmarshal([]byte(sessionJSON), &ms)
+		if err != nil || now.After(ms.ExpiresAt) {
+			RedisDb.HDel(key, sessionId)
+			continue
+		}
+
+		sessions = append(sessions, ms)
+	}
+	return sessions, nil
+}
+
+// Function RevokeSession stops the session from being accepted again
+// and disconnects any sockets that were opened with it
+func (mb *Mailbox) RevokeSession(sessionId string) error {
+	key := sessionsCachePrefix + mb.Id
+	expiration := auth.MaxSessionDuration
+	if sessionJSON, err := RedisDb.HGet(key, sessionId).Result(); err == nil {
+		var ms MailboxSession
+		if err := json.Unmarshal([]byte(sessionJSON), &ms); err == nil && ms.ExpiresAt.After(time.Now()) {
+			expiration = ms.ExpiresAt.Sub(time.Now())
+		}
+	}
+
+	if err := RedisDb.Set(mb.revokedSessionKey(sessionId), "1", expiration).Err(); err != nil {
+		return err
+	}
+
+	RedisDb.HDel(key, sessionId)
+	return Stream.AnnounceEvent("session-revoke-"+mb.Id, MailboxSession{Id: sessionId, MailboxId: mb.Id})
+}
+
+// Function RevokeAllSessions revokes every session issued for the mailbox so
+// far and disconnects all of its sockets
+func (mb *Mailbox) RevokeAllSessions() error {
+	return mb.RevokeOtherSessions("")
+}
+
+// Function RevokeOtherSessions revokes every session issued for the
+// mailbox so far except the session with the id keepSessionId
+func (mb *Mailbox) RevokeOtherSessions(keepSessionId string) error {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := RedisDb.Set(sessionsRevokedBeforePrefix+mb.Id, now, auth.MaxSessionDuration).Err(); err != nil {
+		return err
+	}
+
+	if keepSessionId == "" {
+		RedisDb.Del(sessionsRevokedExceptPrefix + mb.Id)
+	} else if err := RedisDb.Set(sessionsRevokedExceptPrefix+mb.Id, keepSessionId, auth.MaxSessionDuration).Err(); err != nil {
+		return err
+	}
+
+	key := sessionsCachePrefix + mb.Id
+	if sessionMap, err := RedisDb.HGetAllMap(key).Result(); err == nil {
+		for sessionId := range sessionMap {
+			if sessionId != keepSessionId {
+				RedisDb.HDel(key, sessionId)
+			}
+		}
+	}
+
+	return Stream.AnnounceEvent("session-revoke-"+mb.Id, MailboxSession{MailboxId: mb.Id, Except: keepSessionId})
+}
+
+// Function Revokes returns true if a revocation event for this
+// mailbox applies to the session with the given id
+func (ms MailboxSession) Revokes(sessionId string) bool {
+	if ms.Id == "" {
+		return ms.Except != sessionId
+	}
+	return ms.Id == sessionId
+}
+
+// Function OpenSocket records a newly connected socket. The caller must
+// call Close when the socket disconnects
+func (mb *Mailbox) OpenSocket(sessionId string, endpoint string, remoteAddr string) (sock MailboxSocket, err error) {
+	sock = MailboxSocket{
+		Id:          NewUUID(),
+		MailboxId:   mb.Id,
+		SessionId:   sessionId,
+		Endpoint:    endpoint,
+		RemoteAddr:  remoteAddr,
+		ConnectedAt: time.Now(),
+	}
+
+	err = sock.StillConnected()
+	return
+}
+
+// Function StillConnected refreshes the last time the socket was seen
+func (sock *MailboxSocket) StillConnected() error {
+	sock.LastSeen = time.Now()
+	socketJSON, err := json.Marshal(sock)
+	if err != nil {
+		return err
+	}
+
+	return RedisDb.HSet(socketsCachePrefix+sock.MailboxId, sock.Id, string(socketJSON)).Err()
+}
+
+func (sock *MailboxSocket) Close() error {
+	return RedisDb.HDel(socketsCachePrefix+sock.MailboxId, sock.Id).Err()
+}
+
+// Function OpenSockets returns the sockets connected to the mailbox. Sockets
+// that have not been seen recently are assumed to be gone and are removed
+func (mb *Mailbox) OpenSockets() (sockets []MailboxSocket, err error) {
+	sockets = []MailboxSocket{}
+	key := socketsCachePrefix + mb.Id
+	socketMap, err := RedisDb.HGetAllMap(key).Result()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for socketId, socketJSON := range socketMap {
+		var sock MailboxSocket
+		err := json.Unmarshal([]byte(socketJSON), &sock)
+		if err != nil || now.Sub(sock.LastSeen) > socketTimeout {
+			RedisDb.HDel(key, socketId)
+			continue
+		}
+
+		sockets = append(sockets, sock)
+	}
+	return sockets, nil
+}
@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"github.com/omarqazi/hearst/auth"
+	"testing"
+	"time"
+)
+
+func testSession(t *testing.T) auth.Session {
+	serverKey, err := auth.GenerateKey(auth.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal("Error generating server key:", err)
+	}
+
+	token, err := auth.NewToken(serverKey)
+	if err != nil {
+		t.Fatal("Error generating token:", err)
+	}
+
+	return auth.Session{Token: token, Duration: 1 * time.Hour, Signature: []byte(NewUUID())}
+}
+
+func TestSessionRevocation(t *testing.T) {
+	mb := NewMailbox()
+	sessionA, sessionB := testSession(t), testSession(t)
+
+	for _, s := range []auth.Session{sessionA, sessionB} {
+		if err := mb.TrackSession(s); err != nil {
+			t.Fatal("Error tracking session:", err)
+		}
+
+		if mb.SessionRevoked(s) {
+			t.Fatal("Error: new session is already revoked")
+		}
+	}
+
+	sessions, err := mb.ActiveSessions()
+	if err != nil {
+		t.Fatal("Error listing sessions:", err)
+	}
+
+	if len(sessions) != 2 {
+		t.Fatal("Expected 2 active sessions but got", len(sessions))
+	}
+
+	if err := mb.RevokeSession(sessionA.Id()); err != nil {
+		t.Fatal("Error revoking session:", err)
+	}
+
+	if !mb.SessionRevoked(sessionA) || mb.SessionRevoked(sessionB) {
+		t.Fatal("Error: expected only the first session to be revoked")
+	}
+
+	if other := NewMailbox(); other.SessionRevoked(sessionA) {
+		t.Fatal("Error: revoking a session revoked it for another mailbox")
+	}
+
+	if sessions, _ = mb.ActiveSessions(); len(sessions) != 1 || sessions[0].Id != sessionB.Id() {
+		t.Fatal("Expected only the second session to be active but got", sessions)
+	}
+
+	if err := mb.RevokeAllSessions(); err != nil {
+		t.Fatal("Error revoking all sessions:", err)
+	}
+
+	if !mb.SessionRevoked(sessionB) {
+		t.Fatal("Error: session still valid after revoking all sessions")
+	}
+
+	if sessionC := testSession(t); mb.SessionRevoked(sessionC) {
+		t.Fatal("Error: session issued after revoking all sessions is revoked")
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	mb := NewMailbox()
+	keep, other := testSession(t), testSession(t)
+	for _, s := range []auth.Session{keep, other} {
+		if err := mb.TrackSession(s); err != nil {
+			t.Fatal("Error tracking session:", err)
+		}
+	}
+
+	if err := mb.RevokeOtherSessions(keep.Id()); err != nil {
+		t.Fatal("Error revoking other sessions:", err)
+	}
+
+	if mb.SessionRevoked(keep) || !mb.SessionRevoked(other) {
+		t.Fatal("Error: expected only the other session to be revoked")
+	}
+
+	if sessions, _ := mb.ActiveSessions(); len(sessions) != 1 || sessions[0].Id != keep.Id() {
+		t.Fatal("Expected only the kept session to be active but got", sessions)
+	}
+
+	revocation := MailboxSession{MailboxId: mb.Id, Except: keep.Id()}
+	if revocation.Revokes(keep.Id()) || !revocation.Revokes(other.Id()) {
+		t.Fatal("Error: revocation event applies to the wrong sessions")
+	}
+
+	if err := mb.RevokeAllSessions(); err != nil {
+		t.Fatal("Error revoking all sessions:", err)
+	}
+
+	if !mb.SessionRevoked(keep) {
+		t.Fatal("Error: kept session still valid after revoking all sessions")
+	}
+}
+
+func TestOpenSockets(t *testing.T) {
+	mb := NewMailbox()
+	sock, err := mb.OpenSocket("session-id", "sock", "127.0.0.1:1234")
+	if err != nil {
+		t.Fatal("Error opening socket:", err)
+	}
+
+	sockets, err := mb.OpenSockets()
+	if err != nil {
+		t.Fatal("Error listing sockets:", err)
+	}
+
+	if len(sockets) != 1 || sockets[0].Id != sock.Id || sockets[0].SessionId != "session-id" {
+		t.Fatal("Expected socket", sock, "but got", sockets)
+	}
+
+	if err := sock.Close(); err != nil {
+		t.Fatal("Error closing socket:", err)
+	}
+
+	if sockets, _ = mb.OpenSockets(); len(sockets) != 0 {
+		t.Fatal("Expected no open sockets but got", sockets)
+	}
+}
@@ -0,0 +1,45 @@
+package datastore
+
+import (
+	"testing"
+)
+
+// Function testMailbox inserts a mailbox that is deleted when the test ends
+func testMailbox(t *testing.T) Mailbox {
+	mb := NewMailbox()
+	if err := mb.Insert(); err != nil {
+		t.Fatal("Error inserting test mailbox:", err)
+	}
+	t.Cleanup(func() { mb.Delete() })
+	return mb
+}
+
+// Function testThread inserts a thread that is deleted when the test ends
+func testThread(t *testing.T, subject string) Thread {
+	thread := Thread{Subject: subject}
+	if err := thread.Insert(); err != nil {
+		t.Fatal("Error inserting test thread:", err)
+	}
+	t.Cleanup(func() { thread.Delete() })
+	return thread
+}
+
+// Function testMessages inserts the messages, with empty labels and payloads
+// unless they have their own, and deletes them when the test ends
+func testMessages(t *testing.T, messages ...*Message) {
+	for _, m := range messages {
+		if len(m.Labels) == 0 {
+			m.Labels.Scan("{}")
+		}
+		if len(m.Payload) == 0 {
+			m.Payload.Scan("{}")
+		}
+
+		if err := m.Insert(); err != nil {
+			t.Fatal("Error inserting test message:", err)
+		}
+
+		m := m
+		t.Cleanup(func() { m.Delete() })
+	}
+}
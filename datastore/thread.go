@@ -3,6 +3,8 @@ package datastore
 import (
 	"errors"
 	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"strings"
 )
 
@@ -10,15 +12,22 @@ type Thread struct {
 	Record
 	Identifier string // a human readable name for the thread
 	Subject    string
-	Domain     string // the domain of the server that owns this thread
+	Domain     string         // the domain of the server that owns this thread
+	JoinPolicy JoinPolicy     `db:"join_policy"` // how mailboxes that were not invited can join
+	Listed     *bool          // the thread is in the public directory and can be previewed by anyone, nil if not given
+	Labels     pq.StringArray // words the thread can be found by in the directory, nil if not given
+	Direct     bool           // the thread is the direct thread between two mailboxes
 }
 
 type ThreadMember struct {
-	ThreadId          string `db:"thread_id"`
-	MailboxId         string `db:"mailbox_id"`
-	AllowRead         bool   `db:"allow_read"`
-	AllowWrite        bool   `db:"allow_write"`
-	AllowNotification bool   `db:"allow_notification"`
+	ThreadId          string         `db:"thread_id"`
+	MailboxId         string         `db:"mailbox_id"`
+	AllowRead         bool           `db:"allow_read"`
+	AllowWrite        bool           `db:"allow_write"`
+	AllowNotification bool           `db:"allow_notification"`
+	Role              Role           `db:"role"`
+	ReadTopics        pq.StringArray `db:"read_topics"`  // topic patterns the member may read, all if empty
+	WriteTopics       pq.StringArray `db:"write_topics"` // topic patterns the member may write, all if empty
 }
 
 func GetThread(uuid string) (t Thread, err error) {
@@ -28,17 +37,41 @@ func GetThread(uuid string) (t Thread, err error) {
 	return
 }
 
-func (t *Thread) Insert() error {
+func (t *Thread) Insert() (err error) {
+	return t.InsertWithMembers()
+}
+
+// Function InsertWithMembers inserts the thread and adds the members to it in
+// one transaction, so the thread is never saved without them
+func (t *Thread) InsertWithMembers(members ...*ThreadMember) (err error) {
 	t.FillMissing()
+	if t.JoinPolicy, err = ParseJoinPolicy(string(t.JoinPolicy)); err != nil {
+		return
+	}
 
 	tx := PostgresDb.MustBegin()
-	tx.NamedExec(`
-		insert into threads (id, createdat, updatedat, subject, identifier, domain)
-		VALUES (:id, now(), now(), :subject, :identifier, :domain);
+	_, err = tx.NamedExec(`
+		insert into threads (id, createdat, updatedat, subject, identifier, domain, join_policy, listed, labels, direct)
+		VALUES (:id, now(), now(), :subject, :identifier, :domain, :join_policy, coalesce(:listed, false), :labels, :direct);
 	`, t)
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
 	tx.Exec(fmt.Sprintf("create sequence %s;", t.SequenceName()))
-	err := tx.Commit()
+	for _, m := range members {
+		if err = t.addMember(tx, m); err != nil {
+			tx.Rollback()
+			return
+		}
+	}
+
+	err = tx.Commit()
 	Stream.AnnounceEvent("thread-insert-"+t.Id, t)
+	for _, m := range members {
+		Stream.AnnounceEvent("threadmember-insert-"+t.Id, m)
+	}
 	return err
 }
 
@@ -59,22 +92,54 @@ func (t *Thread) Load() error {
 	t.Domain = tdb.Domain
 	t.Identifier = tdb.Identifier
 	t.Subject = tdb.Subject
+	t.JoinPolicy = tdb.JoinPolicy
+	t.Listed = tdb.Listed
+	t.Labels = tdb.Labels
+	t.Direct = tdb.Direct
 	return nil
 }
 
+// Function IsListed returns true if the thread is in the public directory
+func (t Thread) IsListed() bool {
+	return t.Listed != nil && *t.Listed
+}
+
+// Function KeepOmitted sets the settings an update left out to their
+// values in the stored thread, so they are not changed by the update
+func (t *Thread) KeepOmitted(stored Thread) {
+	if t.JoinPolicy == "" {
+		t.JoinPolicy = stored.JoinPolicy
+	}
+	if t.Listed == nil {
+		t.Listed = stored.Listed
+	}
+	if t.Labels == nil {
+		t.Labels = stored.Labels
+	}
+}
+
 func (t *Thread) SequenceName() (sname string) {
 	sname = strings.Replace("log-counter-"+t.Id, "-", "_", -1)
 	return
 }
 
+// Function Update saves the thread. A blank join policy, a nil Listed and
+// nil Labels keep their current values
 func (t *Thread) Update() error {
 	if t.Id == "" {
 		return t.Insert()
 	}
 
+	if t.JoinPolicy != "" {
+		if _, err := ParseJoinPolicy(string(t.JoinPolicy)); err != nil {
+			return err
+		}
+	}
+
 	tx := PostgresDb.MustBegin()
 	tx.NamedExec(`
-		update threads set updatedat = now(), subject = :subject, identifier = :identifier, domain = :domain where id = :id
+		update threads set updatedat = now(), subject = :subject, identifier = :identifier, domain = :domain,
+		join_policy = coalesce(nullif(:join_policy, ''), join_policy), listed = coalesce(:listed, listed), labels = coalesce(:labels, labels) where id = :id
 	`, t)
 	err := tx.Commit()
 	Stream.AnnounceEvent("thread-update-"+t.Id, t)
@@ -93,6 +158,15 @@ func (t *Thread) Delete() error {
 	tx.NamedExec(`
 		delete from thread_members where thread_id = :id
 	`, t)
+	tx.NamedExec(`
+		delete from thread_invitations where thread_id = :id
+	`, t)
+	tx.NamedExec(`
+		delete from thread_join_requests where thread_id = :id
+	`, t)
+	tx.NamedExec(`
+		delete from thread_groups where thread_id = :id
+	`, t)
 	tx.Exec(fmt.Sprintf("drop sequence %s;", t.SequenceName()))
 	err := tx.Commit()
 	Stream.AnnounceEvent("thread-delete-"+t.Id, t)
@@ -117,26 +191,52 @@ func (t *Thread) GetAllMembers() ([]ThreadMember, error) {
 	return members, err
 }
 
+// Function MembersToNotify lists the mailboxes that get notified of new
+// messages in the thread, as members or through their groups
 func (t *Thread) MembersToNotify() ([]ThreadMember, error) {
-	members := []ThreadMember{}
-	err := PostgresDb.Select(&members, "select * from thread_members where thread_id = $1 and allow_notification = true;", t.Id)
-	return members, err
+	members, err := t.accessOf("")
+	if err != nil {
+		return nil, err
+	}
+
+	notify := []ThreadMember{}
+	for _, member := range members {
+		if member.AllowNotification {
+			notify = append(notify, member)
+		}
+	}
+	return notify, nil
 }
 
 func (t *Thread) AddMember(m *ThreadMember) error {
+	tx := PostgresDb.MustBegin()
+	if err := t.addMember(tx, m); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err := tx.Commit()
+	Stream.AnnounceEvent("threadmember-insert-"+t.Id, m)
+	return err
+}
+
+// Function addMember inserts the member as part of the transaction tx.
+// The caller announces the new member once tx is committed
+func (t *Thread) addMember(tx *sqlx.Tx, m *ThreadMember) error {
 	m.ThreadId = t.Id
 	if m.MailboxId == "" {
 		return errors.New("Invalid mailbox ID for new member")
 	}
 
-	tx := PostgresDb.MustBegin()
-	tx.NamedExec(`
+	if err := m.applyRole(); err != nil {
+		return err
+	}
+
+	_, err := tx.NamedExec(`
 		insert into thread_members 
-		(thread_id, mailbox_id, allow_read, allow_write, allow_notification)
-		VALUES (:thread_id, :mailbox_id, :allow_read, :allow_write, :allow_notification);
+		(thread_id, mailbox_id, allow_read, allow_write, allow_notification, role, read_topics, write_topics)
+		VALUES (:thread_id, :mailbox_id, :allow_read, :allow_write, :allow_notification, :role, :read_topics, :write_topics);
 	`, m)
-	err := tx.Commit()
-	Stream.AnnounceEvent("threadmember-insert-"+t.Id, m)
 	return err
 }
 
@@ -163,17 +263,39 @@ func (m *ThreadMember) Load() (err error) {
 		m.AllowRead = dbm.AllowRead
 		m.AllowWrite = dbm.AllowWrite
 		m.AllowNotification = dbm.AllowNotification
+		m.Role = dbm.Role
+		m.ReadTopics = dbm.ReadTopics
+		m.WriteTopics = dbm.WriteTopics
 		return nil
 	}
 
 	return errors.New("No member found with that mailbox id")
 }
 
+// Function UpdatePermissions saves the role and permissions of the member.
+// If no role is given the member keeps its current one
 func (m *ThreadMember) UpdatePermissions() error {
+	if m.Role == "" {
+		stored := ThreadMember{ThreadId: m.ThreadId, MailboxId: m.MailboxId}
+		if err := stored.Load(); err == nil {
+			m.Role = stored.Role
+		}
+	}
+
+	if err := m.applyRole(); err != nil {
+		return err
+	}
+
 	tx := PostgresDb.MustBegin()
+	if err := m.keepsOwner(tx, m.Role); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	tx.NamedExec(`
 		update thread_members set allow_read = :allow_read, allow_write = :allow_write,
-		allow_notification = :allow_notification 
+		allow_notification = :allow_notification, role = :role,
+		read_topics = :read_topics, write_topics = :write_topics
 		where thread_id = :thread_id and mailbox_id = :mailbox_id;
 	`, m)
 	err := tx.Commit()
@@ -186,8 +308,15 @@ func (m *ThreadMember) Update() (err error) {
 	return
 }
 
+// Function Remove takes the member out of the thread,
+// unless it is the last owner
 func (m *ThreadMember) Remove() error {
 	tx := PostgresDb.MustBegin()
+	if err := m.keepsOwner(tx, ""); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	tx.NamedExec(`
 		delete from thread_members
 		where thread_id = :thread_id and mailbox_id = :mailbox_id;
@@ -202,12 +331,43 @@ func (m *ThreadMember) Delete() (err error) {
 	return
 }
 
-func (t Thread) PermissionThreadId() string {
-	return t.Id
+// Threads are governed by their members. Mailboxes outside the thread
+// can join it if its join policy is open or takes requests. Only owners
+// and admins change the join policy and whether the thread is listed
+func (t Thread) Policy() Policy {
+	p := Policy{
+		ThreadId: t.Id,
+		Settings: fmt.Sprintf("join=%s listed=%t", t.JoinPolicy, t.IsListed()),
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireRead},
+			ActionCreate: {RequireUnscoped},
+			ActionUpdate: {RequireWrite},
+			ActionDelete: {RequireManage},
+			ActionList:   {RequireRead},
+		},
+	}
+
+	if t.JoinPolicy == JoinOpen || t.JoinPolicy == JoinOnRequest {
+		p.Rules[ActionJoin] = []Requirement{RequireUnscoped}
+	}
+	return p
 }
 
-func (m ThreadMember) PermissionThreadId() string {
-	return m.ThreadId
+// Owners and admins manage members with lower roles, but can not add
+// mailboxes that blocked them. Members can see their own membership
+// and leave the thread. Nobody changes the members of a direct thread
+func (m ThreadMember) Policy() Policy {
+	return Policy{
+		OwnerId:  m.MailboxId,
+		ThreadId: m.ThreadId,
+		Role:     m.MemberRole(),
+		Rules: map[Action][]Requirement{
+			ActionRead:   {RequireRead, RequireOwner},
+			ActionCreate: {RequireManage | RequireUnblocked | RequireNotDirect},
+			ActionUpdate: {RequireManage | RequireNotDirect},
+			ActionDelete: {RequireManage | RequireNotDirect, RequireOwner | RequireNotDirect},
+		},
+	}
 }
 
 // Funciton RequireIdentifier sets the identifier of the thread
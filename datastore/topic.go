@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/omarqazi/hearst/auth"
+)
+
+// Function MatchTopic returns true if the topic matches any of the patterns,
+// the same way session scopes and message queries match them
+func MatchTopic(patterns []string, topic string) bool {
+	return auth.MatchTopic(patterns, topic)
+}
+
+// Function topicRegexps returns the patterns as a postgres array of regular
+// expressions, for queries like "topic ~ any($1)". Empty lists are passed as
+// empty arrays, which queries treat as allowing every topic
+func topicRegexps(patterns []string) interface{} {
+	regexps := []string{}
+	for _, pattern := range patterns {
+		regexps = append(regexps, auth.TopicRegexp(pattern))
+	}
+	return pq.Array(regexps)
+}
+
+// Function ReadsTopic returns true if the member's read topics allow the topic
+func (m ThreadMember) ReadsTopic(topic string) bool {
+	return MatchTopic(m.ReadTopics, topic)
+}
+
+// Function WritesTopic returns true if the member's write topics allow the topic
+func (m ThreadMember) WritesTopic(topic string) bool {
+	return MatchTopic(m.WriteTopics, topic)
+}
+
+// Function Reads returns true if the member may see the message, because
+// its read topics allow the topic and the message is addressed to it
+func (m ThreadMember) Reads(message *Message) bool {
+	return m.ReadsTopic(message.Topic) && (message.SenderMailboxId == m.MailboxId || message.IsRecipient(m.MailboxId))
+}
+
+// Function Member returns the access of the mailbox to the thread, to
+// filter the messages it reads. Callers must have checked that the mailbox
+// can read the thread. If it is not a member, a membership without topic
+// rules is returned
+func (mb *Mailbox) Member(threadId string) *ThreadMember {
+	dbThread := Thread{Record: Rec(threadId)}
+	member, err := dbThread.Access(mb.Id)
+	if err != nil {
+		member = ThreadMember{ThreadId: threadId, MailboxId: mb.Id}
+	}
+	return &member
+}
+
+// Function readerArgs returns the query arguments for readableBy
+func readerArgs(reader *ThreadMember) (readTopics interface{}, readerId string) {
+	if reader == nil {
+		return topicRegexps(nil), ""
+	}
+	return topicRegexps(reader.ReadTopics), reader.MailboxId
+}
+
+// Function readableBy returns a condition on messages that matches the ones
+// a reader may read and has not blocked the sender of, given the numbers of
+// the query arguments from readerArgs
+func readableBy(topicsArg int, readerArg int) string {
+	return fmt.Sprintf(`($%[1]d::text[] = '{}' or topic ~ any($%[1]d))
+		and ($%[2]d = '' or recipients is null or recipients = '{}'
+		or $%[2]d = any(recipients) or sender_mailbox_id::text = $%[2]d)
+		and ($%[2]d = '' or not exists (select 1 from mailbox_blocks
+		where mailbox_blocks.mailbox_id::text = $%[2]d and mailbox_blocks.blocked_id = messages.sender_mailbox_id
+		and mailbox_blocks.kind = 'block'))`, topicsArg, readerArg)
+}
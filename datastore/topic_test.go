@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"github.com/omarqazi/hearst/auth"
+	"testing"
+)
+
+// Function TestMatchTopic checks that member topics, session scopes and
+// message queries agree on every pattern
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		topic    string
+		matches  bool
+	}{
+		{nil, "anything", true},
+		{[]string{"chat"}, "chat", true},
+		{[]string{"chat"}, "chatter", false},
+		{[]string{"telemetry.*"}, "telemetry.gps", true},
+		{[]string{"telemetry.*"}, "telemetryXgps", false},
+		{[]string{"telemetry.*"}, "telemetry.gps/raw", false},
+		{[]string{"chat", "telemetry.*"}, "telemetry.", true},
+		{[]string{"a+b"}, "aab", false},
+		{[]string{"chat?"}, "chats", false},
+		{[]string{"chat?"}, "chat?", true},
+		{[]string{"chat[0-9]"}, "chat1", false},
+		{[]string{"chat[0-9]"}, "chat[0-9]", true},
+		{[]string{`chat\*`}, "chat*", false},
+		{[]string{`chat\*`}, `chat\x`, true},
+	}
+
+	for _, c := range cases {
+		if got := MatchTopic(c.patterns, c.topic); got != c.matches {
+			t.Error("Error: matching", c.topic, "against", c.patterns, "should be", c.matches, "but got", got)
+		}
+
+		if got := (auth.Scope{Topics: c.patterns}).AllowsTopic(c.topic); got != c.matches {
+			t.Error("Error: scope matching", c.topic, "against", c.patterns, "should be", c.matches, "but got", got)
+		}
+
+		var matched bool
+		err := PostgresDb.Get(&matched, "select $2::text[] = '{}' or $1 ~ any($2)", c.topic, topicRegexps(c.patterns))
+		if err != nil || matched != c.matches {
+			t.Error("Error: postgres matching", c.topic, "against", c.patterns, "should be", c.matches, "but got", matched, err)
+		}
+	}
+}
+
+func TestMemberTopics(t *testing.T) {
+	device, viewer := testMailbox(t), testMailbox(t)
+	thread := testThread(t, "topics")
+
+	deviceMember := ThreadMember{MailboxId: device.Id, Role: RoleMember, WriteTopics: []string{"telemetry.*"}}
+	viewerMember := ThreadMember{MailboxId: viewer.Id, Role: RoleViewer, ReadTopics: []string{"chat"}}
+	for _, member := range []*ThreadMember{&deviceMember, &viewerMember} {
+		if err := thread.AddMember(member); err != nil {
+			t.Fatal("Error adding thread member:", err)
+		}
+	}
+
+	gps := Message{ThreadId: thread.Id, SenderMailboxId: device.Id, Topic: "telemetry.gps"}
+	chat := Message{ThreadId: thread.Id, SenderMailboxId: device.Id, Topic: "chat"}
+	if !device.Can(ActionCreate, gps) || device.Can(ActionCreate, chat) {
+		t.Fatal("Error: device write topics not enforced")
+	}
+
+	if device.AuthorizeUpdate(gps, chat) == nil {
+		t.Fatal("Error: device could move a message to a topic it can not write")
+	}
+
+	testMessages(t, &gps, &chat)
+
+	if !viewer.Can(ActionRead, chat) || viewer.Can(ActionRead, gps) {
+		t.Fatal("Error: viewer read topics not enforced")
+	}
+
+	messages, err := thread.RecentMessagesWithTopic("", 100, viewer.Member(thread.Id), nil)
+	if err != nil {
+		t.Fatal("Error getting messages with read topics:", err)
+	}
+
+	if len(messages) != 1 || messages[0].Id != chat.Id {
+		t.Fatal("Expected only the chat message but got", messages)
+	}
+}
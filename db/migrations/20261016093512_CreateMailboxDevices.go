@@ -0,0 +1,35 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261016093512(txn *sql.Tx) {
+	sql := `
+	create table mailbox_devices (
+		id uuid not null,
+		mailbox_id uuid not null,
+		createdat timestamp with time zone not null,
+		updatedat timestamp with time zone not null,
+		name text,
+		public_key text not null,
+		constraint mailbox_devices_pk primary key (id)
+	)
+	with (
+		OIDS=FALSE
+	);
+	create index mailbox_devices_mailbox on mailbox_devices(mailbox_id);
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error creating mailbox devices table:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261016093512(txn *sql.Tx) {
+	if _, err := txn.Exec("drop table mailbox_devices;"); err != nil {
+		fmt.Println("Error dropping mailbox_devices table:", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261016141207(txn *sql.Tx) {
+	sql := `
+	create table thread_invitations (
+		id uuid not null,
+		thread_id uuid not null,
+		creator_id uuid not null,
+		createdat timestamp with time zone not null,
+		updatedat timestamp with time zone not null,
+		expires_at timestamp with time zone not null,
+		allow_read boolean default false,
+		allow_write boolean default false,
+		allow_notification boolean default false,
+		max_uses integer not null default 0,
+		uses integer not null default 0,
+		token text not null,
+		constraint thread_invitations_pk primary key (id)
+	)
+	with (
+		OIDS=FALSE
+	);
+	create index thread_invitations_creator on thread_invitations(creator_id, thread_id);
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error creating thread invitations table:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261016141207(txn *sql.Tx) {
+	if _, err := txn.Exec("drop table thread_invitations;"); err != nil {
+		fmt.Println("Error dropping thread_invitations table:", err)
+	}
+}
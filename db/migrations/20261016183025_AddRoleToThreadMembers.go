@@ -0,0 +1,26 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied. Members have no creation
+// time, so there is no way to tell which one created a thread. Every member
+// that could write becomes an owner and the rest become viewers
+func Up_20261016183025(txn *sql.Tx) {
+	sql := `
+	alter table thread_members add column role text not null default 'member';
+	update thread_members set role = case when allow_write then 'owner' else 'viewer' end;
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error adding role column to thread members table", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261016183025(txn *sql.Tx) {
+	if _, err := txn.Exec("alter table thread_members drop column role;"); err != nil {
+		fmt.Println("Error dropping role column from thread members table:", err)
+	}
+}
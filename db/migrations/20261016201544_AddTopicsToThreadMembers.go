@@ -0,0 +1,28 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261016201544(txn *sql.Tx) {
+	sql := `
+	alter table thread_members add column read_topics text[];
+	alter table thread_members add column write_topics text[];
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error adding topic columns to thread members table", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261016201544(txn *sql.Tx) {
+	sql := `
+	alter table thread_members drop column read_topics;
+	alter table thread_members drop column write_topics;
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error dropping topic columns from thread members table:", err)
+	}
+}
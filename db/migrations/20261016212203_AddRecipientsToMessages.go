@@ -0,0 +1,23 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261016212203(txn *sql.Tx) {
+	sql := `
+	alter table messages add column recipients text[];
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error adding recipients column to messages table", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261016212203(txn *sql.Tx) {
+	if _, err := txn.Exec("alter table messages drop column recipients;"); err != nil {
+		fmt.Println("Error dropping recipients column from messages table:", err)
+	}
+}
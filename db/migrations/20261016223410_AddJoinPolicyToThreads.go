@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied. Existing threads
+// stay invite-only, which is how every thread worked before
+func Up_20261016223410(txn *sql.Tx) {
+	sql := `
+	alter table threads add column join_policy text not null default 'invite-only';
+	create table thread_join_requests (
+		id uuid not null,
+		thread_id uuid not null,
+		mailbox_id uuid not null,
+		createdat timestamp with time zone not null,
+		updatedat timestamp with time zone not null,
+		note text not null default '',
+		constraint thread_join_requests_pk primary key (id),
+		constraint thread_join_requests_unique unique (thread_id, mailbox_id)
+	)
+	with (
+		OIDS=FALSE
+	);
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error adding join policies to threads:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261016223410(txn *sql.Tx) {
+	sql := `
+	drop table thread_join_requests;
+	alter table threads drop column join_policy;
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error removing join policies from threads:", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261017090241(txn *sql.Tx) {
+	sql := `
+	alter table threads add column listed boolean not null default false;
+	alter table threads add column labels text[];
+	create index threads_listed on threads(updatedat) where listed;
+	create index threads_labels on threads using gin(labels);
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error adding directory listing to threads:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261017090241(txn *sql.Tx) {
+	sql := `
+	drop index threads_labels;
+	drop index threads_listed;
+	alter table threads drop column labels;
+	alter table threads drop column listed;
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error removing directory listing from threads:", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261017113905(txn *sql.Tx) {
+	sql := `
+	create table mailbox_groups (
+		id uuid not null,
+		createdat timestamp with time zone not null,
+		updatedat timestamp with time zone not null,
+		name text not null,
+		constraint mailbox_groups_pk primary key (id)
+	)
+	with (
+		OIDS=FALSE
+	);
+	create table group_members (
+		group_id uuid not null,
+		mailbox_id uuid not null,
+		admin boolean not null default false,
+		constraint group_members_pk primary key (group_id, mailbox_id)
+	)
+	with (
+		OIDS=FALSE
+	);
+	create index group_members_mailbox on group_members(mailbox_id);
+	create table thread_groups (
+		thread_id uuid not null,
+		group_id uuid not null,
+		allow_read boolean default false,
+		allow_write boolean default false,
+		allow_notification boolean default false,
+		constraint thread_groups_pk primary key (thread_id, group_id)
+	)
+	with (
+		OIDS=FALSE
+	);
+	create index thread_groups_group on thread_groups(group_id);
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error creating mailbox group tables:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261017113905(txn *sql.Tx) {
+	if _, err := txn.Exec("drop table thread_groups; drop table group_members; drop table mailbox_groups;"); err != nil {
+		fmt.Println("Error dropping mailbox group tables:", err)
+	}
+}
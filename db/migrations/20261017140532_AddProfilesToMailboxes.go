@@ -0,0 +1,35 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied. Handles are stored in
+// lower case and are unique when they are set
+func Up_20261017140532(txn *sql.Tx) {
+	sql := `
+	alter table mailboxes add column handle text not null default '';
+	alter table mailboxes add column display_name text not null default '';
+	alter table mailboxes add column avatar text not null default '';
+	alter table mailboxes add column profile jsonb not null default '{}';
+	create unique index mailboxes_handle on mailboxes(handle) where handle <> '';
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error adding profiles to mailboxes table:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261017140532(txn *sql.Tx) {
+	sql := `
+	drop index mailboxes_handle;
+	alter table mailboxes drop column profile;
+	alter table mailboxes drop column avatar;
+	alter table mailboxes drop column display_name;
+	alter table mailboxes drop column handle;
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error removing profiles from mailboxes table:", err)
+	}
+}
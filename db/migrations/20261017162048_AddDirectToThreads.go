@@ -0,0 +1,20 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261017162048(txn *sql.Tx) {
+	if _, err := txn.Exec("alter table threads add column direct boolean not null default false;"); err != nil {
+		fmt.Println("Error adding direct column to threads table:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261017162048(txn *sql.Tx) {
+	if _, err := txn.Exec("alter table threads drop column direct;"); err != nil {
+		fmt.Println("Error dropping direct column from threads table:", err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261017183320(txn *sql.Tx) {
+	sql := `
+	create table mailbox_blocks (
+		mailbox_id uuid not null,
+		blocked_id uuid not null,
+		kind text not null,
+		createdat timestamp with time zone not null,
+		constraint mailbox_blocks_pk primary key (mailbox_id, blocked_id)
+	)
+	with (
+		OIDS=FALSE
+	);
+	create index mailbox_blocks_blocked on mailbox_blocks(blocked_id);
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error creating mailbox blocks table:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261017183320(txn *sql.Tx) {
+	if _, err := txn.Exec("drop table mailbox_blocks;"); err != nil {
+		fmt.Println("Error dropping mailbox blocks table:", err)
+	}
+}
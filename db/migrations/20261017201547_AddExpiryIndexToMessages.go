@@ -0,0 +1,20 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261017201547(txn *sql.Tx) {
+	if _, err := txn.Exec("create index messages_expiresat on messages(expiresat) where expiresat is not null;"); err != nil {
+		fmt.Println("Error creating expiry index on messages table:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261017201547(txn *sql.Tx) {
+	if _, err := txn.Exec("drop index messages_expiresat;"); err != nil {
+		fmt.Println("Error dropping expiry index from messages table:", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied. The indexed expression
+// must stay the same as messageDocument in datastore/search.go
+func Up_20261017224105(txn *sql.Tx) {
+	sql := `
+	create index messages_search on messages using gin (
+		(setweight(to_tsvector('english', coalesce(body, '')), 'A') ||
+		setweight(to_tsvector('english', coalesce(topic, '')), 'B'))
+	);
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error creating search index on messages table:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261017224105(txn *sql.Tx) {
+	if _, err := txn.Exec("drop index messages_search;"); err != nil {
+		fmt.Println("Error dropping search index from messages table:", err)
+	}
+}
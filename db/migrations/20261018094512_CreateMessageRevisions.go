@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Up is executed when this migration is applied
+func Up_20261018094512(txn *sql.Tx) {
+	sql := `
+	alter table messages add column edited boolean not null default false;
+	alter table messages add column edit_count integer not null default 0;
+	create table message_revisions (
+		message_id uuid not null,
+		revision integer not null,
+		createdat timestamp with time zone not null,
+		topic text,
+		body text,
+		labels jsonb,
+		payload jsonb,
+		recipients text[],
+		constraint message_revisions_pk primary key (message_id, revision)
+	)
+	with (
+		OIDS=FALSE
+	);
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error creating message revisions table:", err)
+	}
+}
+
+// Down is executed when this migration is rolled back
+func Down_20261018094512(txn *sql.Tx) {
+	sql := `
+	drop table message_revisions;
+	alter table messages drop column edited;
+	alter table messages drop column edit_count;
+	`
+	if _, err := txn.Exec(sql); err != nil {
+		fmt.Println("Error dropping message revisions table:", err)
+	}
+}
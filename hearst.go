@@ -1,18 +1,54 @@
 package main
 
 import (
+	"flag"
+	"github.com/omarqazi/hearst/controller"
+	"github.com/omarqazi/hearst/datastore"
 	"log"
 	"net/http"
+	"os"
+	"time"
 )
 
 const startMessage = "Starting Hearst on port "
 const errorMessage = "Error starting server:"
 const bindAddress = ":8080"
 
-func init() {
-	log.Println(startMessage, bindAddress)
-}
+// How often to rotate server session keys, as a duration like "168h".
+// Rotation is disabled when this is not set
+const keyRotationVariable = "HEARST_KEY_ROTATION_INTERVAL"
+
+// How often to delete expired messages, as a duration like "30s". Expired
+// messages are hidden as soon as they expire, and deleted every minute when
+// this is not set. Set it to "0" to disable the reaper
+const reapIntervalVariable = "HEARST_REAP_INTERVAL"
+const defaultReapInterval = time.Minute
+
+var rotateKeys = flag.Bool("rotate-keys", false, "rotate the server session keys and exit")
 
 func main() {
+	flag.Parse()
+	if *rotateKeys {
+		if err := controller.RotateServerKeys(); err != nil {
+			log.Fatalln("Error rotating server session keys:", err)
+		}
+		log.Println("Rotated server session keys")
+		return
+	}
+
+	if interval, err := time.ParseDuration(os.Getenv(keyRotationVariable)); err == nil && interval > 0 {
+		go controller.RotateServerKeysEvery(interval)
+	}
+
+	reapInterval := defaultReapInterval
+	if interval, err := time.ParseDuration(os.Getenv(reapIntervalVariable)); err == nil {
+		reapInterval = interval
+	}
+
+	if reapInterval > 0 {
+		go datastore.ReapExpiredMessagesEvery(reapInterval)
+	}
+
+	log.Println(startMessage, bindAddress)
 	log.Fatalln(errorMessage, http.ListenAndServe(bindAddress, nil))
 }
@@ -8,13 +8,16 @@ import (
 const staticPath = "www"
 
 var routes = map[string]http.Handler{
-	"/":          http.FileServer(http.Dir(staticPath)),
-	"/mailbox/":  controller.MailboxController{},
-	"/thread/":   controller.ThreadController{},
-	"/messages/": controller.MessageController{},
-	"/socket/":   controller.WebSocketController{},
-	"/sock/":     controller.SockController{},
-	"/auth/":     controller.AuthController{},
+	"/":           http.FileServer(http.Dir(staticPath)),
+	"/mailbox/":   controller.MailboxController{},
+	"/thread/":    controller.ThreadController{},
+	"/messages/":  controller.MessageController{},
+	"/socket/":    controller.WebSocketController{},
+	"/sock/":      controller.SockController{},
+	"/auth/":      controller.AuthController{},
+	"/directory/": controller.DirectoryController{},
+	"/group/":     controller.GroupController{},
+	"/search/":    controller.SearchController{},
 }
 
 func init() {